@@ -4,13 +4,18 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/cache"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/handlers"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/middleware"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
 )
 
 var db *database.DB
@@ -69,9 +74,61 @@ func main() {
 	}
 	defer redisClient.Close()
 
+	// Payments go through the in-process fake until a real provider is wired in
+	paymentProvider := payments.NewFake()
+
+	// Immediate cancellations are refunded according to REFUND_POLICY
+	refundPolicy := billing.DefaultRefundPolicy
+	if mode := os.Getenv("REFUND_POLICY"); mode != "" {
+		windowDays, _ := strconv.Atoi(os.Getenv("REFUND_WINDOW_DAYS"))
+		refundPolicy, err = billing.ParseRefundPolicy(mode, windowDays)
+		if err != nil {
+			log.Fatalf("Invalid refund policy: %v", err)
+		}
+	}
+
+	// Gifts waiting for a new or changed email are claimed according to
+	// GIFT_CLAIM_POLICY
+	claimPolicy := billing.DefaultGiftClaimPolicy
+	if mode := os.Getenv("GIFT_CLAIM_POLICY"); mode != "" {
+		claimPolicy, err = billing.ParseGiftClaimPolicy(mode)
+		if err != nil {
+			log.Fatalf("Invalid gift claim policy: %v", err)
+		}
+	}
+
+	// End users authenticate with JWTs signed by a key in AUTH_JWKS_FILE;
+	// without one, only API keys are accepted
+	var jwtKeys *auth.KeySet
+	if path := os.Getenv("AUTH_JWKS_FILE"); path != "" {
+		jwtKeys, err = auth.LoadKeySet(path)
+		if err != nil {
+			log.Fatalf("Invalid JWT key set: %v", err)
+		}
+		jwtKeys.Issuer = os.Getenv("AUTH_JWT_ISSUER")
+		jwtKeys.Audience = os.Getenv("AUTH_JWT_AUDIENCE")
+	}
+
 	// Initialize handlers
-	subHandler := handlers.NewSubscriptionHandler(db)
-	giftHandler := handlers.NewGiftHandler(db)
+	subHandler := handlers.NewSubscriptionHandler(db, paymentProvider, refundPolicy)
+	redeemFailures := middleware.NewFailureLimiter(redisClient, "gift-redeem", middleware.GiftRedeemFailureLimit, middleware.GiftRedeemFailureWindow)
+	giftHandler := handlers.NewGiftHandler(db, paymentProvider, redeemFailures)
+	planHandler := handlers.NewPlanHandler(db)
+	paymentMethodHandler := handlers.NewPaymentMethodHandler(db)
+	couponHandler := handlers.NewCouponHandler(db)
+	invoiceHandler := handlers.NewInvoiceHandler(db)
+	creditHandler := handlers.NewCreditHandler(db)
+	ledgerHandler := handlers.NewLedgerHandler(db)
+	userHandler := handlers.NewUserHandler(db, claimPolicy)
+
+	userRouter := handlers.NewUserRouter()
+	userRouter.Handle("", userHandler.User)
+	userRouter.Handle("invoices", invoiceHandler.UserInvoices)
+	userRouter.Handle("balance", creditHandler.Balance)
+	userRouter.Handle("credit/grant", creditHandler.Grant)
+	userRouter.Handle("credit/debit", creditHandler.Debit)
+	userRouter.Handle("gifts/sent", giftHandler.SentGifts)
+	userRouter.Handle("pending-gifts", userHandler.PendingGifts)
 
 	// Setup routes
 	mux := http.NewServeMux()
@@ -79,27 +136,60 @@ func main() {
 	// Health endpoint
 	mux.HandleFunc("/health", healthHandler)
 
+	// Plan catalog endpoints
+	mux.HandleFunc("/plans", planHandler.Plans)
+	mux.HandleFunc("/plans/", planHandler.Plan)
+
+	// Coupon endpoints
+	mux.HandleFunc("/coupons", couponHandler.Coupons)
+	mux.HandleFunc("/coupons/", couponHandler.Coupon)
+
 	// Subscription endpoints
 	mux.HandleFunc("/subscribe", subHandler.Subscribe)
 	mux.HandleFunc("/renew", subHandler.Renew)
 	mux.HandleFunc("/cancel", subHandler.Cancel)
-	mux.HandleFunc("/subscriptions/", subHandler.GetUserSubscriptions)
+	mux.HandleFunc("/subscriptions/", subHandler.Subscriptions)
+
+	// User endpoints
+	mux.HandleFunc("/users", userHandler.Users)
+	mux.Handle("/users/", userRouter)
+
+	// Invoice endpoints
+	mux.HandleFunc("/invoices/", invoiceHandler.GetInvoice)
+
+	// Accounting endpoints
+	mux.HandleFunc("/ledger/trial-balance", ledgerHandler.TrialBalance)
+	mux.HandleFunc("/revenue/report", ledgerHandler.RevenueReport)
+
+	// Payment method endpoints
+	mux.HandleFunc("/payment-methods", paymentMethodHandler.AddPaymentMethod)
 
 	// Gift endpoints
 	mux.HandleFunc("/gift", giftHandler.CreateGift)
 	mux.HandleFunc("/gift/redeem", giftHandler.RedeemGift)
-
-	// Apply middleware
+	mux.HandleFunc("/gift/", giftHandler.Gifts)
+	mux.HandleFunc("/gift/batch", giftHandler.CreateBatch)
+	mux.HandleFunc("/gift/batch/", giftHandler.Batches)
+	mux.HandleFunc("/gifts/received", giftHandler.ReceivedGifts)
+
+	// Apply middleware. Every request but /health is authenticated, so
+	// idempotency keys are scoped to the caller.
+	authenticate := middleware.Authenticate(jwtKeys, db)
 	handler := middleware.RateLimiter(redisClient)(
-		middleware.Idempotency(redisClient)(mux),
+		authenticate(middleware.Idempotency(redisClient)(mux)),
 	)
+	readHandler := authenticate(mux)
 
-	// Custom handler to skip idempotency for GET requests
+	// Custom handler to skip rate limiting and idempotency for GET requests
 	finalHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet || strings.HasPrefix(r.URL.Path, "/health") {
+		if strings.HasPrefix(r.URL.Path, "/health") {
 			mux.ServeHTTP(w, r)
 			return
 		}
+		if r.Method == http.MethodGet {
+			readHandler.ServeHTTP(w, r)
+			return
+		}
 		handler.ServeHTTP(w, r)
 	})
 
@@ -114,12 +204,47 @@ func main() {
 	log.Println("Starting server on :8080")
 	log.Println("Available endpoints:")
 	log.Println("  GET  /health")
+	log.Println("  GET  /plans")
+	log.Println("  POST /plans")
+	log.Println("  GET  /plans/{code}")
+	log.Println("  PUT  /plans/{code}")
+	log.Println("  DELETE /plans/{code}")
+	log.Println("  GET  /coupons")
+	log.Println("  POST /coupons")
+	log.Println("  GET  /coupons/{code}")
+	log.Println("  DELETE /coupons/{code}")
 	log.Println("  POST /subscribe")
 	log.Println("  POST /renew")
 	log.Println("  POST /cancel")
+	log.Println("  POST /users")
+	log.Println("  GET  /users?email=")
+	log.Println("  GET  /users/{id}")
+	log.Println("  PATCH /users/{id}")
+	log.Println("  GET  /users/{id}/invoices")
+	log.Println("  GET  /users/{id}/balance")
+	log.Println("  POST /users/{id}/credit/grant")
+	log.Println("  POST /users/{id}/credit/debit")
+	log.Println("  GET  /users/{id}/gifts/sent")
+	log.Println("  GET  /users/{id}/pending-gifts")
+	log.Println("  GET  /invoices/{id}")
+	log.Println("  GET  /ledger/trial-balance")
+	log.Println("  GET  /revenue/report")
+	log.Println("  POST /payment-methods")
 	log.Println("  POST /gift")
 	log.Println("  POST /gift/redeem")
+	log.Println("  POST /gift/{id}/revoke")
+	log.Println("  POST /gift/{id}/recipient")
+	log.Println("  GET  /gifts/received?email=")
+	log.Println("  POST /gift/batch")
+	log.Println("  GET  /gift/batch/{id}")
+	log.Println("  GET  /gift/batch/{id}/report")
+	log.Println("  POST /gift/batch/{id}/revoke")
 	log.Println("  GET  /subscriptions/{user_id}")
+	log.Println("  POST /subscriptions/{id}/change-plan")
+	log.Println("  POST /subscriptions/{id}/undo-cancel")
+	log.Println("  POST /subscriptions/{id}/auto-renew")
+	log.Println("  POST /subscriptions/{id}/pause")
+	log.Println("  POST /subscriptions/{id}/resume")
 
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
@@ -0,0 +1,57 @@
+// Command apikey issues and revokes API keys for server-to-server callers.
+//
+//	apikey -name billing-sync   issue a key and print it once
+//	apikey -revoke 3            revoke key 3
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+)
+
+func main() {
+	name := flag.String("name", "", "name of the caller the key is issued to")
+	revoke := flag.Int("revoke", 0, "ID of a key to revoke")
+	flag.Parse()
+
+	if (*name == "") == (*revoke == 0) {
+		log.Fatal("Exactly one of -name or -revoke is required")
+	}
+
+	// Connect to database
+	db, err := database.New()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if *revoke != 0 {
+		revoked, err := db.RevokeAPIKey(*revoke)
+		if err != nil {
+			log.Fatalf("Failed to revoke API key: %v", err)
+		}
+		if !revoked {
+			log.Fatalf("No active API key with ID %d", *revoke)
+		}
+		log.Printf("Revoked API key %d", *revoke)
+		return
+	}
+
+	key, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		log.Fatalf("Failed to generate API key: %v", err)
+	}
+
+	apiKey, err := db.CreateAPIKey(*name, prefix, hash)
+	if err != nil {
+		log.Fatalf("Failed to store API key: %v", err)
+	}
+
+	// The key is not stored, so this is the only time it can be shown
+	log.Printf("Created API key %d (%s) for %s", apiKey.ID, apiKey.Prefix, apiKey.Name)
+	fmt.Println(key)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/jobs"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
+)
+
+func main() {
+	interval := getEnvDuration("WORKER_INTERVAL", time.Minute)
+	batchSize := getEnvInt("WORKER_BATCH_SIZE", 500)
+	renewalLead := getEnvDuration("RENEWAL_LEAD_TIME", 24*time.Hour)
+
+	retrySchedule := billing.DefaultRetrySchedule
+	if value := os.Getenv("DUNNING_SCHEDULE"); value != "" {
+		schedule, err := billing.ParseRetrySchedule(value)
+		if err != nil {
+			log.Fatalf("Invalid DUNNING_SCHEDULE: %v", err)
+		}
+		retrySchedule = schedule
+	}
+
+	// Payments go through the in-process fake until a real provider is wired in
+	paymentProvider := payments.NewFake()
+
+	// Connect to database
+	db, err := database.New()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	scheduler := jobs.NewScheduler(interval,
+		jobs.NewSubscriptionExpiry(db, batchSize),
+		jobs.NewGiftDelivery(db, batchSize),
+		jobs.NewGiftExpiry(db, batchSize),
+		jobs.NewAutoResume(db, batchSize),
+		jobs.NewTrialEnd(db, batchSize),
+		jobs.NewRevenueRecognition(db, batchSize),
+		jobs.NewRenewalCharge(db, paymentProvider, retrySchedule, renewalLead),
+	)
+
+	log.Printf("Starting worker (interval %v, batch size %d, dunning schedule %v days)", interval, batchSize, retrySchedule)
+	scheduler.Start(ctx)
+	log.Println("Worker stopped")
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// APIKeyPrefix starts every API key, so leaked keys are easy to spot
+const APIKeyPrefix = "sk_"
+
+// apiKeyDisplayLength is how much of a key is kept in the clear to tell
+// keys apart
+const apiKeyDisplayLength = len(APIKeyPrefix) + 8
+
+// GenerateAPIKey returns a new API key with its display prefix and hash.
+// The key itself is shown once and never stored.
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	key = APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, key[:apiKeyDisplayLength], HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hex SHA-256 of key. Keys carry 256 random bits, so
+// a fast unsalted hash is enough and lets keys be looked up by hash.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signing algorithms accepted for bearer tokens
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// ClockSkew is how far token times may be off from the server's clock
+const ClockSkew = time.Minute
+
+// Token errors
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrUnknownKey     = errors.New("token signed with an unknown key")
+	ErrBadSignature   = errors.New("invalid token signature")
+	ErrTokenExpired   = errors.New("token expired")
+	ErrTokenNotYet    = errors.New("token not valid yet")
+	ErrWrongIssuer    = errors.New("token issued by an untrusted issuer")
+	ErrWrongAudience  = errors.New("token intended for another audience")
+)
+
+// signingKey is one verification key. The algorithm is fixed by the key,
+// never taken from the token, so a token cannot pick a weaker check.
+type signingKey struct {
+	alg    string
+	secret []byte
+	rsa    *rsa.PublicKey
+	ecdsa  *ecdsa.PublicKey
+}
+
+// KeySet verifies bearer tokens against locally configured keys. Issuer
+// and Audience, when set, must match the token's iss and aud claims.
+type KeySet struct {
+	keys     map[string]signingKey
+	Issuer   string
+	Audience string
+}
+
+// jwk is a key in a JSON Web Key Set (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadKeySet reads a JSON Web Key Set from a file
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key set: %w", err)
+	}
+	return ParseKeySet(data)
+}
+
+// ParseKeySet parses a JSON Web Key Set holding symmetric ("oct") keys for
+// HS256, RSA keys for RS256 and P-256 keys for ES256. Every key needs a
+// kid so tokens can name the key they were signed with.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("key set has no keys")
+	}
+
+	ks := &KeySet{keys: make(map[string]signingKey)}
+	for _, k := range set.Keys {
+		if k.Kid == "" {
+			return nil, errors.New("every key needs a kid")
+		}
+		if _, dup := ks.keys[k.Kid]; dup {
+			return nil, fmt.Errorf("duplicate kid %q", k.Kid)
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		ks.keys[k.Kid] = key
+	}
+	return ks, nil
+}
+
+func parseJWK(k jwk) (signingKey, error) {
+	switch k.Kty {
+	case "oct":
+		if k.Alg != "" && k.Alg != AlgHS256 {
+			return signingKey{}, fmt.Errorf("unsupported alg %q for oct key", k.Alg)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) < 32 {
+			return signingKey{}, errors.New("oct key must be at least 256 bits of base64url")
+		}
+		return signingKey{alg: AlgHS256, secret: secret}, nil
+
+	case "RSA":
+		if k.Alg != "" && k.Alg != AlgRS256 {
+			return signingKey{}, fmt.Errorf("unsupported alg %q for RSA key", k.Alg)
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return signingKey{}, errors.New("invalid RSA modulus or exponent")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return signingKey{}, errors.New("RSA key must be at least 2048 bits")
+		}
+		return signingKey{alg: AlgRS256, rsa: pub}, nil
+
+	case "EC":
+		if k.Crv != "P-256" || (k.Alg != "" && k.Alg != AlgES256) {
+			return signingKey{}, fmt.Errorf("unsupported EC key %q/%q", k.Crv, k.Alg)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return signingKey{}, errors.New("invalid EC coordinates")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return signingKey{}, fmt.Errorf("invalid EC point: %w", err)
+		}
+		return signingKey{alg: AlgES256, ecdsa: pub}, nil
+
+	default:
+		return signingKey{}, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// Claims are the registered claims of a verified token
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+}
+
+// rawClaims is the token payload as sent. aud may be a string or a list,
+// and the dates are seconds since the epoch, possibly fractional.
+type rawClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *json.Number    `json:"exp"`
+	Nbf *json.Number    `json:"nbf"`
+	Iat *json.Number    `json:"iat"`
+}
+
+// Verify checks a compact JWS token's signature, expiry, not-before,
+// issuer and audience at now and returns its claims. Tokens must expire.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	key, ok := ks.keys[header.Kid]
+	if !ok && header.Kid == "" && len(ks.keys) == 1 {
+		// A set with a single key needs no kid to pick it
+		for _, only := range ks.keys {
+			key, ok = only, true
+		}
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if header.Alg != key.alg {
+		return nil, ErrBadSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrBadSignature
+	}
+
+	var raw rawClaims
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, ErrMalformedToken
+	}
+	claims, err := raw.claims()
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if claims.ExpiresAt.IsZero() || !now.Before(claims.ExpiresAt.Add(ClockSkew)) {
+		return nil, ErrTokenExpired
+	}
+	if !claims.NotBefore.IsZero() && now.Add(ClockSkew).Before(claims.NotBefore) {
+		return nil, ErrTokenNotYet
+	}
+	if ks.Issuer != "" && claims.Issuer != ks.Issuer {
+		return nil, ErrWrongIssuer
+	}
+	if ks.Audience != "" && !contains(claims.Audience, ks.Audience) {
+		return nil, ErrWrongAudience
+	}
+	return claims, nil
+}
+
+func (k signingKey) verify(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch k.alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case AlgRS256:
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, digest[:], signature) == nil
+	case AlgES256:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k.ecdsa, digest[:], r, s)
+	}
+	return false
+}
+
+func (raw rawClaims) claims() (*Claims, error) {
+	c := &Claims{Subject: raw.Sub, Issuer: raw.Iss}
+
+	if len(raw.Aud) > 0 && !bytes.Equal(raw.Aud, []byte("null")) {
+		var one string
+		if err := json.Unmarshal(raw.Aud, &one); err == nil {
+			c.Audience = []string{one}
+		} else if err := json.Unmarshal(raw.Aud, &c.Audience); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, date := range []struct {
+		value *json.Number
+		into  *time.Time
+	}{{raw.Exp, &c.ExpiresAt}, {raw.Nbf, &c.NotBefore}, {raw.Iat, &c.IssuedAt}} {
+		if date.value == nil {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(date.value.String(), 64)
+		if err != nil {
+			return nil, err
+		}
+		*date.into = time.Unix(0, int64(seconds*float64(time.Second)))
+	}
+	return c, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
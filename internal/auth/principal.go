@@ -0,0 +1,55 @@
+// Package auth identifies API callers: end users by signed JWT bearer
+// tokens and server-to-server callers by API keys.
+package auth
+
+import (
+	"context"
+	"strconv"
+)
+
+// PrincipalKind tells end users from server-to-server callers
+type PrincipalKind string
+
+const (
+	// PrincipalUser is an end user, who may only act for themselves
+	PrincipalUser PrincipalKind = "user"
+	// PrincipalService is a trusted server-to-server caller, who may act
+	// for any user
+	PrincipalService PrincipalKind = "service"
+)
+
+// Principal is the authenticated caller of a request. UserID is set for
+// users and APIKeyID and Name for services.
+type Principal struct {
+	Kind     PrincipalKind
+	UserID   int
+	APIKeyID int
+	Name     string
+}
+
+// ID identifies the principal across requests, for scoping per-caller state
+func (p *Principal) ID() string {
+	if p.Kind == PrincipalUser {
+		return "user:" + strconv.Itoa(p.UserID)
+	}
+	return "key:" + strconv.Itoa(p.APIKeyID)
+}
+
+// CanActFor reports whether the principal may act on behalf of userID
+func (p *Principal) CanActFor(userID int) bool {
+	return p.Kind == PrincipalService || p.UserID == userID
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal stored in ctx, or nil when the request
+// was not authenticated
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,31 @@
+package billing
+
+import "fmt"
+
+// GiftClaimPolicy decides what happens to unredeemed gifts addressed to an
+// email when a user signs up with it or changes their email to it
+type GiftClaimPolicy string
+
+const (
+	// ClaimManual leaves the gifts for the user to find and redeem
+	ClaimManual GiftClaimPolicy = "manual"
+	// ClaimAttach ties the gifts to the account, so only that user can
+	// redeem them even if either email later changes
+	ClaimAttach GiftClaimPolicy = "attach"
+	// ClaimRedeem redeems delivered gifts straight onto the account and
+	// attaches the rest
+	ClaimRedeem GiftClaimPolicy = "redeem"
+)
+
+// DefaultGiftClaimPolicy attaches gifts without redeeming them
+const DefaultGiftClaimPolicy = ClaimAttach
+
+// ParseGiftClaimPolicy validates a gift claim policy
+func ParseGiftClaimPolicy(mode string) (GiftClaimPolicy, error) {
+	switch policy := GiftClaimPolicy(mode); policy {
+	case ClaimManual, ClaimAttach, ClaimRedeem:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid gift claim policy %q", mode)
+	}
+}
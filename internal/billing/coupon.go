@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+var (
+	ErrCouponInactive       = errors.New("coupon is not active")
+	ErrCouponNotYetValid    = errors.New("coupon is not valid yet")
+	ErrCouponExpired        = errors.New("coupon has expired")
+	ErrCouponPlanRestricted = errors.New("coupon does not apply to this plan")
+	ErrCouponCurrency       = errors.New("coupon currency does not match plan")
+	ErrCouponExhausted      = errors.New("coupon has reached its redemption limit")
+	ErrCouponUserLimit      = errors.New("coupon already used the maximum number of times by this user")
+)
+
+// Discount is the effect of a coupon on a single purchase
+type Discount struct {
+	CouponCode    string `json:"coupon_code"`
+	SubtotalCents int64  `json:"subtotal_cents"`
+	DiscountCents int64  `json:"discount_cents"`
+	TotalCents    int64  `json:"total_cents"`
+	FreeMonths    int    `json:"free_months"`
+}
+
+// CheckCoupon verifies that a coupon can be applied to plan at now. Global
+// and per-user redemption limits are enforced in the database where they
+// can be checked atomically.
+func CheckCoupon(c *models.Coupon, plan *models.Plan, now time.Time) error {
+	if !c.Active {
+		return ErrCouponInactive
+	}
+	if c.ValidFrom != nil && now.Before(*c.ValidFrom) {
+		return ErrCouponNotYetValid
+	}
+	if c.ValidUntil != nil && !now.Before(*c.ValidUntil) {
+		return ErrCouponExpired
+	}
+	if len(c.PlanCodes) > 0 {
+		allowed := false
+		for _, code := range c.PlanCodes {
+			if code == plan.Code {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrCouponPlanRestricted
+		}
+	}
+	if c.Kind == models.CouponAmount && c.Currency != nil && *c.Currency != plan.Currency {
+		return ErrCouponCurrency
+	}
+	return nil
+}
+
+// ApplyCoupon computes the discount a coupon gives on subtotal. A nil coupon
+// yields no discount. Amount-off coupons never take the total below zero.
+func ApplyCoupon(c *models.Coupon, subtotal int64) Discount {
+	d := Discount{SubtotalCents: subtotal, TotalCents: subtotal}
+	if c == nil {
+		return d
+	}
+
+	d.CouponCode = c.Code
+	switch c.Kind {
+	case models.CouponPercent:
+		if c.PercentOff != nil {
+			d.DiscountCents = (subtotal*int64(*c.PercentOff) + 50) / 100
+		}
+	case models.CouponAmount:
+		if c.AmountOffCents != nil {
+			d.DiscountCents = *c.AmountOffCents
+		}
+	case models.CouponFreeMonths:
+		if c.FreeMonths != nil {
+			d.FreeMonths = *c.FreeMonths
+		}
+	}
+
+	if d.DiscountCents > subtotal {
+		d.DiscountCents = subtotal
+	}
+	d.TotalCents = subtotal - d.DiscountCents
+	return d
+}
@@ -0,0 +1,64 @@
+package billing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetrySchedule retries a failed renewal charge 1, 3, 5 and 7 days
+// after the payment was due
+var DefaultRetrySchedule = RetrySchedule{1, 3, 5, 7}
+
+// RetrySchedule lists the days after the due date on which a failed
+// automatic charge is retried, in increasing order
+type RetrySchedule []int
+
+// ParseRetrySchedule parses a comma-separated list of days such as "1,3,5,7"
+func ParseRetrySchedule(s string) (RetrySchedule, error) {
+	var schedule RetrySchedule
+	for _, part := range strings.Split(s, ",") {
+		day, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || day <= 0 {
+			return nil, fmt.Errorf("invalid retry day %q", part)
+		}
+		if len(schedule) > 0 && day <= schedule[len(schedule)-1] {
+			return nil, fmt.Errorf("retry days must increase: %q", s)
+		}
+		schedule = append(schedule, day)
+	}
+	return schedule, nil
+}
+
+// NextAttempt returns when to retry after the given number of failed
+// attempts on a payment due at dueAt. It returns false once the schedule
+// is exhausted and the subscription should become unpaid.
+func (s RetrySchedule) NextAttempt(dueAt time.Time, failures int) (time.Time, bool) {
+	if failures < 1 || failures > len(s) {
+		return time.Time{}, false
+	}
+	return dueAt.AddDate(0, 0, s[failures-1]), true
+}
+
+// Results of an automatic charge attempt
+const (
+	AttemptSucceeded       = "succeeded"
+	AttemptDeclined        = "declined"
+	AttemptTimeout         = "timeout"
+	AttemptError           = "error"
+	AttemptNoPaymentMethod = "no_payment_method"
+	AttemptPlanRetired     = "plan_retired"
+)
+
+// PaymentAttempt is the outcome of one automatic charge for a subscription,
+// recorded in the transactions history
+type PaymentAttempt struct {
+	Attempt       int        `json:"attempt"`
+	Result        string     `json:"result"`
+	AmountCents   int64      `json:"amount_cents"`
+	Currency      string     `json:"currency"`
+	DueAt         time.Time  `json:"due_at"`
+	Status        string     `json:"status"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
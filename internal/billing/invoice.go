@@ -0,0 +1,78 @@
+package billing
+
+import (
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// InvoiceDraft is an invoice before it is numbered and stored. Positive
+// lines are charges; negative lines are discounts and credits.
+type InvoiceDraft struct {
+	UserID   int
+	Currency string
+	Lines    []models.InvoiceLine
+}
+
+// AddLine appends a line of quantity units at unitAmount each
+func (d *InvoiceDraft) AddLine(description string, quantity int, unitAmount int64) {
+	d.Lines = append(d.Lines, models.InvoiceLine{
+		Description:     description,
+		Quantity:        quantity,
+		UnitAmountCents: unitAmount,
+		AmountCents:     unitAmount * int64(quantity),
+	})
+}
+
+// Totals returns the sum of charges, the sum of discounts and credits, and
+// the amount due. The amount due is negative when credits exceed charges.
+func (d *InvoiceDraft) Totals() (subtotal, discount, total int64) {
+	for _, line := range d.Lines {
+		if line.AmountCents >= 0 {
+			subtotal += line.AmountCents
+		} else {
+			discount -= line.AmountCents
+		}
+	}
+	return subtotal, discount, subtotal - discount
+}
+
+// PurchaseInvoice drafts the invoice for months of service on plan with an
+// optional coupon applied. Used for subscribe, renew and gift purchases.
+func PurchaseInvoice(userID int, plan *models.Plan, months int, discount Discount, description string) InvoiceDraft {
+	d := InvoiceDraft{UserID: userID, Currency: plan.Currency}
+	d.AddLine(fmt.Sprintf("%s (%s plan, %d month%s)", description, plan.Name, months, plural(months)), 1, discount.SubtotalCents)
+
+	if discount.DiscountCents > 0 {
+		d.AddLine(fmt.Sprintf("Coupon %s", discount.CouponCode), 1, -discount.DiscountCents)
+	}
+	if discount.FreeMonths > 0 {
+		d.AddLine(fmt.Sprintf("Coupon %s: %d free month%s", discount.CouponCode, discount.FreeMonths, plural(discount.FreeMonths)), 1, 0)
+	}
+	return d
+}
+
+// GiftBatchInvoice drafts the invoice for a bulk gift purchase: one line
+// for count gifts of the same plan and length
+func GiftBatchInvoice(userID int, plan *models.Plan, months, count int) InvoiceDraft {
+	d := InvoiceDraft{UserID: userID, Currency: plan.Currency}
+	d.AddLine(fmt.Sprintf("Gifts (%s plan, %d month%s)", plan.Name, months, plural(months)), count, PlanAmount(plan, months))
+	return d
+}
+
+// PlanChangeInvoice drafts the invoice for an immediate plan change
+func PlanChangeInvoice(userID int, oldPlan, newPlan *models.Plan, p Proration) InvoiceDraft {
+	d := InvoiceDraft{UserID: userID, Currency: p.Currency}
+	d.AddLine(fmt.Sprintf("Remaining time on %s plan", newPlan.Name), 1, p.ChargeCents)
+	if p.CreditCents > 0 {
+		d.AddLine(fmt.Sprintf("Unused time on %s plan", oldPlan.Name), 1, -p.CreditCents)
+	}
+	return d
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
@@ -0,0 +1,189 @@
+package billing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// Ledger accounts
+const (
+	AccountCash              = "cash"
+	AccountCustomerCredit    = "customer_credit"
+	AccountDeferredRevenue   = "deferred_revenue"
+	AccountRecognizedRevenue = "recognized_revenue"
+	AccountGiftLiability     = "gift_liability"
+	AccountRefundsPayable    = "refunds_payable"
+	AccountCreditAdjustments = "credit_adjustments"
+)
+
+// JournalDraft is a journal entry before it is posted. Zero amounts are
+// dropped, so an operation that moves no money drafts an empty entry. A
+// zero EffectiveAt means the entry takes effect when it is posted.
+type JournalDraft struct {
+	Description string
+	EntityType  string
+	EntityID    int
+	Currency    string
+	EffectiveAt time.Time
+	Lines       []models.JournalLine
+}
+
+// Debit appends a debit of amount to account
+func (d *JournalDraft) Debit(account string, amount int64) {
+	if amount != 0 {
+		d.Lines = append(d.Lines, models.JournalLine{Account: account, DebitCents: amount, Currency: d.Currency})
+	}
+}
+
+// Credit appends a credit of amount to account
+func (d *JournalDraft) Credit(account string, amount int64) {
+	if amount != 0 {
+		d.Lines = append(d.Lines, models.JournalLine{Account: account, CreditCents: amount, Currency: d.Currency})
+	}
+}
+
+// Totals returns the sums of the debits and the credits
+func (d *JournalDraft) Totals() (debits, credits int64) {
+	for _, line := range d.Lines {
+		debits += line.DebitCents
+		credits += line.CreditCents
+	}
+	return debits, credits
+}
+
+// Balanced reports whether the debits equal the credits
+func (d *JournalDraft) Balanced() bool {
+	debits, credits := d.Totals()
+	return debits == credits
+}
+
+// InvoicePaymentJournal drafts the entry for a paid invoice. The money comes
+// from the card and from account credit; it is owed back as service, as
+// deferred revenue for subscriptions and as gift liability for gifts.
+func InvoicePaymentJournal(invoice *models.Invoice) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Payment of invoice %s", invoice.Number),
+		EntityType:  invoice.EntityType,
+		EntityID:    invoice.EntityID,
+		Currency:    invoice.Currency,
+	}
+	if invoice.TotalCents <= 0 {
+		return d
+	}
+
+	d.Debit(AccountCash, invoice.TotalCents-invoice.CreditCents)
+	d.Debit(AccountCustomerCredit, invoice.CreditCents)
+	if invoice.EntityType == "gift" || invoice.EntityType == "gift_batch" {
+		d.Credit(AccountGiftLiability, invoice.TotalCents)
+	} else {
+		d.Credit(AccountDeferredRevenue, invoice.TotalCents)
+	}
+	return d
+}
+
+// InvoiceCreditJournal drafts the entry for an invoice whose credits exceed
+// its charges: the unused service owed to the user becomes account credit
+func InvoiceCreditJournal(invoice *models.Invoice) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Credit from invoice %s", invoice.Number),
+		EntityType:  invoice.EntityType,
+		EntityID:    invoice.EntityID,
+		Currency:    invoice.Currency,
+	}
+	if invoice.TotalCents >= 0 {
+		return d
+	}
+
+	d.Debit(AccountDeferredRevenue, -invoice.TotalCents)
+	d.Credit(AccountCustomerCredit, -invoice.TotalCents)
+	return d
+}
+
+// CreditAdjustmentJournal drafts the entry for a manual grant (positive
+// amount) or debit (negative amount) of account credit
+func CreditAdjustmentJournal(userID int, amount int64, currency string) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Credit adjustment for user %d", userID),
+		EntityType:  "user",
+		EntityID:    userID,
+		Currency:    currency,
+	}
+	if amount > 0 {
+		d.Debit(AccountCreditAdjustments, amount)
+		d.Credit(AccountCustomerCredit, amount)
+	} else {
+		d.Debit(AccountCustomerCredit, -amount)
+		d.Credit(AccountCreditAdjustments, -amount)
+	}
+	return d
+}
+
+// GiftRedemptionJournal drafts the entry for a redeemed gift: what the
+// gifter paid stops being owed as a gift and is owed as service on the
+// recipient's subscription instead
+func GiftRedemptionJournal(gift *models.Gift, subscriptionID int) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Redemption of gift %d", gift.ID),
+		EntityType:  "subscription",
+		EntityID:    subscriptionID,
+		Currency:    gift.Currency,
+	}
+	d.Debit(AccountGiftLiability, gift.AmountCents)
+	d.Credit(AccountDeferredRevenue, gift.AmountCents)
+	return d
+}
+
+// GiftRevocationJournal drafts the entry for a revoked gift: what the
+// gifter paid is no longer owed as a gift but as a refund to the card and
+// as account credit
+func GiftRevocationJournal(gift *models.Gift, refund, credit int64) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Revocation of gift %d", gift.ID),
+		EntityType:  "gift",
+		EntityID:    gift.ID,
+		Currency:    gift.Currency,
+	}
+	d.Debit(AccountGiftLiability, refund+credit)
+	d.Credit(AccountRefundsPayable, refund)
+	d.Credit(AccountCustomerCredit, credit)
+	return d
+}
+
+// CancellationJournal drafts the entry for an immediate cancellation.
+// deferred is the revenue still deferred for the subscription, refund the
+// amount owed back to the card and credit the amount returned as account
+// credit. What is given back comes out of deferred revenue first; what is
+// left has been earned, and giving back more than is deferred reverses
+// revenue already recognized.
+func CancellationJournal(subscriptionID int, deferred, refund, credit int64, currency string) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Cancellation of subscription %d", subscriptionID),
+		EntityType:  "subscription",
+		EntityID:    subscriptionID,
+		Currency:    currency,
+	}
+
+	returned := refund + credit
+	fromDeferred := min(returned, deferred)
+	d.Debit(AccountDeferredRevenue, deferred)
+	d.Debit(AccountRecognizedRevenue, returned-fromDeferred)
+	d.Credit(AccountRecognizedRevenue, deferred-fromDeferred)
+	d.Credit(AccountRefundsPayable, refund)
+	d.Credit(AccountCustomerCredit, credit)
+	return d
+}
+
+// RefundPaymentJournal drafts the entry for a refund paid out to the card
+func RefundPaymentJournal(refund *models.Refund) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Payment of refund %d", refund.ID),
+		EntityType:  "refund",
+		EntityID:    refund.ID,
+		Currency:    refund.Currency,
+	}
+	d.Debit(AccountRefundsPayable, refund.AmountCents)
+	d.Credit(AccountCash, refund.AmountCents)
+	return d
+}
@@ -0,0 +1,76 @@
+package billing
+
+import (
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// secondsPerMonth is the length of an average month in a 365-day year.
+// Proration uses a fixed month length so the same remaining time always
+// yields the same amount regardless of calendar month.
+const secondsPerMonth = 365 * 24 * 60 * 60 / 12
+
+// ApplyAt controls when a plan change takes effect
+type ApplyAt string
+
+const (
+	ApplyNow       ApplyAt = "now"
+	ApplyPeriodEnd ApplyAt = "period_end"
+)
+
+// Proration is the money breakdown of a plan change
+type Proration struct {
+	OldPlan          string    `json:"old_plan"`
+	NewPlan          string    `json:"new_plan"`
+	ApplyAt          ApplyAt   `json:"apply_at"`
+	EffectiveAt      time.Time `json:"effective_at"`
+	RemainingSeconds int64     `json:"remaining_seconds"`
+	CreditCents      int64     `json:"credit_cents"`
+	ChargeCents      int64     `json:"charge_cents"`
+	NetCents         int64     `json:"net_cents"`
+	Currency         string    `json:"currency"`
+}
+
+// ProratedAmount returns the share of one billing interval of plan that
+// covers the given number of seconds, rounded to the nearest cent.
+func ProratedAmount(plan *models.Plan, seconds int64) int64 {
+	if seconds <= 0 {
+		return 0
+	}
+	intervalSeconds := int64(plan.IntervalMonths()) * secondsPerMonth
+	return (plan.PriceCents*seconds + intervalSeconds/2) / intervalSeconds
+}
+
+// PlanAmount returns the price of months of service on plan, rounded to
+// the nearest cent.
+func PlanAmount(plan *models.Plan, months int) int64 {
+	intervalMonths := int64(plan.IntervalMonths())
+	return (plan.PriceCents*int64(months) + intervalMonths/2) / intervalMonths
+}
+
+// Prorate computes the credit for the unused time on oldPlan and the charge
+// for the same time on newPlan. Changes applied at period end carry no
+// proration; the new plan is simply billed from the next renewal.
+func Prorate(oldPlan, newPlan *models.Plan, now, periodEnd time.Time, applyAt ApplyAt) Proration {
+	p := Proration{
+		OldPlan:  oldPlan.Code,
+		NewPlan:  newPlan.Code,
+		ApplyAt:  applyAt,
+		Currency: newPlan.Currency,
+	}
+
+	if applyAt == ApplyPeriodEnd {
+		p.EffectiveAt = periodEnd
+		return p
+	}
+
+	p.EffectiveAt = now
+	if periodEnd.After(now) {
+		p.RemainingSeconds = int64(periodEnd.Sub(now) / time.Second)
+	}
+	p.CreditCents = ProratedAmount(oldPlan, p.RemainingSeconds)
+	p.ChargeCents = ProratedAmount(newPlan, p.RemainingSeconds)
+	p.NetCents = p.ChargeCents - p.CreditCents
+	return p
+}
@@ -0,0 +1,134 @@
+package billing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// RefundMode selects how much of the last payment a cancellation returns
+type RefundMode string
+
+const (
+	RefundNone     RefundMode = "none"
+	RefundProrated RefundMode = "prorated"
+	RefundFull     RefundMode = "full"
+)
+
+// RefundPolicy decides what an immediate cancellation gives back. When
+// WindowDays is set, only cancellations within that many days of the last
+// payment qualify.
+type RefundPolicy struct {
+	Mode       RefundMode
+	WindowDays int
+}
+
+// DefaultRefundPolicy keeps cancellations refund-free
+var DefaultRefundPolicy = RefundPolicy{Mode: RefundNone}
+
+// ParseRefundPolicy validates a refund mode and window. A full refund
+// needs a window, otherwise every cancellation would return the whole
+// payment no matter how much of the period was used.
+func ParseRefundPolicy(mode string, windowDays int) (RefundPolicy, error) {
+	policy := RefundPolicy{Mode: RefundMode(mode), WindowDays: windowDays}
+	switch policy.Mode {
+	case RefundNone, RefundProrated:
+	case RefundFull:
+		if windowDays <= 0 {
+			return RefundPolicy{}, fmt.Errorf("full refunds require a refund window")
+		}
+	default:
+		return RefundPolicy{}, fmt.Errorf("invalid refund policy %q", mode)
+	}
+	if windowDays < 0 {
+		return RefundPolicy{}, fmt.Errorf("invalid refund window %d", windowDays)
+	}
+	return policy, nil
+}
+
+// RefundSummary is the money breakdown of a cancellation. AmountCents is
+// everything given back, split between RefundCents to the card and
+// CreditCents to account credit. RefundID and Status are filled in once a
+// refund has been recorded.
+type RefundSummary struct {
+	Policy           RefundMode          `json:"policy"`
+	InvoiceID        *int                `json:"invoice_id,omitempty"`
+	RemainingSeconds int64               `json:"remaining_seconds"`
+	AmountCents      int64               `json:"amount_cents"`
+	RefundCents      int64               `json:"refund_cents"`
+	CreditCents      int64               `json:"credit_cents"`
+	Currency         string              `json:"currency"`
+	RefundID         *int                `json:"refund_id,omitempty"`
+	Status           models.RefundStatus `json:"status,omitempty"`
+}
+
+// CancellationRefund computes what cancelling now returns under policy.
+// invoice is the last paid invoice for the subscription, or nil when
+// nothing was paid, and paidThrough is when the paid service would have
+// ended. Refunds never exceed what the invoice collected, and are split
+// between card and credit in the proportion the invoice was paid by each.
+func CancellationRefund(policy RefundPolicy, plan *models.Plan, invoice *models.Invoice, now, paidThrough time.Time) RefundSummary {
+	s := RefundSummary{Policy: policy.Mode, Currency: plan.Currency}
+	if invoice == nil {
+		return s
+	}
+	s.InvoiceID = &invoice.ID
+	s.Currency = invoice.Currency
+
+	if paidThrough.After(now) {
+		s.RemainingSeconds = int64(paidThrough.Sub(now) / time.Second)
+	}
+	if s.RemainingSeconds == 0 {
+		return s
+	}
+	if policy.WindowDays > 0 && now.After(invoice.IssuedAt.AddDate(0, 0, policy.WindowDays)) {
+		return s
+	}
+
+	switch policy.Mode {
+	case RefundFull:
+		s.AmountCents = invoice.TotalCents
+	case RefundProrated:
+		s.AmountCents = ProratedAmount(plan, s.RemainingSeconds)
+	}
+	if s.AmountCents > invoice.TotalCents {
+		s.AmountCents = invoice.TotalCents
+	}
+	s.RefundCents = cardShare(invoice, s.AmountCents)
+	s.CreditCents = s.AmountCents - s.RefundCents
+	return s
+}
+
+// cardShare is the part of amount, out of what invoice collected, that can
+// go back to the card: the proportion of the invoice charged to it, rounded
+// down so refunds against one charge never add up to more than it
+func cardShare(invoice *models.Invoice, amount int64) int64 {
+	if invoice == nil || invoice.TotalCents <= 0 {
+		return 0
+	}
+	charged := max(invoice.TotalCents-invoice.CreditCents, 0)
+	return min(amount, amount*charged/invoice.TotalCents)
+}
+
+// RevocationMethod selects how a revoked gift is paid back to the gifter
+type RevocationMethod string
+
+const (
+	RevokeToCard   RevocationMethod = "refund"
+	RevokeToCredit RevocationMethod = "credit"
+)
+
+// GiftRevocation splits what the gifter paid for a gift between a refund
+// to the card and account credit. Only what the invoice charged to the
+// card can go back to it: the gift's share of the invoice, which covers a
+// whole batch for bulk gifts, is refunded in the proportion the invoice
+// was paid by card, rounded down so a batch's refunds never exceed its
+// charge. The rest, or all of it when method is credit, returns as credit.
+// invoice is nil for gifts that were never invoiced.
+func GiftRevocation(gift *models.Gift, invoice *models.Invoice, method RevocationMethod) (refund, credit int64) {
+	if method == RevokeToCard {
+		refund = cardShare(invoice, gift.AmountCents)
+	}
+	return refund, gift.AmountCents - refund
+}
@@ -0,0 +1,71 @@
+package billing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// RecognizableAmount returns how much of the schedule's remaining revenue
+// is earned between its recognized_through and through. Revenue is earned
+// straight-line over the time left, so releasing part of a schedule
+// spreads the rest over what remains of the period.
+func RecognizableAmount(s *models.RevenueSchedule, through time.Time) int64 {
+	remaining := s.RemainingCents()
+	if remaining <= 0 || !through.After(s.RecognizedThrough) {
+		return 0
+	}
+	if !through.Before(s.EndsAt) {
+		return remaining
+	}
+
+	elapsed := int64(through.Sub(s.RecognizedThrough) / time.Second)
+	left := int64(s.EndsAt.Sub(s.RecognizedThrough) / time.Second)
+	return remaining * elapsed / left
+}
+
+// AllocateRelease splits amount across schedules, in the order given,
+// taking no more than each has remaining. It returns the share of each
+// schedule; any amount beyond what the schedules hold is left unallocated.
+func AllocateRelease(schedules []models.RevenueSchedule, amount int64) []int64 {
+	shares := make([]int64, len(schedules))
+	for i := range schedules {
+		share := min(amount, schedules[i].RemainingCents())
+		if share <= 0 {
+			continue
+		}
+		shares[i] = share
+		amount -= share
+	}
+	return shares
+}
+
+// RecognitionJournal drafts the entry that moves amount of a schedule from
+// deferred to recognized revenue, effective at through
+func RecognitionJournal(s *models.RevenueSchedule, amount int64, through time.Time) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Revenue recognized on schedule %d", s.ID),
+		EntityType:  s.EntityType,
+		EntityID:    s.EntityID,
+		Currency:    s.Currency,
+		EffectiveAt: through,
+	}
+	d.Debit(AccountDeferredRevenue, amount)
+	d.Credit(AccountRecognizedRevenue, amount)
+	return d
+}
+
+// GiftExpiryJournal drafts the entry for an expired gift: what the gifter
+// paid is no longer owed as a gift but as a refund
+func GiftExpiryJournal(giftID int, amount int64, currency string) JournalDraft {
+	d := JournalDraft{
+		Description: fmt.Sprintf("Expiry of gift %d", giftID),
+		EntityType:  "gift",
+		EntityID:    giftID,
+		Currency:    currency,
+	}
+	d.Debit(AccountGiftLiability, amount)
+	d.Credit(AccountRefundsPayable, amount)
+	return d
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// CreateAPIKey stores a new API key by its prefix and hash
+func (db *DB) CreateAPIKey(name, prefix, hash string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := db.QueryRow(
+		`INSERT INTO api_keys (name, key_prefix, key_hash) VALUES ($1, $2, $3)
+		 RETURNING id, name, key_prefix, key_hash, created_at, revoked_at`,
+		name, prefix, hash,
+	).Scan(&key.ID, &key.Name, &key.Prefix, &key.KeyHash, &key.CreatedAt, &key.RevokedAt)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API key: %w", err)
+	}
+	return &key, nil
+}
+
+// GetAPIKeyByHash retrieves an API key, revoked or not, by its hash
+func (db *DB) GetAPIKeyByHash(hash string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := db.QueryRow(
+		`SELECT id, name, key_prefix, key_hash, created_at, revoked_at FROM api_keys WHERE key_hash = $1`,
+		hash,
+	).Scan(&key.ID, &key.Name, &key.Prefix, &key.KeyHash, &key.CreatedAt, &key.RevokedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return &key, nil
+}
+
+// RevokeAPIKey revokes an API key and reports whether there was an active
+// key to revoke
+func (db *DB) RevokeAPIKey(id int) (bool, error) {
+	result, err := db.Exec(
+		`UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return rows > 0, nil
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const couponColumns = `id, code, kind, percent_off, amount_off_cents, currency, free_months, max_redemptions,
+		 per_user_limit, redemption_count, valid_from, valid_until, plan_codes, active, created_at`
+
+func scanCoupon(row rowScanner) (*models.Coupon, error) {
+	var c models.Coupon
+	err := row.Scan(&c.ID, &c.Code, &c.Kind, &c.PercentOff, &c.AmountOffCents, &c.Currency, &c.FreeMonths,
+		&c.MaxRedemptions, &c.PerUserLimit, &c.RedemptionCount, &c.ValidFrom, &c.ValidUntil,
+		pq.Array(&c.PlanCodes), &c.Active, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if c.PlanCodes == nil {
+		c.PlanCodes = []string{}
+	}
+	return &c, nil
+}
+
+// GetCouponByCode retrieves a coupon by its code
+func (db *DB) GetCouponByCode(code string) (*models.Coupon, error) {
+	coupon, err := scanCoupon(db.QueryRow(
+		`SELECT `+couponColumns+` FROM coupons WHERE code = $1`,
+		code,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get coupon: %w", err)
+	}
+	return coupon, nil
+}
+
+// ListCoupons retrieves all coupons, newest first
+func (db *DB) ListCoupons() ([]models.Coupon, error) {
+	rows, err := db.Query(
+		`SELECT ` + couponColumns + ` FROM coupons ORDER BY created_at DESC, id DESC`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list coupons: %w", err)
+	}
+	defer rows.Close()
+
+	coupons := []models.Coupon{}
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan coupon: %w", err)
+		}
+		coupons = append(coupons, *coupon)
+	}
+	return coupons, nil
+}
+
+// CreateCouponTx creates a coupon within a transaction
+func (db *DB) CreateCouponTx(tx *sql.Tx, req models.CouponRequest, idempotencyKey string) (*models.Coupon, error) {
+	planCodes := req.PlanCodes
+	if planCodes == nil {
+		planCodes = []string{}
+	}
+
+	coupon, err := scanCoupon(tx.QueryRow(
+		`INSERT INTO coupons (code, kind, percent_off, amount_off_cents, currency, free_months,
+		                      max_redemptions, per_user_limit, valid_from, valid_until, plan_codes)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		 RETURNING `+couponColumns,
+		req.Code, req.Kind, req.PercentOff, req.AmountOffCents, req.Currency, req.FreeMonths,
+		req.MaxRedemptions, req.PerUserLimit, req.ValidFrom, req.ValidUntil, pq.Array(planCodes),
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create coupon: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id)
+		 VALUES ($1, 'create', 'coupon', $2)`,
+		idempotencyKey, coupon.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return coupon, nil
+}
+
+// DeactivateCouponTx stops a coupon from being redeemed within a transaction
+func (db *DB) DeactivateCouponTx(tx *sql.Tx, code string, idempotencyKey string) (*models.Coupon, error) {
+	coupon, err := scanCoupon(tx.QueryRow(
+		`UPDATE coupons SET active = FALSE WHERE code = $1
+		 RETURNING `+couponColumns,
+		code,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to deactivate coupon: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id)
+		 VALUES ($1, 'deactivate', 'coupon', $2)`,
+		idempotencyKey, coupon.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return coupon, nil
+}
+
+// RedeemCouponTx records a coupon use against the transactions row written
+// for idempotencyKey. The conditional increment takes the coupon's row lock,
+// so concurrent redemptions of the same code are serialized: the global
+// limit is checked by the UPDATE itself and the per-user count is read only
+// after the lock is held. Returns billing.ErrCouponExhausted or
+// billing.ErrCouponUserLimit when a limit is hit.
+func (db *DB) RedeemCouponTx(tx *sql.Tx, coupon *models.Coupon, userID int, entityType string, entityID int, discount billing.Discount, idempotencyKey string) error {
+	var count int
+	err := tx.QueryRow(
+		`UPDATE coupons
+		 SET redemption_count = redemption_count + 1
+		 WHERE id = $1 AND active AND (max_redemptions IS NULL OR redemption_count < max_redemptions)
+		 RETURNING redemption_count`,
+		coupon.ID,
+	).Scan(&count)
+	if err == sql.ErrNoRows {
+		return billing.ErrCouponExhausted
+	}
+	if err != nil {
+		return fmt.Errorf("failed to redeem coupon: %w", err)
+	}
+
+	if coupon.PerUserLimit != nil {
+		var used int
+		err = tx.QueryRow(
+			`SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = $1 AND user_id = $2`,
+			coupon.ID, userID,
+		).Scan(&used)
+		if err != nil {
+			return fmt.Errorf("failed to count coupon redemptions: %w", err)
+		}
+		if used >= *coupon.PerUserLimit {
+			return billing.ErrCouponUserLimit
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO coupon_redemptions (coupon_id, user_id, transaction_id, entity_type, entity_id, discount_cents, free_months)
+		 SELECT $1, $2, id, $3, $4, $5, $6 FROM transactions WHERE idempotency_key = $7`,
+		coupon.ID, userID, entityType, entityID, discount.DiscountCents, discount.FreeMonths, idempotencyKey,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record coupon redemption: %w", err)
+	}
+
+	return nil
+}
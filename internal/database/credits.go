@@ -0,0 +1,241 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// ErrInsufficientCredit is returned when a debit would take a balance
+// below zero
+var ErrInsufficientCredit = errors.New("insufficient credit")
+
+const creditColumns = `id, user_id, amount_cents, currency, balance_cents, reason, entity_type, entity_id,
+		 transaction_id, created_at`
+
+func scanCreditEntry(row rowScanner) (*models.CreditEntry, error) {
+	var e models.CreditEntry
+	err := row.Scan(&e.ID, &e.UserID, &e.AmountCents, &e.Currency, &e.BalanceCents, &e.Reason,
+		&e.EntityType, &e.EntityID, &e.TransactionID, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// CreditBalanceTx returns the user's credit balance in currency within a
+// transaction. It locks the user's row until the transaction ends, so
+// balances read through it cannot change underneath the caller.
+func (db *DB) CreditBalanceTx(tx *sql.Tx, userID int, currency string) (int64, error) {
+	var id int
+	err := tx.QueryRow(`SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock user: %w", err)
+	}
+
+	var balance int64
+	err = tx.QueryRow(
+		`SELECT COALESCE((
+		     SELECT balance_cents FROM credit_ledger
+		     WHERE user_id = $1 AND currency = $2
+		     ORDER BY id DESC
+		     LIMIT 1
+		 ), 0)`,
+		userID, currency,
+	).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get credit balance: %w", err)
+	}
+	return balance, nil
+}
+
+// appendCreditTx adds entry to the ledger with the balance it leaves
+func (db *DB) appendCreditTx(tx *sql.Tx, entry models.CreditEntry) (*models.CreditEntry, error) {
+	balance, err := db.CreditBalanceTx(tx, entry.UserID, entry.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if balance+entry.AmountCents < 0 {
+		return nil, ErrInsufficientCredit
+	}
+
+	created, err := scanCreditEntry(tx.QueryRow(
+		`INSERT INTO credit_ledger (user_id, amount_cents, currency, balance_cents, reason,
+		                            entity_type, entity_id, transaction_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 RETURNING `+creditColumns,
+		entry.UserID, entry.AmountCents, entry.Currency, balance+entry.AmountCents, entry.Reason,
+		entry.EntityType, entry.EntityID, entry.TransactionID,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to append credit entry: %w", err)
+	}
+	return created, nil
+}
+
+// AdjustCreditTx grants (positive amount) or debits (negative amount)
+// account credit by hand within a transaction. Debits beyond the balance
+// fail with ErrInsufficientCredit.
+func (db *DB) AdjustCreditTx(tx *sql.Tx, userID int, amount int64, currency, reason, idempotencyKey string) (*models.CreditEntry, error) {
+	operation := "credit_grant"
+	if amount < 0 {
+		operation = "credit_debit"
+	}
+
+	// Record transaction
+	var transactionID int
+	err := tx.QueryRow(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, $2, 'user', $3, jsonb_build_object('amount_cents', $4::bigint, 'currency', $5::text, 'reason', $6::text))
+		 RETURNING id`,
+		idempotencyKey, operation, userID, amount, currency, reason,
+	).Scan(&transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	entry, err := db.appendCreditTx(tx, models.CreditEntry{
+		UserID:        userID,
+		AmountCents:   amount,
+		Currency:      currency,
+		Reason:        reason,
+		TransactionID: &transactionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.PostJournalTx(tx, billing.CreditAdjustmentJournal(userID, amount, currency), &transactionID); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// ApplyCreditTx draws down up to limit of the invoice owner's credit
+// against invoice within a transaction and returns the amount applied. It
+// must run before the remainder is charged to the payment provider.
+func (db *DB) ApplyCreditTx(tx *sql.Tx, invoice *models.Invoice, limit int64) (int64, error) {
+	balance, err := db.CreditBalanceTx(tx, invoice.UserID, invoice.Currency)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := min(balance, limit)
+	if applied <= 0 {
+		return 0, nil
+	}
+
+	entityType := "invoice"
+	_, err = db.appendCreditTx(tx, models.CreditEntry{
+		UserID:        invoice.UserID,
+		AmountCents:   -applied,
+		Currency:      invoice.Currency,
+		Reason:        "Applied to invoice " + invoice.Number,
+		EntityType:    &entityType,
+		EntityID:      &invoice.ID,
+		TransactionID: &invoice.TransactionID,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE invoices SET credit_applied_cents = credit_applied_cents + $1 WHERE id = $2`,
+		applied, invoice.ID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to apply credit to invoice: %w", err)
+	}
+	invoice.CreditCents += applied
+	return applied, nil
+}
+
+// CreditInvoiceTx moves the amount owed back on an invoice whose credits
+// exceed its charges onto the user's balance within a transaction, releases
+// it from the subscription's revenue schedules and marks the invoice paid
+func (db *DB) CreditInvoiceTx(tx *sql.Tx, invoice *models.Invoice) (*models.CreditEntry, error) {
+	if invoice.TotalCents >= 0 {
+		return nil, nil
+	}
+
+	entityType := "invoice"
+	entry, err := db.appendCreditTx(tx, models.CreditEntry{
+		UserID:        invoice.UserID,
+		AmountCents:   -invoice.TotalCents,
+		Currency:      invoice.Currency,
+		Reason:        "Credit from invoice " + invoice.Number,
+		EntityType:    &entityType,
+		EntityID:      &invoice.ID,
+		TransactionID: &invoice.TransactionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.PostJournalTx(tx, billing.InvoiceCreditJournal(invoice), &invoice.TransactionID); err != nil {
+		return nil, err
+	}
+	if invoice.EntityType == "subscription" {
+		if err := db.ReleaseRevenueTx(tx, invoice.EntityID, -invoice.TotalCents, invoice.Currency); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.MarkInvoicePaidTx(tx, invoice); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// CreditCancellationTx returns the credit part of a cancellation's refund
+// to the user's balance within the cancel's transaction
+func (db *DB) CreditCancellationTx(tx *sql.Tx, sub *models.Subscription, summary billing.RefundSummary, idempotencyKey string) (*models.CreditEntry, error) {
+	var transactionID int
+	err := tx.QueryRow(
+		`SELECT id FROM transactions WHERE idempotency_key = $1`,
+		idempotencyKey,
+	).Scan(&transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find transaction: %w", err)
+	}
+
+	entityType := "subscription"
+	return db.appendCreditTx(tx, models.CreditEntry{
+		UserID:        sub.UserID,
+		AmountCents:   summary.CreditCents,
+		Currency:      summary.Currency,
+		Reason:        fmt.Sprintf("Cancelled subscription %d", sub.ID),
+		EntityType:    &entityType,
+		EntityID:      &sub.ID,
+		TransactionID: &transactionID,
+	})
+}
+
+// GetCreditLedger retrieves a user's credit entries in the order they were
+// written
+func (db *DB) GetCreditLedger(userID int) ([]models.CreditEntry, error) {
+	rows, err := db.Query(
+		`SELECT `+creditColumns+`
+		 FROM credit_ledger
+		 WHERE user_id = $1
+		 ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credit ledger: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []models.CreditEntry{}
+	for rows.Next() {
+		entry, err := scanCreditEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan credit entry: %w", err)
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
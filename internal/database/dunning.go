@@ -0,0 +1,82 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// ClaimDueRenewalTx locks and returns one subscription whose automatic
+// charge is due, or nil when there is none. That is an auto-renewing active
+// subscription whose end_date falls within lead and whose retry, after a
+// charge failed ahead of end_date, has come; an auto-renewing trial past
+// trial_end whose user has a payment method; or an auto-renewing past_due
+// subscription whose next retry has come. The row is claimed with SKIP LOCKED so
+// concurrent workers never charge the same subscription twice.
+func (db *DB) ClaimDueRenewalTx(tx *sql.Tx, lead time.Duration) (*models.Subscription, error) {
+	sub, err := scanSubscription(tx.QueryRow(
+		`SELECT `+subscriptionColumns+`
+		 FROM subscriptions s
+		 WHERE (s.status = 'active' AND s.auto_renew AND NOT s.cancel_at_period_end
+		        AND s.end_date <= NOW() + interval '1 second' * $1
+		        AND (s.next_payment_attempt_at IS NULL OR s.next_payment_attempt_at <= NOW()))
+		    OR (s.status = 'pending' AND s.auto_renew AND s.trial_end <= NOW()
+		        AND EXISTS (SELECT 1 FROM payment_methods pm WHERE pm.user_id = s.user_id))
+		    OR (s.status = 'past_due' AND s.auto_renew AND s.next_payment_attempt_at <= NOW())
+		 ORDER BY COALESCE(s.next_payment_attempt_at, s.end_date)
+		 LIMIT 1
+		 FOR UPDATE SKIP LOCKED`,
+		int64(lead/time.Second),
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim renewal: %w", err)
+	}
+	return sub, nil
+}
+
+// UpdateDunningTx records a failed automatic charge within a transaction.
+// status stays active, with nextAttemptAt at end_date, when the charge
+// failed ahead of end_date; it is past_due while retries remain, with
+// nextAttemptAt set, and unpaid or expired once the subscription leaves
+// dunning.
+func (db *DB) UpdateDunningTx(tx *sql.Tx, subscriptionID int, status models.SubscriptionStatus, attempts int, nextAttemptAt *time.Time) (*models.Subscription, error) {
+	sub, err := scanSubscription(tx.QueryRow(
+		`UPDATE subscriptions
+		 SET status = $1, payment_attempts = $2, next_payment_attempt_at = $3, updated_at = NOW()
+		 WHERE id = $4 AND status IN ('active', 'pending', 'past_due')
+		 RETURNING `+subscriptionColumns,
+		status, attempts, nextAttemptAt, subscriptionID,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to update dunning: %w", err)
+	}
+	return sub, nil
+}
+
+// RecordPaymentAttemptTx writes one automatic charge attempt to the
+// transactions history within a transaction
+func (db *DB) RecordPaymentAttemptTx(tx *sql.Tx, subscriptionID int, attempt billing.PaymentAttempt, idempotencyKey string) error {
+	metadata, err := json.Marshal(attempt)
+	if err != nil {
+		return fmt.Errorf("failed to encode payment attempt: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'payment_attempt', 'subscription', $2, $3)`,
+		idempotencyKey, subscriptionID, string(metadata),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// recordEventTx writes a domain event to the outbox within the transaction
+// that made the change it describes
+func (db *DB) recordEventTx(tx *sql.Tx, eventType, entityType string, entityID int, payload interface{}, transactionID *int) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode event payload: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO events (event_type, entity_type, entity_id, payload, transaction_id)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		eventType, entityType, entityID, data, transactionID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record event: %w", err)
+	}
+	return nil
+}
+
+// giftDeliveredTx records the gift.delivered event for a gift that has
+// just become visible to its recipient. The payload carries everything the
+// delivery email needs, including the redemption code.
+func (db *DB) giftDeliveredTx(tx *sql.Tx, gift *models.Gift, transactionID int) error {
+	payload := map[string]interface{}{
+		"gift_id":         gift.ID,
+		"recipient_email": gift.RecipientEmail,
+		"redemption_code": gift.RedemptionCode,
+		"sender_name":     gift.SenderName,
+		"message":         gift.Message,
+		"plan":            gift.PlanCode,
+		"duration_months": gift.DurationMonths,
+		"delivered_at":    gift.DeliveredAt,
+		"expires_at":      gift.ExpiresAt,
+	}
+	return db.recordEventTx(tx, models.EventGiftDelivered, "gift", gift.ID, payload, &transactionID)
+}
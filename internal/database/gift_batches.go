@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const giftBatchColumns = `id, gifter_id, plan_code, duration_months, mode, requested_count, created_count,
+		 amount_cents, currency, created_at`
+
+func scanGiftBatch(row rowScanner) (*models.GiftBatch, error) {
+	var b models.GiftBatch
+	err := row.Scan(&b.ID, &b.GifterID, &b.PlanCode, &b.DurationMonths, &b.Mode, &b.RequestedCount, &b.CreatedCount,
+		&b.AmountCents, &b.Currency, &b.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// CreateGiftBatchTx creates a batch and a gift for each of recipients
+// within a transaction, each gift costing amount. The batch's transaction
+// uses idempotencyKey and each gift's is derived from it and the gift's
+// position, so the whole order is keyed by the one request.
+func (db *DB) CreateGiftBatchTx(tx *sql.Tx, req *models.GiftBatchRequest, plan *models.Plan, recipients []models.GiftBatchRecipient, amount int64, idempotencyKey string) (*models.GiftBatch, []models.Gift, error) {
+	batch, err := scanGiftBatch(tx.QueryRow(
+		`INSERT INTO gift_batches (gifter_id, plan_code, duration_months, mode, requested_count, created_count,
+		                           amount_cents, currency)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 RETURNING `+giftBatchColumns,
+		req.GifterID, plan.Code, req.DurationMonths, req.Mode, len(req.Recipients), len(recipients),
+		amount*int64(len(recipients)), plan.Currency,
+	))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create gift batch: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'create', 'gift_batch', $2, jsonb_build_object('plan', $3::text, 'mode', $4::text,
+		         'requested_count', $5::int, 'created_count', $6::int))`,
+		idempotencyKey, batch.ID, batch.PlanCode, string(batch.Mode), batch.RequestedCount, batch.CreatedCount,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	gifts := make([]models.Gift, 0, len(recipients))
+	for i, recipient := range recipients {
+		giftReq := models.GiftRequest{
+			GifterID:       req.GifterID,
+			RecipientEmail: recipient.Email,
+			Plan:           plan.Code,
+			DurationMonths: req.DurationMonths,
+			Open:           req.Open,
+			DeliverAt:      req.DeliverAt,
+			Message:        recipient.Message,
+			SenderName:     recipient.SenderName,
+		}
+		gift, err := db.createGiftTx(tx, &giftReq, plan, req.DurationMonths, amount, &batch.ID,
+			fmt.Sprintf("%s:gift:%d", idempotencyKey, i+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		gifts = append(gifts, *gift)
+	}
+
+	return batch, gifts, nil
+}
+
+// GetGiftBatch retrieves a gift batch by ID
+func (db *DB) GetGiftBatch(id int) (*models.GiftBatch, error) {
+	batch, err := scanGiftBatch(db.QueryRow(
+		`SELECT `+giftBatchColumns+` FROM gift_batches WHERE id = $1`,
+		id,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gift batch: %w", err)
+	}
+	return batch, nil
+}
+
+// GetGiftBatchGifts retrieves a batch's gifts in the order they were created
+func (db *DB) GetGiftBatchGifts(batchID int) ([]models.Gift, error) {
+	return db.queryGifts(
+		`SELECT `+giftColumns+`
+		 FROM gifts
+		 WHERE batch_id = $1
+		 ORDER BY id`,
+		batchID,
+	)
+}
+
+// GetGiftBatchSummary counts a batch's gifts per status
+func (db *DB) GetGiftBatchSummary(batchID int) ([]models.GiftBatchStatusCount, error) {
+	rows, err := db.Query(
+		`SELECT status, COUNT(*), SUM(amount_cents)
+		 FROM gifts
+		 WHERE batch_id = $1
+		 GROUP BY status
+		 ORDER BY status`,
+		batchID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gift batch summary: %w", err)
+	}
+	defer rows.Close()
+
+	summary := []models.GiftBatchStatusCount{}
+	for rows.Next() {
+		var c models.GiftBatchStatusCount
+		if err := rows.Scan(&c.Status, &c.Count, &c.AmountCents); err != nil {
+			return nil, fmt.Errorf("failed to scan gift batch summary: %w", err)
+		}
+		summary = append(summary, c)
+	}
+	return summary, rows.Err()
+}
+
+// RevokeGiftBatchTx revokes every scheduled or pending gift in a batch
+// within a transaction, paying each back as RevokeGiftTx does against the
+// batch's invoice and payment. Gifts already redeemed, expired or revoked
+// are left alone. It returns the revoked gifts with the refunds and credit
+// entries they created.
+func (db *DB) RevokeGiftBatchTx(tx *sql.Tx, batch *models.GiftBatch, invoice *models.Invoice, payment *models.Payment, method billing.RevocationMethod, idempotencyKey string) ([]models.Gift, []models.Refund, []models.CreditEntry, error) {
+	rows, err := tx.Query(
+		`SELECT `+giftColumns+`
+		 FROM gifts
+		 WHERE batch_id = $1 AND status IN ('scheduled', 'pending')
+		 ORDER BY id
+		 FOR UPDATE`,
+		batch.ID,
+	)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to lock gifts: %w", err)
+	}
+
+	var revocable []*models.Gift
+	for rows.Next() {
+		gift, err := scanGift(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, nil, fmt.Errorf("failed to scan gift: %w", err)
+		}
+		revocable = append(revocable, gift)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	gifts := []models.Gift{}
+	refunds := []models.Refund{}
+	credits := []models.CreditEntry{}
+	var refundTotal, creditTotal int64
+	for _, gift := range revocable {
+		refundCents, creditCents := billing.GiftRevocation(gift, invoice, method)
+		revoked, refund, credit, err := db.RevokeGiftTx(tx, gift.ID, refundCents, creditCents, invoice, payment,
+			fmt.Sprintf("%s:gift:%d", idempotencyKey, gift.ID))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		gifts = append(gifts, *revoked)
+		if refund != nil {
+			refunds = append(refunds, *refund)
+		}
+		if credit != nil {
+			credits = append(credits, *credit)
+		}
+		refundTotal += refundCents
+		creditTotal += creditCents
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'revoke', 'gift_batch', $2, jsonb_build_object('revoked_count', $3::int,
+		         'refund_cents', $4::bigint, 'credit_cents', $5::bigint, 'currency', $6::text))`,
+		idempotencyKey, batch.ID, len(gifts), refundTotal, creditTotal, batch.Currency,
+	)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return gifts, refunds, credits, nil
+}
@@ -0,0 +1,276 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/giftcode"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// GetSentGifts retrieves the gifts a user bought, newest first
+func (db *DB) GetSentGifts(gifterID int) ([]models.Gift, error) {
+	return db.queryGifts(
+		`SELECT `+giftColumns+`
+		 FROM gifts
+		 WHERE gifter_id = $1
+		 ORDER BY created_at DESC, id DESC`,
+		gifterID,
+	)
+}
+
+// GetReceivedGifts retrieves the delivered gifts addressed to an email,
+// newest first. Scheduled gifts are left out until they are delivered.
+func (db *DB) GetReceivedGifts(email string) ([]models.Gift, error) {
+	return db.queryGifts(
+		`SELECT `+giftColumns+`
+		 FROM gifts
+		 WHERE recipient_email = $1 AND status <> 'scheduled'
+		 ORDER BY created_at DESC, id DESC`,
+		models.NormalizeEmail(email),
+	)
+}
+
+// GetPendingGifts retrieves the delivered, unexpired gifts waiting for a
+// user: those attached to their account and unattached ones addressed to
+// their email
+func (db *DB) GetPendingGifts(user *models.User) ([]models.Gift, error) {
+	return db.queryGifts(
+		`SELECT `+giftColumns+`
+		 FROM gifts
+		 WHERE (recipient_id = $1 OR (recipient_id IS NULL AND recipient_email = $2))
+		   AND status = 'pending' AND expires_at > NOW()
+		 ORDER BY created_at, id`,
+		user.ID, models.NormalizeEmail(user.Email),
+	)
+}
+
+func (db *DB) queryGifts(query string, args ...interface{}) ([]models.Gift, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gifts: %w", err)
+	}
+	defer rows.Close()
+
+	gifts := []models.Gift{}
+	for rows.Next() {
+		gift, err := scanGift(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan gift: %w", err)
+		}
+		gifts = append(gifts, *gift)
+	}
+	return gifts, rows.Err()
+}
+
+// RevokeGiftTx revokes a scheduled or pending gift within a transaction and
+// pays the gifter back: refundCents as a pending refund against the gift's
+// invoice and payment, and creditCents to their account credit. It returns
+// the revoked gift and the refund and credit entry it created, either of
+// which is nil when its amount is zero. Like a cancellation refund, the
+// refund points at the invoice, the transaction it billed and its payment.
+func (db *DB) RevokeGiftTx(tx *sql.Tx, giftID int, refundCents, creditCents int64, invoice *models.Invoice, payment *models.Payment, idempotencyKey string) (*models.Gift, *models.Refund, *models.CreditEntry, error) {
+	gift, err := scanGift(tx.QueryRow(
+		`UPDATE gifts
+		 SET status = 'revoked', revoked_at = NOW()
+		 WHERE id = $1 AND status IN ('scheduled', 'pending')
+		 RETURNING `+giftColumns,
+		giftID,
+	))
+
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to revoke gift: %w", err)
+	}
+
+	// Record transaction
+	var transactionID int
+	err = tx.QueryRow(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'revoke', 'gift', $2, jsonb_build_object('refund_cents', $3::bigint, 'credit_cents', $4::bigint,
+		         'currency', $5::text))
+		 RETURNING id`,
+		idempotencyKey, gift.ID, refundCents, creditCents, gift.Currency,
+	).Scan(&transactionID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	var refund *models.Refund
+	if refundCents > 0 {
+		var paymentID *int
+		if payment != nil {
+			paymentID = &payment.ID
+		}
+
+		refund, err = scanRefund(tx.QueryRow(
+			`INSERT INTO refunds (user_id, entity_type, entity_id, amount_cents, currency, reason,
+			                      invoice_id, transaction_id, payment_id)
+			 VALUES ($1, 'gift', $2, $3, $4, 'gift_revoked', $5, $6, $7)
+			 RETURNING `+refundColumns,
+			gift.GifterID, gift.ID, refundCents, gift.Currency, invoice.ID, invoice.TransactionID, paymentID,
+		))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create refund: %w", err)
+		}
+	}
+
+	var credit *models.CreditEntry
+	if creditCents > 0 {
+		entityType := "gift"
+		credit, err = db.appendCreditTx(tx, models.CreditEntry{
+			UserID:        gift.GifterID,
+			AmountCents:   creditCents,
+			Currency:      gift.Currency,
+			Reason:        fmt.Sprintf("Revoked gift %d", gift.ID),
+			EntityType:    &entityType,
+			EntityID:      &gift.ID,
+			TransactionID: &transactionID,
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	draft := billing.GiftRevocationJournal(gift, refundCents, creditCents)
+	if _, err := db.PostJournalTx(tx, draft, &transactionID); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return gift, refund, credit, nil
+}
+
+// ChangeGiftRecipientTx readdresses a scheduled or pending gift within a
+// transaction. The gift gets a new redemption code, so the code sent to the
+// old address stops working, it is no longer attached to the old
+// recipient's account, and a delivered gift is delivered again to the new
+// one.
+func (db *DB) ChangeGiftRecipientTx(tx *sql.Tx, giftID int, recipientEmail string, idempotencyKey string) (*models.Gift, error) {
+	code, err := giftcode.Generate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate redemption code: %w", err)
+	}
+
+	var previousEmail string
+	err = tx.QueryRow(
+		`SELECT recipient_email FROM gifts
+		 WHERE id = $1 AND status IN ('scheduled', 'pending')
+		 FOR UPDATE`,
+		giftID,
+	).Scan(&previousEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock gift: %w", err)
+	}
+
+	gift, err := scanGift(tx.QueryRow(
+		`UPDATE gifts
+		 SET recipient_email = $1, redemption_code = $2, recipient_id = NULL
+		 WHERE id = $3
+		 RETURNING `+giftColumns,
+		models.NormalizeEmail(recipientEmail), code, giftID,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to change gift recipient: %w", err)
+	}
+
+	// Record transaction
+	var transactionID int
+	err = tx.QueryRow(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'change_recipient', 'gift', $2, jsonb_build_object('from', $3::text, 'to', $4::text))
+		 RETURNING id`,
+		idempotencyKey, gift.ID, previousEmail, gift.RecipientEmail,
+	).Scan(&transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	if gift.Status == models.GiftPending {
+		if err := db.giftDeliveredTx(tx, gift, transactionID); err != nil {
+			return nil, err
+		}
+	}
+
+	return gift, nil
+}
+
+// ClaimGiftsTx applies policy, within a transaction, to the unattached
+// scheduled and pending gifts addressed to a user's email. Under
+// ClaimRedeem, delivered gifts are redeemed onto existing, the user's
+// current subscription, or onto a new one when it is nil, as long as it
+// could be extended by a gift; everything else is attached. Each gift gets
+// its own transaction, keyed from idempotencyKey.
+func (db *DB) ClaimGiftsTx(tx *sql.Tx, user *models.User, existing *models.Subscription, policy billing.GiftClaimPolicy, idempotencyKey string) (*models.GiftClaims, error) {
+	claims := &models.GiftClaims{Attached: []models.Gift{}, Redeemed: []models.Gift{}}
+	if policy == billing.ClaimManual {
+		return claims, nil
+	}
+
+	rows, err := tx.Query(
+		`SELECT `+giftColumns+`
+		 FROM gifts
+		 WHERE recipient_email = $1 AND recipient_id IS NULL AND status IN ('scheduled', 'pending')
+		 ORDER BY id
+		 FOR UPDATE`,
+		models.NormalizeEmail(user.Email),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock gifts: %w", err)
+	}
+
+	var unclaimed []*models.Gift
+	for rows.Next() {
+		gift, err := scanGift(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan gift: %w", err)
+		}
+		unclaimed = append(unclaimed, gift)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	canRedeem := policy == billing.ClaimRedeem &&
+		(existing == nil || existing.Status == models.StatusActive || existing.Status == models.StatusPaused)
+	now := time.Now()
+
+	for _, gift := range unclaimed {
+		if canRedeem && gift.Status == models.GiftPending && gift.ExpiresAt.After(now) {
+			sub, redeemed, err := db.RedeemGiftTx(tx, gift.ID, user.ID, existing,
+				fmt.Sprintf("%s:redeem:gift:%d", idempotencyKey, gift.ID))
+			if err != nil {
+				return nil, err
+			}
+			existing = sub
+			claims.Redeemed = append(claims.Redeemed, *redeemed)
+			claims.Subscription = sub
+			continue
+		}
+
+		attached, err := scanGift(tx.QueryRow(
+			`UPDATE gifts SET recipient_id = $1 WHERE id = $2
+			 RETURNING `+giftColumns,
+			user.ID, gift.ID,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("failed to attach gift: %w", err)
+		}
+
+		// Record transaction
+		_, err = tx.Exec(
+			`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+			 VALUES ($1, 'claim', 'gift', $2, jsonb_build_object('user_id', $3::int, 'policy', $4::text))`,
+			fmt.Sprintf("%s:claim:gift:%d", idempotencyKey, gift.ID), gift.ID, user.ID, string(policy),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record transaction: %w", err)
+		}
+		claims.Attached = append(claims.Attached, *attached)
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const invoiceColumns = `id, number, user_id, entity_type, entity_id, transaction_id, subtotal_cents,
+		 discount_cents, total_cents, credit_applied_cents, currency, status, issued_at`
+
+func scanInvoice(row rowScanner) (*models.Invoice, error) {
+	var inv models.Invoice
+	err := row.Scan(&inv.ID, &inv.Number, &inv.UserID, &inv.EntityType, &inv.EntityID, &inv.TransactionID,
+		&inv.SubtotalCents, &inv.DiscountCents, &inv.TotalCents, &inv.CreditCents, &inv.Currency, &inv.Status, &inv.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// CreateInvoiceTx numbers and stores an invoice within a transaction. It
+// must run in the same transaction as the operation it bills, after the
+// operation's transactions row for idempotencyKey has been written. The
+// counter row stays locked until commit, so numbers are sequential and a
+// rollback never leaves a gap; callers must therefore make any payment
+// provider call before numbering the invoice, never while holding the lock.
+func (db *DB) CreateInvoiceTx(tx *sql.Tx, draft billing.InvoiceDraft, entityType string, entityID int, idempotencyKey string) (*models.Invoice, error) {
+	var seq int64
+	err := tx.QueryRow(
+		`UPDATE invoice_counters SET last_value = last_value + 1
+		 WHERE name = 'invoice'
+		 RETURNING last_value`,
+	).Scan(&seq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate invoice number: %w", err)
+	}
+
+	subtotal, discount, total := draft.Totals()
+
+	inv, err := scanInvoice(tx.QueryRow(
+		`INSERT INTO invoices (number, user_id, entity_type, entity_id, transaction_id,
+		                       subtotal_cents, discount_cents, total_cents, currency)
+		 SELECT $1, $2, $3, $4, id, $5, $6, $7, $8
+		 FROM transactions WHERE idempotency_key = $9
+		 RETURNING `+invoiceColumns,
+		fmt.Sprintf("INV-%06d", seq), draft.UserID, entityType, entityID,
+		subtotal, discount, total, draft.Currency, idempotencyKey,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invoice: %w", err)
+	}
+
+	for _, line := range draft.Lines {
+		err := tx.QueryRow(
+			`INSERT INTO invoice_lines (invoice_id, description, quantity, unit_amount_cents, amount_cents)
+			 VALUES ($1, $2, $3, $4, $5)
+			 RETURNING id`,
+			inv.ID, line.Description, line.Quantity, line.UnitAmountCents, line.AmountCents,
+		).Scan(&line.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create invoice line: %w", err)
+		}
+		line.InvoiceID = inv.ID
+		inv.Lines = append(inv.Lines, line)
+	}
+
+	return inv, nil
+}
+
+// GetInvoiceByID retrieves an invoice and its lines
+func (db *DB) GetInvoiceByID(id int) (*models.Invoice, error) {
+	inv, err := scanInvoice(db.QueryRow(
+		`SELECT `+invoiceColumns+` FROM invoices WHERE id = $1`,
+		id,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice: %w", err)
+	}
+
+	rows, err := db.Query(
+		`SELECT id, invoice_id, description, quantity, unit_amount_cents, amount_cents
+		 FROM invoice_lines
+		 WHERE invoice_id = $1
+		 ORDER BY id`,
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice lines: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line models.InvoiceLine
+		err := rows.Scan(&line.ID, &line.InvoiceID, &line.Description, &line.Quantity,
+			&line.UnitAmountCents, &line.AmountCents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan invoice line: %w", err)
+		}
+		inv.Lines = append(inv.Lines, line)
+	}
+	return inv, nil
+}
+
+// GetUserInvoices retrieves all invoices for a user, newest first, without
+// their lines
+func (db *DB) GetUserInvoices(userID int) ([]models.Invoice, error) {
+	rows, err := db.Query(
+		`SELECT `+invoiceColumns+`
+		 FROM invoices
+		 WHERE user_id = $1
+		 ORDER BY issued_at DESC, id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoices: %w", err)
+	}
+	defer rows.Close()
+
+	invoices := []models.Invoice{}
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan invoice: %w", err)
+		}
+		invoices = append(invoices, *inv)
+	}
+	return invoices, nil
+}
+
+// GetLastPaidInvoice retrieves the most recent paid invoice that collected
+// money for an entity, without its lines
+func (db *DB) GetLastPaidInvoice(entityType string, entityID int) (*models.Invoice, error) {
+	inv, err := scanInvoice(db.QueryRow(
+		`SELECT `+invoiceColumns+`
+		 FROM invoices
+		 WHERE entity_type = $1 AND entity_id = $2 AND status = 'paid' AND total_cents > 0
+		 ORDER BY issued_at DESC, id DESC
+		 LIMIT 1`,
+		entityType, entityID,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice: %w", err)
+	}
+	return inv, nil
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// ErrUnbalancedEntry is returned for a journal entry whose debits and
+// credits differ
+var ErrUnbalancedEntry = errors.New("journal entry does not balance")
+
+// PostJournalTx posts a journal entry within a transaction, linked to the
+// transactions row that caused it when there is one. Empty drafts post
+// nothing and yield a nil entry. The database re-checks the balance at
+// commit, so an unbalanced entry can never be committed.
+func (db *DB) PostJournalTx(tx *sql.Tx, draft billing.JournalDraft, transactionID *int) (*models.JournalEntry, error) {
+	if len(draft.Lines) == 0 {
+		return nil, nil
+	}
+	if !draft.Balanced() {
+		return nil, ErrUnbalancedEntry
+	}
+
+	var effectiveAt *time.Time
+	if !draft.EffectiveAt.IsZero() {
+		effectiveAt = &draft.EffectiveAt
+	}
+
+	entry := models.JournalEntry{
+		TransactionID: transactionID,
+		Description:   draft.Description,
+		EntityType:    draft.EntityType,
+		EntityID:      draft.EntityID,
+	}
+	err := tx.QueryRow(
+		`INSERT INTO journal_entries (transaction_id, description, entity_type, entity_id, effective_at)
+		 VALUES ($1, $2, $3, $4, COALESCE($5, NOW()))
+		 RETURNING id, effective_at, created_at`,
+		transactionID, draft.Description, draft.EntityType, draft.EntityID, effectiveAt,
+	).Scan(&entry.ID, &entry.EffectiveAt, &entry.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	for _, line := range draft.Lines {
+		err := tx.QueryRow(
+			`INSERT INTO journal_lines (entry_id, account, debit_cents, credit_cents, currency)
+			 VALUES ($1, $2, $3, $4, $5)
+			 RETURNING id`,
+			entry.ID, line.Account, line.DebitCents, line.CreditCents, line.Currency,
+		).Scan(&line.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create journal line: %w", err)
+		}
+		line.EntryID = entry.ID
+		entry.Lines = append(entry.Lines, line)
+	}
+
+	return &entry, nil
+}
+
+// GetTrialBalance totals every account's debits and credits per currency
+func (db *DB) GetTrialBalance() ([]models.TrialBalanceRow, error) {
+	rows, err := db.Query(
+		`SELECT a.code, a.type, l.currency, SUM(l.debit_cents), SUM(l.credit_cents)
+		 FROM journal_lines l
+		 JOIN accounts a ON a.code = l.account
+		 GROUP BY a.code, a.type, l.currency
+		 ORDER BY l.currency, a.code`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trial balance: %w", err)
+	}
+	defer rows.Close()
+
+	balance := []models.TrialBalanceRow{}
+	for rows.Next() {
+		var row models.TrialBalanceRow
+		if err := rows.Scan(&row.Account, &row.Type, &row.Currency, &row.DebitCents, &row.CreditCents); err != nil {
+			return nil, fmt.Errorf("failed to scan trial balance: %w", err)
+		}
+		balance = append(balance, row)
+	}
+	return balance, rows.Err()
+}
@@ -0,0 +1,22 @@
+-- Plans table (catalog of purchasable plans)
+CREATE TABLE IF NOT EXISTS plans (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) UNIQUE NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    price_cents BIGINT NOT NULL CHECK (price_cents >= 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    billing_interval VARCHAR(20) NOT NULL CHECK (billing_interval IN ('month', 'year')),
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Seed default plans so existing clients sending "monthly" keep working
+INSERT INTO plans (code, name, price_cents, currency, billing_interval)
+VALUES ('monthly', 'Monthly', 999, 'USD', 'month'),
+       ('annual', 'Annual', 9999, 'USD', 'year')
+ON CONFLICT (code) DO NOTHING;
+
+-- Record the plan on every subscription and gift
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS plan_code VARCHAR(50) NOT NULL DEFAULT 'monthly' REFERENCES plans(code);
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS plan_code VARCHAR(50) NOT NULL DEFAULT 'monthly' REFERENCES plans(code);
@@ -0,0 +1,2 @@
+-- Plan changes scheduled for the end of the current period
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS pending_plan_code VARCHAR(50) REFERENCES plans(code);
@@ -0,0 +1,20 @@
+-- Amount paid for each gift, captured at purchase time
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS amount_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+
+-- Refunds owed to customers, reconciled by finance
+CREATE TABLE IF NOT EXISTS refunds (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    entity_type VARCHAR(50) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    amount_cents BIGINT NOT NULL CHECK (amount_cents >= 0),
+    currency CHAR(3) NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed', 'failed')),
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (entity_type, entity_id, reason)
+);
+
+CREATE INDEX IF NOT EXISTS idx_refunds_user ON refunds(user_id);
+CREATE INDEX IF NOT EXISTS idx_gifts_expires_at ON gifts(expires_at) WHERE status = 'pending';
@@ -0,0 +1,2 @@
+-- Cancellations scheduled for the end of the paid period
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE;
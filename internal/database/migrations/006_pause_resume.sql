@@ -0,0 +1,9 @@
+-- Allow subscriptions to be paused
+ALTER TABLE subscriptions DROP CONSTRAINT IF EXISTS subscriptions_status_check;
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_status_check
+    CHECK (status IN ('active', 'cancelled', 'expired', 'pending', 'paused'));
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS paused_at TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS resume_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_resume_at ON subscriptions(resume_at) WHERE status = 'paused';
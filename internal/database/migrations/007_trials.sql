@@ -0,0 +1,26 @@
+-- Plans may offer a free trial
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS trial_days INTEGER NOT NULL DEFAULT 0 CHECK (trial_days >= 0);
+UPDATE plans SET trial_days = 7 WHERE code = 'monthly' AND trial_days = 0;
+
+-- Trial subscriptions are 'pending' until trial_end
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_end TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_subscriptions_trial_end ON subscriptions(trial_end) WHERE status = 'pending';
+
+-- One trial per user and per email address, ever
+CREATE TABLE IF NOT EXISTS trials (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER UNIQUE NOT NULL REFERENCES users(id),
+    email VARCHAR(255) UNIQUE NOT NULL,
+    subscription_id INTEGER NOT NULL REFERENCES subscriptions(id),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Payment methods on file, used to convert trials to paid subscriptions
+CREATE TABLE IF NOT EXISTS payment_methods (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    token VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_methods_user ON payment_methods(user_id);
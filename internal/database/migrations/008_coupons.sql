@@ -0,0 +1,34 @@
+-- Coupons and promotion codes
+CREATE TABLE IF NOT EXISTS coupons (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) UNIQUE NOT NULL,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('percent', 'amount', 'free_months')),
+    percent_off INTEGER CHECK (percent_off BETWEEN 1 AND 100),
+    amount_off_cents BIGINT CHECK (amount_off_cents > 0),
+    currency CHAR(3),
+    free_months INTEGER CHECK (free_months > 0),
+    max_redemptions INTEGER CHECK (max_redemptions > 0),
+    per_user_limit INTEGER CHECK (per_user_limit > 0),
+    redemption_count INTEGER NOT NULL DEFAULT 0,
+    valid_from TIMESTAMP,
+    valid_until TIMESTAMP,
+    plan_codes TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CHECK (max_redemptions IS NULL OR redemption_count <= max_redemptions)
+);
+
+-- One row per coupon use, linked to the operation's transactions record
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    id SERIAL PRIMARY KEY,
+    coupon_id INTEGER NOT NULL REFERENCES coupons(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    transaction_id INTEGER UNIQUE NOT NULL REFERENCES transactions(id),
+    entity_type VARCHAR(50) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    discount_cents BIGINT NOT NULL DEFAULT 0,
+    free_months INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_coupon_user ON coupon_redemptions(coupon_id, user_id);
@@ -0,0 +1,36 @@
+-- Gap-free invoice numbering. The counter row is updated inside the same
+-- transaction as the invoice, so a rollback releases the number.
+CREATE TABLE IF NOT EXISTS invoice_counters (
+    name VARCHAR(50) PRIMARY KEY,
+    last_value BIGINT NOT NULL DEFAULT 0
+);
+INSERT INTO invoice_counters (name, last_value) VALUES ('invoice', 0) ON CONFLICT (name) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS invoices (
+    id SERIAL PRIMARY KEY,
+    number VARCHAR(50) UNIQUE NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    entity_type VARCHAR(50) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+    subtotal_cents BIGINT NOT NULL,
+    discount_cents BIGINT NOT NULL DEFAULT 0,
+    total_cents BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'issued' CHECK (status IN ('issued', 'paid', 'void')),
+    issued_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS invoice_lines (
+    id SERIAL PRIMARY KEY,
+    invoice_id INTEGER NOT NULL REFERENCES invoices(id),
+    description VARCHAR(255) NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    unit_amount_cents BIGINT NOT NULL,
+    amount_cents BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_invoices_user ON invoices(user_id, issued_at DESC);
+CREATE INDEX IF NOT EXISTS idx_invoices_entity ON invoices(entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_invoice_lines_invoice ON invoice_lines(invoice_id);
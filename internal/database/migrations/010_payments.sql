@@ -0,0 +1,17 @@
+-- Charges taken through the payment provider, one per paid invoice
+CREATE TABLE IF NOT EXISTS payments (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    invoice_id INTEGER NOT NULL REFERENCES invoices(id),
+    payment_method_id INTEGER REFERENCES payment_methods(id),
+    provider VARCHAR(50) NOT NULL,
+    provider_ref VARCHAR(255) NOT NULL,
+    amount_cents BIGINT NOT NULL CHECK (amount_cents >= 0),
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'captured' CHECK (status IN ('captured', 'refunded')),
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (provider, provider_ref)
+);
+
+CREATE INDEX IF NOT EXISTS idx_payments_user ON payments(user_id);
+CREATE INDEX IF NOT EXISTS idx_payments_invoice ON payments(invoice_id);
@@ -0,0 +1,10 @@
+-- Failed automatic charges put a subscription into dunning: past_due while
+-- retries remain, unpaid once the retry schedule is exhausted
+ALTER TABLE subscriptions DROP CONSTRAINT IF EXISTS subscriptions_status_check;
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_status_check
+    CHECK (status IN ('active', 'cancelled', 'expired', 'pending', 'paused', 'past_due', 'unpaid'));
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS payment_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS next_payment_attempt_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_next_payment_attempt ON subscriptions(next_payment_attempt_at) WHERE status = 'past_due';
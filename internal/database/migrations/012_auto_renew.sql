@@ -0,0 +1,8 @@
+-- Subscriptions that renew themselves near end_date. Existing rows keep
+-- their current behaviour and expire at end_date.
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS auto_renew BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_auto_renew ON subscriptions(end_date) WHERE status = 'active' AND auto_renew;
+
+-- Trials already running keep converting when they end
+UPDATE subscriptions SET auto_renew = TRUE WHERE status = 'pending' AND trial_end IS NOT NULL;
@@ -0,0 +1,7 @@
+-- Refunds issued on cancellation point back at what they refund
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS invoice_id INTEGER REFERENCES invoices(id);
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS transaction_id INTEGER REFERENCES transactions(id);
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS payment_id INTEGER REFERENCES payments(id);
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS provider_ref VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_refunds_invoice ON refunds(invoice_id);
@@ -0,0 +1,29 @@
+-- Per-user account credit. The ledger is append-only: each row carries the
+-- balance after it, so the latest row per user and currency is the balance.
+CREATE TABLE IF NOT EXISTS credit_ledger (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    amount_cents BIGINT NOT NULL CHECK (amount_cents <> 0),
+    currency CHAR(3) NOT NULL,
+    balance_cents BIGINT NOT NULL CHECK (balance_cents >= 0),
+    reason VARCHAR(255) NOT NULL,
+    entity_type VARCHAR(50),
+    entity_id INTEGER,
+    transaction_id INTEGER REFERENCES transactions(id),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_user ON credit_ledger(user_id, currency, id DESC);
+
+CREATE OR REPLACE FUNCTION credit_ledger_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'credit_ledger is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS credit_ledger_no_update ON credit_ledger;
+CREATE TRIGGER credit_ledger_no_update BEFORE UPDATE OR DELETE ON credit_ledger
+    FOR EACH ROW EXECUTE FUNCTION credit_ledger_append_only();
+
+-- Credit drawn down against an invoice before the card is charged
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS credit_applied_cents BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,74 @@
+-- Double-entry accounting ledger
+CREATE TABLE IF NOT EXISTS accounts (
+    code VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('asset', 'liability', 'revenue', 'expense'))
+);
+
+INSERT INTO accounts (code, name, type) VALUES
+    ('cash', 'Cash', 'asset'),
+    ('customer_credit', 'Customer credit', 'liability'),
+    ('deferred_revenue', 'Deferred revenue', 'liability'),
+    ('recognized_revenue', 'Recognized revenue', 'revenue'),
+    ('gift_liability', 'Gift liability', 'liability'),
+    ('refunds_payable', 'Refunds payable', 'liability'),
+    ('credit_adjustments', 'Credit adjustments', 'expense')
+ON CONFLICT (code) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INTEGER REFERENCES transactions(id),
+    description VARCHAR(255) NOT NULL,
+    entity_type VARCHAR(50) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS journal_lines (
+    id SERIAL PRIMARY KEY,
+    entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+    account VARCHAR(50) NOT NULL REFERENCES accounts(code),
+    debit_cents BIGINT NOT NULL DEFAULT 0 CHECK (debit_cents >= 0),
+    credit_cents BIGINT NOT NULL DEFAULT 0 CHECK (credit_cents >= 0),
+    currency CHAR(3) NOT NULL,
+    CHECK ((debit_cents = 0) <> (credit_cents = 0))
+);
+
+CREATE INDEX IF NOT EXISTS idx_journal_entries_entity ON journal_entries(entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_journal_lines_entry ON journal_lines(entry_id);
+CREATE INDEX IF NOT EXISTS idx_journal_lines_account ON journal_lines(account, currency);
+
+-- Every entry must balance per currency by the time its transaction commits
+CREATE OR REPLACE FUNCTION journal_entry_balanced() RETURNS trigger AS $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM journal_lines
+        WHERE entry_id = NEW.entry_id
+        GROUP BY currency
+        HAVING SUM(debit_cents) <> SUM(credit_cents)
+    ) THEN
+        RAISE EXCEPTION 'journal entry % does not balance', NEW.entry_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS journal_lines_balanced ON journal_lines;
+CREATE CONSTRAINT TRIGGER journal_lines_balanced AFTER INSERT ON journal_lines
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION journal_entry_balanced();
+
+-- Posted entries are never changed
+CREATE OR REPLACE FUNCTION journal_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS journal_entries_no_update ON journal_entries;
+CREATE TRIGGER journal_entries_no_update BEFORE UPDATE OR DELETE ON journal_entries
+    FOR EACH ROW EXECUTE FUNCTION journal_append_only();
+
+DROP TRIGGER IF EXISTS journal_lines_no_update ON journal_lines;
+CREATE TRIGGER journal_lines_no_update BEFORE UPDATE OR DELETE ON journal_lines
+    FOR EACH ROW EXECUTE FUNCTION journal_append_only();
@@ -0,0 +1,28 @@
+-- Revenue recognition schedules: one per paid period, earned straight-line
+-- between recognized_through and ends_at
+CREATE TABLE IF NOT EXISTS revenue_schedules (
+    id SERIAL PRIMARY KEY,
+    entity_type VARCHAR(50) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    invoice_id INTEGER REFERENCES invoices(id),
+    gift_id INTEGER REFERENCES gifts(id),
+    amount_cents BIGINT NOT NULL CHECK (amount_cents >= 0),
+    released_cents BIGINT NOT NULL DEFAULT 0 CHECK (released_cents >= 0),
+    recognized_cents BIGINT NOT NULL DEFAULT 0 CHECK (recognized_cents >= 0),
+    currency CHAR(3) NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    recognized_through TIMESTAMP NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'completed', 'closed')),
+    created_at TIMESTAMP DEFAULT NOW(),
+    CHECK (released_cents + recognized_cents <= amount_cents),
+    CHECK (ends_at >= starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_revenue_schedules_entity ON revenue_schedules(entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_revenue_schedules_due ON revenue_schedules(recognized_through) WHERE status = 'active';
+
+-- When an entry takes effect for reporting, which for recognition is the
+-- end of the period it recognizes rather than when the job ran
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS effective_at TIMESTAMP NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS idx_journal_entries_effective_at ON journal_entries(effective_at);
@@ -0,0 +1,40 @@
+-- Unguessable redemption codes replace redeeming by sequential gift ID
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS redemption_code VARCHAR(19);
+
+-- Generates a code in the same format as internal/giftcode: 15 random
+-- Crockford base32 symbols and a Luhn mod 32 check symbol, in groups of
+-- four. The application generates its own codes; this backfills existing
+-- gifts and covers rows inserted outside it. The random bytes come from
+-- two v4 UUIDs, skipping their version and variant bytes.
+CREATE OR REPLACE FUNCTION generate_gift_code() RETURNS VARCHAR(19) AS $$
+DECLARE
+    alphabet CONSTANT TEXT := '0123456789ABCDEFGHJKMNPQRSTVWXYZ';
+    positions CONSTANT INT[] := ARRAY[0, 1, 2, 3, 4, 5, 7, 9, 10, 11, 12, 13, 14, 15, 16];
+    random BYTEA;
+    symbols TEXT := '';
+    addend INT;
+    factor INT := 2;
+    total INT := 0;
+BEGIN
+    random := decode(replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', ''), 'hex');
+    FOR i IN 1..15 LOOP
+        symbols := symbols || substr(alphabet, get_byte(random, positions[i]) % 32 + 1, 1);
+    END LOOP;
+
+    FOR i IN REVERSE 15..1 LOOP
+        addend := factor * (strpos(alphabet, substr(symbols, i, 1)) - 1);
+        total := total + addend / 32 + addend % 32;
+        factor := 3 - factor;
+    END LOOP;
+    symbols := symbols || substr(alphabet, (32 - total % 32) % 32 + 1, 1);
+
+    RETURN substr(symbols, 1, 4) || '-' || substr(symbols, 5, 4) || '-' ||
+           substr(symbols, 9, 4) || '-' || substr(symbols, 13, 4);
+END;
+$$ LANGUAGE plpgsql VOLATILE;
+
+UPDATE gifts SET redemption_code = generate_gift_code() WHERE redemption_code IS NULL;
+
+ALTER TABLE gifts ALTER COLUMN redemption_code SET DEFAULT generate_gift_code();
+ALTER TABLE gifts ALTER COLUMN redemption_code SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_gifts_redemption_code ON gifts(redemption_code);
@@ -0,0 +1,34 @@
+-- Recipient emails are compared normalized (trimmed, lowercase), so they
+-- are stored that way
+UPDATE gifts SET recipient_email = LOWER(TRIM(recipient_email))
+WHERE recipient_email <> LOWER(TRIM(recipient_email));
+
+-- Open gifts can be redeemed by anyone holding the code; the rest only by
+-- the user whose email matches recipient_email
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS open BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Audit trail of rejected redemption attempts. gift_id is set when the
+-- code matched a gift. Append-only, like the ledgers.
+CREATE TABLE IF NOT EXISTS gift_redemption_rejections (
+    id SERIAL PRIMARY KEY,
+    gift_id INTEGER REFERENCES gifts(id),
+    user_id INTEGER NOT NULL,
+    user_email VARCHAR(255),
+    client_ip VARCHAR(64) NOT NULL,
+    reason VARCHAR(50) NOT NULL CHECK (reason IN ('rate_limited', 'invalid_code', 'unknown_code',
+                                                  'recipient_mismatch', 'unavailable')),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_gift_redemption_rejections_gift ON gift_redemption_rejections(gift_id);
+CREATE INDEX IF NOT EXISTS idx_gift_redemption_rejections_user ON gift_redemption_rejections(user_id, created_at);
+
+CREATE OR REPLACE FUNCTION gift_redemption_rejections_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'gift_redemption_rejections is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS gift_redemption_rejections_no_update ON gift_redemption_rejections;
+CREATE TRIGGER gift_redemption_rejections_no_update BEFORE UPDATE OR DELETE ON gift_redemption_rejections
+    FOR EACH ROW EXECUTE FUNCTION gift_redemption_rejections_append_only();
@@ -0,0 +1,35 @@
+-- Gifts can be scheduled for delivery and carry a message from the sender.
+-- A scheduled gift is invisible to its recipient and cannot be redeemed
+-- until the delivery job moves it to pending at deliver_at.
+ALTER TABLE gifts DROP CONSTRAINT IF EXISTS gifts_status_check;
+ALTER TABLE gifts ADD CONSTRAINT gifts_status_check
+    CHECK (status IN ('scheduled', 'pending', 'redeemed', 'expired'));
+
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS message TEXT;
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS sender_name VARCHAR(100);
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS deliver_at TIMESTAMP;
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMP;
+
+UPDATE gifts SET deliver_at = created_at, delivered_at = created_at WHERE deliver_at IS NULL;
+ALTER TABLE gifts ALTER COLUMN deliver_at SET DEFAULT NOW();
+ALTER TABLE gifts ALTER COLUMN deliver_at SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_gifts_deliver_at ON gifts(deliver_at) WHERE status = 'scheduled';
+
+ALTER TABLE gift_redemption_rejections DROP CONSTRAINT IF EXISTS gift_redemption_rejections_reason_check;
+ALTER TABLE gift_redemption_rejections ADD CONSTRAINT gift_redemption_rejections_reason_check
+    CHECK (reason IN ('rate_limited', 'invalid_code', 'unknown_code', 'recipient_mismatch', 'unavailable', 'undelivered'));
+
+-- Outbox of domain events, written in the same transaction as the change
+-- they describe; consumers read them in id order
+CREATE TABLE IF NOT EXISTS events (
+    id SERIAL PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    entity_type VARCHAR(50) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    payload JSONB NOT NULL,
+    transaction_id INTEGER REFERENCES transactions(id),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_entity ON events(entity_type, entity_id);
@@ -0,0 +1,8 @@
+-- Gifters can revoke gifts that have not been redeemed
+ALTER TABLE gifts DROP CONSTRAINT IF EXISTS gifts_status_check;
+ALTER TABLE gifts ADD CONSTRAINT gifts_status_check
+    CHECK (status IN ('scheduled', 'pending', 'redeemed', 'expired', 'revoked'));
+
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_gifts_gifter ON gifts(gifter_id, created_at DESC);
@@ -0,0 +1,19 @@
+-- Bulk gift orders: one purchase, invoice and charge for many recipients,
+-- tracked, revoked and reported on together through the batch
+CREATE TABLE IF NOT EXISTS gift_batches (
+    id SERIAL PRIMARY KEY,
+    gifter_id INTEGER NOT NULL REFERENCES users(id),
+    plan_code VARCHAR(50) NOT NULL,
+    duration_months INTEGER NOT NULL,
+    mode VARCHAR(20) NOT NULL CHECK (mode IN ('atomic', 'partial')),
+    requested_count INTEGER NOT NULL,
+    created_count INTEGER NOT NULL,
+    amount_cents BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_gift_batches_gifter ON gift_batches(gifter_id, created_at DESC);
+
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS batch_id INTEGER REFERENCES gift_batches(id);
+CREATE INDEX IF NOT EXISTS idx_gifts_batch ON gifts(batch_id) WHERE batch_id IS NOT NULL;
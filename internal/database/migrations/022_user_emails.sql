@@ -0,0 +1,10 @@
+-- User emails are stored trimmed and lowercased, like gift recipients, so
+-- lookups and the unique constraint ignore case. Addresses that would
+-- collide once normalized are left for support to merge.
+UPDATE users u
+SET email = LOWER(TRIM(u.email))
+WHERE u.email <> LOWER(TRIM(u.email))
+  AND NOT EXISTS (
+      SELECT 1 FROM users other
+      WHERE other.id <> u.id AND LOWER(TRIM(other.email)) = LOWER(TRIM(u.email))
+  );
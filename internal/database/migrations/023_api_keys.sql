@@ -0,0 +1,10 @@
+-- API keys for server-to-server callers. Only a SHA-256 hash of each key is
+-- kept; the prefix is stored in the clear so keys can be told apart.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    key_prefix VARCHAR(20) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// GetDefaultPaymentMethod retrieves the most recently added payment method
+// for a user
+func (db *DB) GetDefaultPaymentMethod(userID int) (*models.PaymentMethod, error) {
+	var pm models.PaymentMethod
+	err := db.QueryRow(
+		`SELECT id, user_id, token, created_at
+		 FROM payment_methods
+		 WHERE user_id = $1
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`,
+		userID,
+	).Scan(&pm.ID, &pm.UserID, &pm.Token, &pm.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment method: %w", err)
+	}
+	return &pm, nil
+}
+
+// AddPaymentMethodTx stores a payment method within a transaction
+func (db *DB) AddPaymentMethodTx(tx *sql.Tx, userID int, token string, idempotencyKey string) (*models.PaymentMethod, error) {
+	var pm models.PaymentMethod
+	err := tx.QueryRow(
+		`INSERT INTO payment_methods (user_id, token) VALUES ($1, $2)
+		 RETURNING id, user_id, token, created_at`,
+		userID, token,
+	).Scan(&pm.ID, &pm.UserID, &pm.Token, &pm.CreatedAt)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to add payment method: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id)
+		 VALUES ($1, 'create', 'payment_method', $2)`,
+		idempotencyKey, pm.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return &pm, nil
+}
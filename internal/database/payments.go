@@ -0,0 +1,83 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const paymentColumns = `id, user_id, invoice_id, payment_method_id, provider, provider_ref, amount_cents, currency, status, created_at`
+
+func scanPayment(row rowScanner) (*models.Payment, error) {
+	var p models.Payment
+	err := row.Scan(&p.ID, &p.UserID, &p.InvoiceID, &p.PaymentMethodID, &p.Provider, &p.ProviderRef,
+		&p.AmountCents, &p.Currency, &p.Status, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// RecordPaymentTx stores a captured charge for invoice within a transaction
+// and marks the invoice paid. The charge covers whatever account credit
+// did not.
+func (db *DB) RecordPaymentTx(tx *sql.Tx, invoice *models.Invoice, pm *models.PaymentMethod, provider, providerRef string) (*models.Payment, error) {
+	payment, err := scanPayment(tx.QueryRow(
+		`INSERT INTO payments (user_id, invoice_id, payment_method_id, provider, provider_ref, amount_cents, currency)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING `+paymentColumns,
+		invoice.UserID, invoice.ID, pm.ID, provider, providerRef, invoice.TotalCents-invoice.CreditCents, invoice.Currency,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to record payment: %w", err)
+	}
+
+	if err := db.MarkInvoicePaidTx(tx, invoice); err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+// MarkInvoicePaidTx marks an issued invoice paid within a transaction,
+// posts the journal entry for the money it collected and, for a
+// subscription, schedules that revenue over the period it paid for
+func (db *DB) MarkInvoicePaidTx(tx *sql.Tx, invoice *models.Invoice) error {
+	result, err := tx.Exec(
+		`UPDATE invoices SET status = 'paid' WHERE id = $1 AND status = 'issued'`,
+		invoice.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark invoice paid: %w", err)
+	}
+	invoice.Status = models.InvoicePaid
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := db.PostJournalTx(tx, billing.InvoicePaymentJournal(invoice), &invoice.TransactionID); err != nil {
+		return err
+	}
+
+	if invoice.EntityType == "subscription" && invoice.TotalCents > 0 {
+		return db.scheduleInvoiceRevenueTx(tx, invoice)
+	}
+	return nil
+}
+
+// GetPaymentByInvoice retrieves the captured payment for an invoice
+func (db *DB) GetPaymentByInvoice(invoiceID int) (*models.Payment, error) {
+	payment, err := scanPayment(db.QueryRow(
+		`SELECT `+paymentColumns+` FROM payments WHERE invoice_id = $1 ORDER BY id DESC LIMIT 1`,
+		invoiceID,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+	return payment, nil
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const planColumns = `id, code, name, price_cents, currency, billing_interval, trial_days, active, created_at, updated_at`
+
+func scanPlan(row rowScanner) (*models.Plan, error) {
+	var plan models.Plan
+	err := row.Scan(&plan.ID, &plan.Code, &plan.Name, &plan.PriceCents, &plan.Currency,
+		&plan.BillingInterval, &plan.TrialDays, &plan.Active, &plan.CreatedAt, &plan.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// GetPlanByCode retrieves a plan by its code, including retired plans
+func (db *DB) GetPlanByCode(code string) (*models.Plan, error) {
+	plan, err := scanPlan(db.QueryRow(
+		`SELECT `+planColumns+` FROM plans WHERE code = $1`,
+		code,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get plan: %w", err)
+	}
+	return plan, nil
+}
+
+// ListPlans retrieves all plans, optionally only the active ones
+func (db *DB) ListPlans(activeOnly bool) ([]models.Plan, error) {
+	rows, err := db.Query(
+		`SELECT `+planColumns+`
+		 FROM plans
+		 WHERE active OR NOT $1
+		 ORDER BY price_cents, code`,
+		activeOnly,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list plans: %w", err)
+	}
+	defer rows.Close()
+
+	plans := []models.Plan{}
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan plan: %w", err)
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, nil
+}
+
+// CreatePlanTx creates a plan within a transaction
+func (db *DB) CreatePlanTx(tx *sql.Tx, req models.PlanRequest, idempotencyKey string) (*models.Plan, error) {
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+	trialDays := 0
+	if req.TrialDays != nil {
+		trialDays = *req.TrialDays
+	}
+	var priceCents int64
+	if req.PriceCents != nil {
+		priceCents = *req.PriceCents
+	}
+
+	plan, err := scanPlan(tx.QueryRow(
+		`INSERT INTO plans (code, name, price_cents, currency, billing_interval, trial_days, active)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING `+planColumns,
+		req.Code, req.Name, priceCents, req.Currency, req.BillingInterval, trialDays, active,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plan: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id)
+		 VALUES ($1, 'create', 'plan', $2)`,
+		idempotencyKey, plan.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return plan, nil
+}
+
+// UpdatePlanTx updates a plan's mutable fields within a transaction; fields
+// left out of req keep their value, and a price of zero makes the plan free.
+// The code and billing interval are fixed once subscriptions reference them.
+func (db *DB) UpdatePlanTx(tx *sql.Tx, code string, req models.PlanRequest, idempotencyKey string) (*models.Plan, error) {
+	plan, err := scanPlan(tx.QueryRow(
+		`UPDATE plans
+		 SET name = COALESCE(NULLIF($1, ''), name),
+		     price_cents = COALESCE($2, price_cents),
+		     currency = COALESCE(NULLIF($3, ''), currency),
+		     active = COALESCE($4, active),
+		     trial_days = COALESCE($5, trial_days),
+		     updated_at = NOW()
+		 WHERE code = $6
+		 RETURNING `+planColumns,
+		req.Name, req.PriceCents, req.Currency, req.Active, req.TrialDays, code,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to update plan: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id)
+		 VALUES ($1, 'update', 'plan', $2)`,
+		idempotencyKey, plan.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return plan, nil
+}
+
+// RetirePlanTx marks a plan inactive within a transaction. Plans are never
+// deleted because existing subscriptions and gifts still reference them.
+func (db *DB) RetirePlanTx(tx *sql.Tx, code string, idempotencyKey string) (*models.Plan, error) {
+	plan, err := scanPlan(tx.QueryRow(
+		`UPDATE plans
+		 SET active = FALSE, updated_at = NOW()
+		 WHERE code = $1
+		 RETURNING `+planColumns,
+		code,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to retire plan: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id)
+		 VALUES ($1, 'retire', 'plan', $2)`,
+		idempotencyKey, plan.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return plan, nil
+}
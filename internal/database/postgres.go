@@ -2,13 +2,14 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type DB struct {
@@ -46,28 +47,81 @@ func New() (*DB, error) {
 	return &DB{db}, nil
 }
 
+// RunMigrations applies each .sql file in migrationsPath once, in filename
+// order. Applied files are recorded in schema_migrations so later files can
+// safely alter constraints that earlier files created.
 func (db *DB) RunMigrations(migrationsPath string) error {
 	files, err := filepath.Glob(filepath.Join(migrationsPath, "*.sql"))
 	if err != nil {
 		return fmt.Errorf("failed to find migration files: %w", err)
 	}
 
-	for _, file := range files {
-		log.Printf("Running migration: %s", filepath.Base(file))
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+		     filename VARCHAR(255) PRIMARY KEY,
+		     applied_at TIMESTAMP DEFAULT NOW()
+		 )`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
 
-		content, err := os.ReadFile(file)
-		if err != nil {
-			return fmt.Errorf("failed to read migration file %s: %w", file, err)
+	for _, file := range files {
+		if err := db.runMigration(file); err != nil {
+			return err
 		}
+	}
 
-		_, err = db.Exec(string(content))
-		if err != nil {
-			return fmt.Errorf("failed to execute migration %s: %w", file, err)
-		}
+	return nil
+}
+
+// runMigration applies a single migration file inside a transaction. An
+// advisory lock serializes replicas starting at the same time.
+func (db *DB) runMigration(file string) error {
+	name := filepath.Base(file)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start migration %s: %w", name, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))`); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+
+	var applied bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE filename = $1)`,
+		name,
+	).Scan(&applied)
+	if err != nil {
+		return fmt.Errorf("failed to check migration %s: %w", name, err)
+	}
+	if applied {
+		return nil
+	}
+
+	log.Printf("Running migration: %s", name)
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read migration file %s: %w", file, err)
+	}
+
+	if _, err := tx.Exec(string(content)); err != nil {
+		return fmt.Errorf("failed to execute migration %s: %w", file, err)
+	}
+
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (filename) VALUES ($1)`, name); err != nil {
+		return fmt.Errorf("failed to record migration %s: %w", name, err)
+	}
 
-		log.Printf("Migration completed: %s", filepath.Base(file))
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %s: %w", name, err)
 	}
 
+	log.Printf("Migration completed: %s", name)
 	return nil
 }
 
@@ -75,6 +129,34 @@ func (db *DB) Close() error {
 	return db.DB.Close()
 }
 
+// IsUniqueViolation reports whether err was caused by a unique constraint
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// Unique constraints that allow one trial per user and per email address,
+// under the names Postgres gives them
+const (
+	TrialUserConstraint  = "trials_user_id_key"
+	TrialEmailConstraint = "trials_email_key"
+)
+
+// IsConstraintViolation reports whether err was caused by a unique
+// violation of one of the named constraints
+func IsConstraintViolation(err error, constraints ...string) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return false
+	}
+	for _, constraint := range constraints {
+		if pqErr.Constraint == constraint {
+			return true
+		}
+	}
+	return false
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const refundColumns = `id, user_id, entity_type, entity_id, amount_cents, currency, reason, status,
+		 invoice_id, transaction_id, payment_id, provider_ref, created_at`
+
+func scanRefund(row rowScanner) (*models.Refund, error) {
+	var r models.Refund
+	err := row.Scan(&r.ID, &r.UserID, &r.EntityType, &r.EntityID, &r.AmountCents, &r.Currency, &r.Reason, &r.Status,
+		&r.InvoiceID, &r.TransactionID, &r.PaymentID, &r.ProviderRef, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// CreateCancellationRefundTx records a pending refund of the card part of
+// summary for a cancelled subscription within a transaction. The refund
+// points at the invoice it refunds, the transaction that invoice billed
+// and the payment to refund against.
+func (db *DB) CreateCancellationRefundTx(tx *sql.Tx, sub *models.Subscription, summary billing.RefundSummary, invoice *models.Invoice, payment *models.Payment, idempotencyKey string) (*models.Refund, error) {
+	var paymentID *int
+	if payment != nil {
+		paymentID = &payment.ID
+	}
+
+	refund, err := scanRefund(tx.QueryRow(
+		`INSERT INTO refunds (user_id, entity_type, entity_id, amount_cents, currency, reason,
+		                      invoice_id, transaction_id, payment_id)
+		 VALUES ($1, 'subscription', $2, $3, $4, 'cancellation', $5, $6, $7)
+		 RETURNING `+refundColumns,
+		sub.UserID, sub.ID, summary.RefundCents, summary.Currency, invoice.ID, invoice.TransactionID, paymentID,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create refund: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'refund', 'refund', $2, jsonb_build_object('subscription_id', $3::int, 'invoice_id', $4::int,
+		         'policy', $5::text, 'amount_cents', $6::bigint, 'currency', $7::text))`,
+		"refund:"+idempotencyKey, refund.ID, sub.ID, invoice.ID, string(summary.Policy), refund.AmountCents, refund.Currency,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return refund, nil
+}
+
+// SettleRefund records the provider's answer for a pending refund.
+// providerRef is nil when the refund failed. A completed refund posts the
+// cash paid out against refunds payable.
+func (db *DB) SettleRefund(id int, status models.RefundStatus, providerRef *string) (*models.Refund, error) {
+	tx, err := db.BeginTx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	refund, err := scanRefund(tx.QueryRow(
+		`UPDATE refunds SET status = $1, provider_ref = $2
+		 WHERE id = $3 AND status = 'pending'
+		 RETURNING `+refundColumns,
+		status, providerRef, id,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to settle refund: %w", err)
+	}
+
+	if refund.Status == models.RefundCompleted {
+		if _, err := db.PostJournalTx(tx, billing.RefundPaymentJournal(refund), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return refund, nil
+}
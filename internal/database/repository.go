@@ -2,17 +2,53 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/giftcode"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
 )
 
+const subscriptionColumns = `id, user_id, plan_code, pending_plan_code, status, start_date, end_date, cancelled_at, cancel_at_period_end,
+		 auto_renew, paused_at, resume_at, trial_end, payment_attempts, next_payment_attempt_at, created_at, updated_at`
+
+const giftColumns = `id, gifter_id, recipient_email, recipient_id, redemption_code, open, plan_code, status, duration_months, amount_cents, currency,
+		 message, sender_name, deliver_at, delivered_at, redeemed_at, revoked_at, expires_at, batch_id, created_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSubscription(row rowScanner) (*models.Subscription, error) {
+	var sub models.Subscription
+	err := row.Scan(&sub.ID, &sub.UserID, &sub.PlanCode, &sub.PendingPlan, &sub.Status, &sub.StartDate, &sub.EndDate,
+		&sub.CancelledAt, &sub.CancelAtPeriodEnd, &sub.AutoRenew, &sub.PausedAt, &sub.ResumeAt, &sub.TrialEnd,
+		&sub.PaymentAttempts, &sub.NextPaymentAt, &sub.CreatedAt, &sub.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func scanGift(row rowScanner) (*models.Gift, error) {
+	var gift models.Gift
+	err := row.Scan(&gift.ID, &gift.GifterID, &gift.RecipientEmail, &gift.RecipientID, &gift.RedemptionCode, &gift.Open, &gift.PlanCode,
+		&gift.Status, &gift.DurationMonths, &gift.AmountCents, &gift.Currency, &gift.Message, &gift.SenderName,
+		&gift.DeliverAt, &gift.DeliveredAt, &gift.RedeemedAt, &gift.RevokedAt, &gift.ExpiresAt, &gift.BatchID, &gift.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &gift, nil
+}
+
 // CreateUser creates a new user
 func (db *DB) CreateUser(email string) (*models.User, error) {
 	var user models.User
 	err := db.QueryRow(
-		`INSERT INTO users (email) VALUES ($1) 
+		`INSERT INTO users (email) VALUES ($1)
 		 RETURNING id, email, created_at, updated_at`,
 		email,
 	).Scan(&user.ID, &user.Email, &user.CreatedAt, &user.UpdatedAt)
@@ -40,12 +76,12 @@ func (db *DB) GetUserByID(id int) (*models.User, error) {
 	return &user, nil
 }
 
-// GetUserByEmail retrieves a user by email
+// GetUserByEmail retrieves a user by email, compared normalized
 func (db *DB) GetUserByEmail(email string) (*models.User, error) {
 	var user models.User
 	err := db.QueryRow(
 		`SELECT id, email, created_at, updated_at FROM users WHERE email = $1`,
-		email,
+		models.NormalizeEmail(email),
 	).Scan(&user.ID, &user.Email, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
@@ -59,14 +95,12 @@ func (db *DB) GetUserByEmail(email string) (*models.User, error) {
 
 // GetActiveSubscription retrieves active subscription for a user
 func (db *DB) GetActiveSubscription(userID int) (*models.Subscription, error) {
-	var sub models.Subscription
-	err := db.QueryRow(
-		`SELECT id, user_id, status, start_date, end_date, cancelled_at, created_at, updated_at 
-		 FROM subscriptions 
+	sub, err := scanSubscription(db.QueryRow(
+		`SELECT `+subscriptionColumns+`
+		 FROM subscriptions
 		 WHERE user_id = $1 AND status = 'active'`,
 		userID,
-	).Scan(&sub.ID, &sub.UserID, &sub.Status, &sub.StartDate, &sub.EndDate,
-		&sub.CancelledAt, &sub.CreatedAt, &sub.UpdatedAt)
+	))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -74,19 +108,38 @@ func (db *DB) GetActiveSubscription(userID int) (*models.Subscription, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get subscription: %w", err)
 	}
-	return &sub, nil
+	return sub, nil
+}
+
+// GetCurrentSubscription retrieves the subscription that currently occupies
+// a user's single slot: active, paused, in trial or in dunning
+func (db *DB) GetCurrentSubscription(userID int) (*models.Subscription, error) {
+	sub, err := scanSubscription(db.QueryRow(
+		`SELECT `+subscriptionColumns+`
+		 FROM subscriptions
+		 WHERE user_id = $1 AND status IN ('active', 'paused', 'pending', 'past_due')
+		 ORDER BY created_at DESC
+		 LIMIT 1`,
+		userID,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	return sub, nil
 }
 
 // GetSubscriptionByID retrieves a subscription by ID
 func (db *DB) GetSubscriptionByID(id int) (*models.Subscription, error) {
-	var sub models.Subscription
-	err := db.QueryRow(
-		`SELECT id, user_id, status, start_date, end_date, cancelled_at, created_at, updated_at 
-		 FROM subscriptions 
+	sub, err := scanSubscription(db.QueryRow(
+		`SELECT `+subscriptionColumns+`
+		 FROM subscriptions
 		 WHERE id = $1`,
 		id,
-	).Scan(&sub.ID, &sub.UserID, &sub.Status, &sub.StartDate, &sub.EndDate,
-		&sub.CancelledAt, &sub.CreatedAt, &sub.UpdatedAt)
+	))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -94,15 +147,15 @@ func (db *DB) GetSubscriptionByID(id int) (*models.Subscription, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get subscription: %w", err)
 	}
-	return &sub, nil
+	return sub, nil
 }
 
 // GetUserSubscriptions retrieves all subscriptions for a user
 func (db *DB) GetUserSubscriptions(userID int) ([]models.Subscription, error) {
 	rows, err := db.Query(
-		`SELECT id, user_id, status, start_date, end_date, cancelled_at, created_at, updated_at 
-		 FROM subscriptions 
-		 WHERE user_id = $1 
+		`SELECT `+subscriptionColumns+`
+		 FROM subscriptions
+		 WHERE user_id = $1
 		 ORDER BY created_at DESC`,
 		userID,
 	)
@@ -113,30 +166,26 @@ func (db *DB) GetUserSubscriptions(userID int) ([]models.Subscription, error) {
 
 	var subscriptions []models.Subscription
 	for rows.Next() {
-		var sub models.Subscription
-		err := rows.Scan(&sub.ID, &sub.UserID, &sub.Status, &sub.StartDate, &sub.EndDate,
-			&sub.CancelledAt, &sub.CreatedAt, &sub.UpdatedAt)
+		sub, err := scanSubscription(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan subscription: %w", err)
 		}
-		subscriptions = append(subscriptions, sub)
+		subscriptions = append(subscriptions, *sub)
 	}
 	return subscriptions, nil
 }
 
 // CreateSubscriptionTx creates a subscription within a transaction
-func (db *DB) CreateSubscriptionTx(tx *sql.Tx, userID int, durationMonths int, idempotencyKey string) (*models.Subscription, error) {
+func (db *DB) CreateSubscriptionTx(tx *sql.Tx, userID int, planCode string, durationMonths int, autoRenew bool, idempotencyKey string) (*models.Subscription, error) {
 	startDate := time.Now()
 	endDate := startDate.AddDate(0, durationMonths, 0)
 
-	var sub models.Subscription
-	err := tx.QueryRow(
-		`INSERT INTO subscriptions (user_id, status, start_date, end_date) 
-		 VALUES ($1, 'active', $2, $3) 
-		 RETURNING id, user_id, status, start_date, end_date, cancelled_at, created_at, updated_at`,
-		userID, startDate, endDate,
-	).Scan(&sub.ID, &sub.UserID, &sub.Status, &sub.StartDate, &sub.EndDate,
-		&sub.CancelledAt, &sub.CreatedAt, &sub.UpdatedAt)
+	sub, err := scanSubscription(tx.QueryRow(
+		`INSERT INTO subscriptions (user_id, plan_code, status, start_date, end_date, auto_renew)
+		 VALUES ($1, $2, 'active', $3, $4, $5)
+		 RETURNING `+subscriptionColumns,
+		userID, planCode, startDate, endDate, autoRenew,
+	))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create subscription: %w", err)
@@ -144,28 +193,134 @@ func (db *DB) CreateSubscriptionTx(tx *sql.Tx, userID int, durationMonths int, i
 
 	// Record transaction
 	_, err = tx.Exec(
-		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id) 
-		 VALUES ($1, 'create', 'subscription', $2)`,
-		idempotencyKey, sub.ID,
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'create', 'subscription', $2, $3)`,
+		idempotencyKey, sub.ID, fmt.Sprintf(`{"plan": %q}`, sub.PlanCode),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to record transaction: %w", err)
 	}
 
-	return &sub, nil
+	return sub, nil
+}
+
+// HasUsedTrial reports whether a user, or anyone who has held the same
+// email address, has already taken a trial
+func (db *DB) HasUsedTrial(userID int, email string) (bool, error) {
+	var used bool
+	err := db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM trials WHERE user_id = $1 OR email = $2)`,
+		userID, models.NormalizeEmail(email),
+	).Scan(&used)
+	if err != nil {
+		return false, fmt.Errorf("failed to check trial history: %w", err)
+	}
+	return used, nil
 }
 
-// RenewSubscriptionTx renews a subscription within a transaction
+// CreateTrialSubscriptionTx creates a pending trial subscription within a
+// transaction and records the trial against the user and email. The unique
+// constraints on trials reject a second trial even under concurrent requests.
+func (db *DB) CreateTrialSubscriptionTx(tx *sql.Tx, user *models.User, plan *models.Plan, autoRenew bool, idempotencyKey string) (*models.Subscription, error) {
+	startDate := time.Now()
+	trialEnd := startDate.AddDate(0, 0, plan.TrialDays)
+
+	sub, err := scanSubscription(tx.QueryRow(
+		`INSERT INTO subscriptions (user_id, plan_code, status, start_date, end_date, trial_end, auto_renew)
+		 VALUES ($1, $2, 'pending', $3, $4, $4, $5)
+		 RETURNING `+subscriptionColumns,
+		user.ID, plan.Code, startDate, trialEnd, autoRenew,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trial subscription: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO trials (user_id, email, subscription_id) VALUES ($1, $2, $3)`,
+		user.ID, models.NormalizeEmail(user.Email), sub.ID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record trial: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'trial_start', 'subscription', $2, $3)`,
+		idempotencyKey, sub.ID, fmt.Sprintf(`{"plan": %q, "trial_days": %d}`, sub.PlanCode, plan.TrialDays),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return sub, nil
+}
+
+// EndTrialsTx expires up to limit trials whose trial_end has passed and
+// that either have auto-renew turned off or whose user has no payment
+// method on file. The rest are left for the renewal job, which charges
+// them. Rows are claimed with SKIP LOCKED.
+func (db *DB) EndTrialsTx(tx *sql.Tx, limit int) ([]int, error) {
+	rows, err := tx.Query(
+		`WITH due AS (
+		     SELECT s.id FROM subscriptions s
+		     WHERE s.status = 'pending' AND s.trial_end <= NOW()
+		       AND (NOT s.auto_renew
+		            OR NOT EXISTS (SELECT 1 FROM payment_methods pm WHERE pm.user_id = s.user_id))
+		     ORDER BY s.trial_end
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 ), ended AS (
+		     UPDATE subscriptions s
+		     SET status = 'expired', updated_at = NOW()
+		     FROM due
+		     WHERE s.id = due.id
+		     RETURNING s.id, s.status, s.end_date
+		 )
+		 INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 SELECT 'trial_end:subscription:' || id, 'trial_expire', 'subscription', id,
+		        jsonb_build_object('status', status, 'end_date', end_date)
+		 FROM ended
+		 ON CONFLICT (idempotency_key) DO NOTHING
+		 RETURNING entity_id`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to end trials: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan ended trial: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// RenewSubscriptionTx renews a subscription within a transaction. A plan
+// change scheduled for period end takes effect with the renewal, and paying
+// for more time withdraws any scheduled cancellation. Paying for a trial
+// converts it, and paying for a past_due subscription ends its dunning.
 func (db *DB) RenewSubscriptionTx(tx *sql.Tx, subscriptionID int, durationMonths int, idempotencyKey string) (*models.Subscription, error) {
-	var sub models.Subscription
-	err := tx.QueryRow(
-		`UPDATE subscriptions 
-		 SET end_date = end_date + interval '1 month' * $1, updated_at = NOW() 
-		 WHERE id = $2 AND status = 'active'
-		 RETURNING id, user_id, status, start_date, end_date, cancelled_at, created_at, updated_at`,
+	sub, err := scanSubscription(tx.QueryRow(
+		`UPDATE subscriptions
+		 SET status = 'active',
+		     end_date = end_date + interval '1 month' * $1,
+		     plan_code = COALESCE(pending_plan_code, plan_code),
+		     pending_plan_code = NULL,
+		     cancel_at_period_end = FALSE,
+		     payment_attempts = 0,
+		     next_payment_attempt_at = NULL,
+		     updated_at = NOW()
+		 WHERE id = $2 AND status IN ('active', 'pending', 'past_due')
+		 RETURNING `+subscriptionColumns,
 		durationMonths, subscriptionID,
-	).Scan(&sub.ID, &sub.UserID, &sub.Status, &sub.StartDate, &sub.EndDate,
-		&sub.CancelledAt, &sub.CreatedAt, &sub.UpdatedAt)
+	))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to renew subscription: %w", err)
@@ -173,56 +328,315 @@ func (db *DB) RenewSubscriptionTx(tx *sql.Tx, subscriptionID int, durationMonths
 
 	// Record transaction
 	_, err = tx.Exec(
-		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id) 
-		 VALUES ($1, 'renew', 'subscription', $2)`,
-		idempotencyKey, sub.ID,
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'renew', 'subscription', $2, $3)`,
+		idempotencyKey, sub.ID, fmt.Sprintf(`{"plan": %q}`, sub.PlanCode),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to record transaction: %w", err)
 	}
 
-	return &sub, nil
+	return sub, nil
 }
 
-// CancelSubscriptionTx cancels a subscription within a transaction
-func (db *DB) CancelSubscriptionTx(tx *sql.Tx, subscriptionID int, idempotencyKey string) (*models.Subscription, error) {
-	var sub models.Subscription
-	err := tx.QueryRow(
-		`UPDATE subscriptions 
-		 SET status = 'cancelled', cancelled_at = NOW(), updated_at = NOW() 
+// CancelSubscriptionTx cancels an active, paused or past_due subscription
+// within a transaction. With atPeriodEnd the subscription stays active and
+// is only flagged; the expiry worker moves it to cancelled once end_date
+// passes.
+func (db *DB) CancelSubscriptionTx(tx *sql.Tx, subscriptionID int, atPeriodEnd bool, idempotencyKey string) (*models.Subscription, error) {
+	query := `UPDATE subscriptions
+		 SET status = 'cancelled', cancelled_at = NOW(), cancel_at_period_end = FALSE,
+		     paused_at = NULL, resume_at = NULL, next_payment_attempt_at = NULL, updated_at = NOW()
+		 WHERE id = $1 AND status IN ('active', 'paused', 'past_due')
+		 RETURNING ` + subscriptionColumns
+	if atPeriodEnd {
+		query = `UPDATE subscriptions
+		 SET cancel_at_period_end = TRUE, updated_at = NOW()
 		 WHERE id = $1 AND status = 'active'
-		 RETURNING id, user_id, status, start_date, end_date, cancelled_at, created_at, updated_at`,
-		subscriptionID,
-	).Scan(&sub.ID, &sub.UserID, &sub.Status, &sub.StartDate, &sub.EndDate,
-		&sub.CancelledAt, &sub.CreatedAt, &sub.UpdatedAt)
+		 RETURNING ` + subscriptionColumns
+	}
 
+	sub, err := scanSubscription(tx.QueryRow(query, subscriptionID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to cancel subscription: %w", err)
 	}
 
 	// Record transaction
 	_, err = tx.Exec(
-		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id) 
-		 VALUES ($1, 'cancel', 'subscription', $2)`,
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'cancel', 'subscription', $2, $3)`,
+		idempotencyKey, sub.ID, fmt.Sprintf(`{"cancel_at_period_end": %t}`, atPeriodEnd),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return sub, nil
+}
+
+// UndoCancelTx clears a scheduled cancellation within a transaction
+func (db *DB) UndoCancelTx(tx *sql.Tx, subscriptionID int, idempotencyKey string) (*models.Subscription, error) {
+	sub, err := scanSubscription(tx.QueryRow(
+		`UPDATE subscriptions
+		 SET cancel_at_period_end = FALSE, updated_at = NOW()
+		 WHERE id = $1 AND status = 'active' AND cancel_at_period_end AND end_date > NOW()
+		 RETURNING `+subscriptionColumns,
+		subscriptionID,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to undo cancellation: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id)
+		 VALUES ($1, 'undo_cancel', 'subscription', $2)`,
 		idempotencyKey, sub.ID,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to record transaction: %w", err)
 	}
 
-	return &sub, nil
+	return sub, nil
+}
+
+// SetAutoRenewTx turns automatic renewal on or off within a transaction
+func (db *DB) SetAutoRenewTx(tx *sql.Tx, subscriptionID int, autoRenew bool, idempotencyKey string) (*models.Subscription, error) {
+	sub, err := scanSubscription(tx.QueryRow(
+		`UPDATE subscriptions
+		 SET auto_renew = $1, updated_at = NOW()
+		 WHERE id = $2 AND status IN ('active', 'paused', 'pending', 'past_due')
+		 RETURNING `+subscriptionColumns,
+		autoRenew, subscriptionID,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to update auto-renew: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'set_auto_renew', 'subscription', $2, $3)`,
+		idempotencyKey, sub.ID, fmt.Sprintf(`{"auto_renew": %t}`, autoRenew),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return sub, nil
+}
+
+// PauseSubscriptionTx pauses an active subscription within a transaction.
+// resumeAt is optional; when set the worker resumes the subscription then.
+func (db *DB) PauseSubscriptionTx(tx *sql.Tx, subscriptionID int, resumeAt *time.Time, idempotencyKey string) (*models.Subscription, error) {
+	sub, err := scanSubscription(tx.QueryRow(
+		`UPDATE subscriptions
+		 SET status = 'paused', paused_at = NOW(), resume_at = $1, updated_at = NOW()
+		 WHERE id = $2 AND status = 'active'
+		 RETURNING `+subscriptionColumns,
+		resumeAt, subscriptionID,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to pause subscription: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'pause', 'subscription', $2, jsonb_build_object('paused_at', $3::timestamp, 'resume_at', $4::timestamp))`,
+		idempotencyKey, sub.ID, sub.PausedAt, sub.ResumeAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return sub, nil
+}
+
+// ResumeSubscriptionTx resumes a paused subscription within a transaction,
+// pushing end_date out by the time spent paused.
+func (db *DB) ResumeSubscriptionTx(tx *sql.Tx, subscriptionID int, idempotencyKey string) (*models.Subscription, error) {
+	var pausedSeconds int64
+	err := tx.QueryRow(
+		`SELECT EXTRACT(EPOCH FROM NOW() - paused_at)::bigint
+		 FROM subscriptions
+		 WHERE id = $1 AND status = 'paused'
+		 FOR UPDATE`,
+		subscriptionID,
+	).Scan(&pausedSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume subscription: %w", err)
+	}
+
+	sub, err := scanSubscription(tx.QueryRow(
+		`UPDATE subscriptions
+		 SET status = 'active', end_date = end_date + interval '1 second' * $1,
+		     paused_at = NULL, resume_at = NULL, updated_at = NOW()
+		 WHERE id = $2
+		 RETURNING `+subscriptionColumns,
+		pausedSeconds, subscriptionID,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume subscription: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'resume', 'subscription', $2, $3)`,
+		idempotencyKey, sub.ID, fmt.Sprintf(`{"paused_seconds": %d}`, pausedSeconds),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return sub, nil
+}
+
+// ResumeDueSubscriptionsTx resumes up to limit paused subscriptions whose
+// resume_at has passed. The pause is credited up to resume_at, not up to
+// whenever the worker happens to run. Rows are claimed with SKIP LOCKED.
+func (db *DB) ResumeDueSubscriptionsTx(tx *sql.Tx, limit int) ([]int, error) {
+	rows, err := tx.Query(
+		`WITH due AS (
+		     SELECT id, paused_at, resume_at FROM subscriptions
+		     WHERE status = 'paused' AND resume_at <= NOW()
+		     ORDER BY resume_at
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 ), resumed AS (
+		     UPDATE subscriptions s
+		     SET status = 'active', end_date = s.end_date + (due.resume_at - due.paused_at),
+		         paused_at = NULL, resume_at = NULL, updated_at = NOW()
+		     FROM due
+		     WHERE s.id = due.id
+		     RETURNING s.id, due.paused_at, due.resume_at
+		 )
+		 INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 SELECT 'resume:subscription:' || id || ':' || EXTRACT(EPOCH FROM paused_at)::bigint,
+		        'resume', 'subscription', id,
+		        jsonb_build_object('paused_seconds', EXTRACT(EPOCH FROM resume_at - paused_at)::bigint, 'auto', true)
+		 FROM resumed
+		 ON CONFLICT (idempotency_key) DO NOTHING
+		 RETURNING entity_id`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan resumed subscription: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ChangePlanTx switches a subscription to a new plan within a transaction.
+// Immediate changes swap the plan in place; period-end changes are stored as
+// the pending plan and picked up by the next renewal.
+func (db *DB) ChangePlanTx(tx *sql.Tx, subscriptionID int, proration billing.Proration, idempotencyKey string) (*models.Subscription, error) {
+	query := `UPDATE subscriptions
+		 SET plan_code = $1, pending_plan_code = NULL, updated_at = NOW()
+		 WHERE id = $2 AND status = 'active'
+		 RETURNING ` + subscriptionColumns
+	if proration.ApplyAt == billing.ApplyPeriodEnd {
+		query = `UPDATE subscriptions
+		 SET pending_plan_code = $1, updated_at = NOW()
+		 WHERE id = $2 AND status = 'active'
+		 RETURNING ` + subscriptionColumns
+	}
+
+	sub, err := scanSubscription(tx.QueryRow(query, proration.NewPlan, subscriptionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to change plan: %w", err)
+	}
+
+	metadata, err := json.Marshal(proration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode proration: %w", err)
+	}
+
+	// Record transaction with the proration breakdown
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'change_plan', 'subscription', $2, $3)`,
+		idempotencyKey, sub.ID, string(metadata),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return sub, nil
+}
+
+// ExpireSubscriptionsTx ends up to limit active subscriptions whose
+// end_date has passed and returns their IDs. Subscriptions flagged
+// cancel_at_period_end become cancelled; the rest become expired.
+// Auto-renewing subscriptions are left to the renewal job, which renews
+// them or puts them into dunning. Rows are claimed with SKIP LOCKED so
+// concurrent workers never pick up the same subscription.
+func (db *DB) ExpireSubscriptionsTx(tx *sql.Tx, limit int) ([]int, error) {
+	rows, err := tx.Query(
+		`WITH due AS (
+		     SELECT id FROM subscriptions
+		     WHERE status = 'active' AND end_date <= NOW()
+		       AND (NOT auto_renew OR cancel_at_period_end)
+		     ORDER BY end_date
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 ), ended AS (
+		     UPDATE subscriptions s
+		     SET status = CASE WHEN s.cancel_at_period_end THEN 'cancelled' ELSE 'expired' END,
+		         cancelled_at = CASE WHEN s.cancel_at_period_end THEN s.end_date ELSE s.cancelled_at END,
+		         updated_at = NOW()
+		     FROM due
+		     WHERE s.id = due.id
+		     RETURNING s.id, s.status, s.end_date
+		 )
+		 INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 SELECT CASE WHEN status = 'cancelled' THEN 'cancel' ELSE 'expire' END || ':subscription:' || id,
+		        CASE WHEN status = 'cancelled' THEN 'cancel' ELSE 'expire' END,
+		        'subscription', id,
+		        jsonb_build_object('end_date', end_date, 'status', status)
+		 FROM ended
+		 ON CONFLICT (idempotency_key) DO NOTHING
+		 RETURNING entity_id`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan expired subscription: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
 // GetGiftByID retrieves a gift by ID
 func (db *DB) GetGiftByID(id int) (*models.Gift, error) {
-	var gift models.Gift
-	err := db.QueryRow(
-		`SELECT id, gifter_id, recipient_email, recipient_id, status, duration_months, redeemed_at, expires_at, created_at 
-		 FROM gifts 
+	gift, err := scanGift(db.QueryRow(
+		`SELECT `+giftColumns+`
+		 FROM gifts
 		 WHERE id = $1`,
 		id,
-	).Scan(&gift.ID, &gift.GifterID, &gift.RecipientEmail, &gift.RecipientID,
-		&gift.Status, &gift.DurationMonths, &gift.RedeemedAt, &gift.ExpiresAt, &gift.CreatedAt)
+	))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -230,84 +644,316 @@ func (db *DB) GetGiftByID(id int) (*models.Gift, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get gift: %w", err)
 	}
-	return &gift, nil
+	return gift, nil
 }
 
-// CreateGiftTx creates a gift within a transaction
-func (db *DB) CreateGiftTx(tx *sql.Tx, gifterID int, recipientEmail string, durationMonths int, idempotencyKey string) (*models.Gift, error) {
-	expiresAt := time.Now().AddDate(0, 0, 30) // Gift expires in 30 days
+// GetGiftByCode retrieves a gift by its redemption code, which must be in
+// canonical form (see giftcode.Normalize)
+func (db *DB) GetGiftByCode(code string) (*models.Gift, error) {
+	gift, err := scanGift(db.QueryRow(
+		`SELECT `+giftColumns+`
+		 FROM gifts
+		 WHERE redemption_code = $1`,
+		code,
+	))
 
-	var gift models.Gift
-	err := tx.QueryRow(
-		`INSERT INTO gifts (gifter_id, recipient_email, status, duration_months, expires_at) 
-		 VALUES ($1, $2, 'pending', $3, $4) 
-		 RETURNING id, gifter_id, recipient_email, recipient_id, status, duration_months, redeemed_at, expires_at, created_at`,
-		gifterID, recipientEmail, durationMonths, expiresAt,
-	).Scan(&gift.ID, &gift.GifterID, &gift.RecipientEmail, &gift.RecipientID,
-		&gift.Status, &gift.DurationMonths, &gift.RedeemedAt, &gift.ExpiresAt, &gift.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gift: %w", err)
+	}
+	return gift, nil
+}
+
+// CreateGiftTx creates a gift with a new redemption code within a
+// transaction. The amount paid is captured at purchase so an expiry refund
+// matches what the gifter paid, and the recipient email is stored
+// normalized. A gift with a future deliver_at is created scheduled; any
+// other is delivered at once. Either way it expires 30 days after delivery.
+func (db *DB) CreateGiftTx(tx *sql.Tx, req *models.GiftRequest, plan *models.Plan, durationMonths int, amount int64, idempotencyKey string) (*models.Gift, error) {
+	return db.createGiftTx(tx, req, plan, durationMonths, amount, nil, idempotencyKey)
+}
+
+// createGiftTx creates a gift, as part of batchID when it is not nil
+func (db *DB) createGiftTx(tx *sql.Tx, req *models.GiftRequest, plan *models.Plan, durationMonths int, amount int64, batchID *int, idempotencyKey string) (*models.Gift, error) {
+	now := time.Now()
+	deliverAt, status, deliveredAt := now, models.GiftPending, &now
+	if req.DeliverAt != nil && req.DeliverAt.After(now) {
+		deliverAt, status, deliveredAt = *req.DeliverAt, models.GiftScheduled, nil
+	}
+	expiresAt := deliverAt.AddDate(0, 0, 30) // Gift expires 30 days after delivery
+
+	code, err := giftcode.Generate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate redemption code: %w", err)
+	}
+
+	gift, err := scanGift(tx.QueryRow(
+		`INSERT INTO gifts (gifter_id, recipient_email, redemption_code, open, plan_code, status, duration_months,
+		                    amount_cents, currency, message, sender_name, deliver_at, delivered_at, expires_at, batch_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NULLIF($11, ''), $12, $13, $14, $15)
+		 RETURNING `+giftColumns,
+		req.GifterID, models.NormalizeEmail(req.RecipientEmail), code, req.Open, plan.Code, status, durationMonths,
+		amount, plan.Currency, req.Message, req.SenderName, deliverAt, deliveredAt, expiresAt, batchID,
+	))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gift: %w", err)
 	}
 
 	// Record transaction
-	_, err = tx.Exec(
-		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id) 
-		 VALUES ($1, 'create', 'gift', $2)`,
-		idempotencyKey, gift.ID,
-	)
+	var transactionID int
+	err = tx.QueryRow(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'create', 'gift', $2, jsonb_build_object('plan', $3::text, 'open', $4::boolean, 'deliver_at', $5::timestamp,
+		         'batch_id', $6::int))
+		 RETURNING id`,
+		idempotencyKey, gift.ID, gift.PlanCode, gift.Open, gift.DeliverAt, batchID,
+	).Scan(&transactionID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to record transaction: %w", err)
 	}
 
-	return &gift, nil
+	if gift.Status == models.GiftPending {
+		if err := db.giftDeliveredTx(tx, gift, transactionID); err != nil {
+			return nil, err
+		}
+	}
+
+	return gift, nil
 }
 
-// RedeemGiftTx redeems a gift and creates subscription within a transaction
-func (db *DB) RedeemGiftTx(tx *sql.Tx, giftID int, userID int, idempotencyKey string) (*models.Subscription, *models.Gift, error) {
+// DeliverGiftsTx delivers up to limit scheduled gifts whose deliver_at has
+// passed, making them visible and redeemable, and records a gift.delivered
+// event for each. It returns the delivered gift IDs. Rows are claimed with
+// SKIP LOCKED so concurrent workers never deliver the same gift twice.
+func (db *DB) DeliverGiftsTx(tx *sql.Tx, limit int) ([]int, error) {
+	rows, err := tx.Query(
+		`WITH due AS (
+		     SELECT id AS due_id FROM gifts
+		     WHERE status = 'scheduled' AND deliver_at <= NOW()
+		     ORDER BY deliver_at
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 UPDATE gifts
+		 SET status = 'pending', delivered_at = NOW()
+		 FROM due
+		 WHERE id = due_id
+		 RETURNING `+giftColumns,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deliver gifts: %w", err)
+	}
+
+	var gifts []*models.Gift
+	for rows.Next() {
+		gift, err := scanGift(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan delivered gift: %w", err)
+		}
+		gifts = append(gifts, gift)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, gift := range gifts {
+		var transactionID int
+		err := tx.QueryRow(
+			`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+			 VALUES ($1, 'deliver', 'gift', $2, jsonb_build_object('deliver_at', $3::timestamp))
+			 ON CONFLICT (idempotency_key) DO NOTHING
+			 RETURNING id`,
+			fmt.Sprintf("deliver:gift:%d", gift.ID), gift.ID, gift.DeliverAt,
+		).Scan(&transactionID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to record transaction: %w", err)
+		}
+
+		if err := db.giftDeliveredTx(tx, gift, transactionID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, gift.ID)
+	}
+	return ids, nil
+}
+
+// RecordRejectedRedemption appends a refused gift redemption to the audit
+// trail. It runs outside the redemption's transaction, which is never
+// committed when the attempt is refused.
+func (db *DB) RecordRejectedRedemption(rejection models.RejectedRedemption) error {
+	_, err := db.Exec(
+		`INSERT INTO gift_redemption_rejections (gift_id, user_id, user_email, client_ip, reason)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		rejection.GiftID, rejection.UserID, rejection.UserEmail, rejection.ClientIP, rejection.Reason,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record rejected redemption: %w", err)
+	}
+	return nil
+}
+
+// ExpireGiftsTx expires up to limit pending gifts past expires_at, creates
+// a pending refund to the gifter for each and moves what was paid from gift
+// liability to refunds payable. It returns the expired gift IDs. Rows are
+// claimed with SKIP LOCKED so concurrent workers never refund the same
+// gift twice.
+func (db *DB) ExpireGiftsTx(tx *sql.Tx, limit int) ([]int, error) {
+	rows, err := tx.Query(
+		`WITH due AS (
+		     SELECT id FROM gifts
+		     WHERE status = 'pending' AND expires_at <= NOW()
+		     ORDER BY expires_at
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 ), expired AS (
+		     UPDATE gifts g
+		     SET status = 'expired'
+		     FROM due
+		     WHERE g.id = due.id
+		     RETURNING g.id, g.gifter_id, g.amount_cents, g.currency, g.expires_at
+		 ), refunded AS (
+		     INSERT INTO refunds (user_id, entity_type, entity_id, amount_cents, currency, reason)
+		     SELECT gifter_id, 'gift', id, amount_cents, currency, 'gift_expired'
+		     FROM expired
+		     RETURNING id, entity_id, amount_cents
+		 )
+		 INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 SELECT 'expire:gift:' || e.id, 'expire', 'gift', e.id,
+		        jsonb_build_object('expires_at', e.expires_at, 'refund_id', r.id,
+		                           'refund_cents', r.amount_cents, 'currency', e.currency)
+		 FROM expired e
+		 JOIN refunded r ON r.entity_id = e.id
+		 ON CONFLICT (idempotency_key) DO NOTHING
+		 RETURNING id, entity_id, (metadata->>'refund_cents')::bigint, metadata->>'currency'`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire gifts: %w", err)
+	}
+
+	type expiredGift struct {
+		transactionID, giftID int
+		amount                int64
+		currency              string
+	}
+	var expired []expiredGift
+	for rows.Next() {
+		var e expiredGift
+		if err := rows.Scan(&e.transactionID, &e.giftID, &e.amount, &e.currency); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan expired gift: %w", err)
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, e := range expired {
+		if _, err := db.PostJournalTx(tx, billing.GiftExpiryJournal(e.giftID, e.amount, e.currency), &e.transactionID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, e.giftID)
+	}
+	return ids, nil
+}
+
+// RedeemGiftTx redeems a gift within a transaction. With no existing
+// subscription it creates one on the gifted plan; otherwise it extends the
+// existing active or paused subscription's end_date by the gift's months.
+// The transaction metadata records which of the two it did.
+func (db *DB) RedeemGiftTx(tx *sql.Tx, giftID int, userID int, existing *models.Subscription, idempotencyKey string) (*models.Subscription, *models.Gift, error) {
 	// Update gift status
-	var gift models.Gift
-	err := tx.QueryRow(
-		`UPDATE gifts 
-		 SET status = 'redeemed', recipient_id = $1, redeemed_at = NOW() 
+	gift, err := scanGift(tx.QueryRow(
+		`UPDATE gifts
+		 SET status = 'redeemed', recipient_id = $1, redeemed_at = NOW()
 		 WHERE id = $2 AND status = 'pending' AND expires_at > NOW()
-		 RETURNING id, gifter_id, recipient_email, recipient_id, status, duration_months, redeemed_at, expires_at, created_at`,
+		 RETURNING `+giftColumns,
 		userID, giftID,
-	).Scan(&gift.ID, &gift.GifterID, &gift.RecipientEmail, &gift.RecipientID,
-		&gift.Status, &gift.DurationMonths, &gift.RedeemedAt, &gift.ExpiresAt, &gift.CreatedAt)
+	))
 
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to redeem gift: %w", err)
 	}
 
-	// Create subscription for recipient
-	startDate := time.Now()
-	endDate := startDate.AddDate(0, gift.DurationMonths, 0)
+	var sub *models.Subscription
+	var periodStart time.Time
+	appliedAs := "new_subscription"
+	if existing == nil {
+		// Create subscription for recipient on the gifted plan
+		startDate := time.Now()
+		endDate := startDate.AddDate(0, gift.DurationMonths, 0)
+
+		sub, err = scanSubscription(tx.QueryRow(
+			`INSERT INTO subscriptions (user_id, plan_code, status, start_date, end_date)
+			 VALUES ($1, $2, 'active', $3, $4)
+			 RETURNING `+subscriptionColumns,
+			userID, gift.PlanCode, startDate, endDate,
+		))
 
-	var sub models.Subscription
-	err = tx.QueryRow(
-		`INSERT INTO subscriptions (user_id, status, start_date, end_date) 
-		 VALUES ($1, 'active', $2, $3) 
-		 RETURNING id, user_id, status, start_date, end_date, cancelled_at, created_at, updated_at`,
-		userID, startDate, endDate,
-	).Scan(&sub.ID, &sub.UserID, &sub.Status, &sub.StartDate, &sub.EndDate,
-		&sub.CancelledAt, &sub.CreatedAt, &sub.UpdatedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create subscription from gift: %w", err)
+		}
+		periodStart = sub.StartDate
+	} else {
+		// The gifted months start where the current period ends
+		err = tx.QueryRow(
+			`SELECT end_date FROM subscriptions
+			 WHERE id = $1 AND user_id = $2 AND status IN ('active', 'paused')
+			 FOR UPDATE`,
+			existing.ID, userID,
+		).Scan(&periodStart)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to lock subscription: %w", err)
+		}
 
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create subscription from gift: %w", err)
+		sub, err = scanSubscription(tx.QueryRow(
+			`UPDATE subscriptions
+			 SET end_date = end_date + interval '1 month' * $1, updated_at = NOW()
+			 WHERE id = $2
+			 RETURNING `+subscriptionColumns,
+			gift.DurationMonths, existing.ID,
+		))
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to extend subscription with gift: %w", err)
+		}
+		appliedAs = "extension"
 	}
 
 	// Record transaction
-	_, err = tx.Exec(
-		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata) 
-		 VALUES ($1, 'redeem', 'gift', $2, $3)`,
-		idempotencyKey, gift.ID, fmt.Sprintf(`{"subscription_id": %d}`, sub.ID),
-	)
+	var transactionID int
+	err = tx.QueryRow(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'redeem', 'gift', $2, jsonb_build_object('subscription_id', $3::int, 'applied_as', $4::text,
+		         'period_start', $5::timestamp, 'end_date', $6::timestamp, 'duration_months', $7::int))
+		 RETURNING id`,
+		idempotencyKey, gift.ID, sub.ID, appliedAs, periodStart, sub.EndDate, gift.DurationMonths,
+	).Scan(&transactionID)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to record transaction: %w", err)
 	}
 
-	return &sub, &gift, nil
+	if _, err := db.PostJournalTx(tx, billing.GiftRedemptionJournal(gift, sub.ID), &transactionID); err != nil {
+		return nil, nil, err
+	}
+	if err := db.scheduleGiftRevenueTx(tx, gift, sub.ID, periodStart, sub.EndDate); err != nil {
+		return nil, nil, err
+	}
+
+	return sub, gift, nil
 }
 
 // BeginTx starts a new database transaction
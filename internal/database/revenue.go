@@ -0,0 +1,314 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const revenueScheduleColumns = `id, entity_type, entity_id, invoice_id, gift_id, amount_cents, released_cents,
+		 recognized_cents, currency, starts_at, ends_at, recognized_through, status, created_at`
+
+func scanRevenueSchedule(row rowScanner) (*models.RevenueSchedule, error) {
+	var s models.RevenueSchedule
+	err := row.Scan(&s.ID, &s.EntityType, &s.EntityID, &s.InvoiceID, &s.GiftID, &s.AmountCents, &s.ReleasedCents,
+		&s.RecognizedCents, &s.Currency, &s.StartsAt, &s.EndsAt, &s.RecognizedThrough, &s.Status, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// scheduleInvoiceRevenueTx creates the schedule for a paid subscription
+// invoice within a transaction. The period paid for runs from the end of
+// the subscription's previous schedule, or from now when there is none or
+// it already ended, to its current end_date.
+func (db *DB) scheduleInvoiceRevenueTx(tx *sql.Tx, invoice *models.Invoice) error {
+	_, err := tx.Exec(
+		`WITH period AS (
+		     SELECT GREATEST(MAX(ends_at), NOW()) AS starts_at
+		     FROM revenue_schedules
+		     WHERE entity_type = 'subscription' AND entity_id = $1 AND status <> 'closed'
+		 )
+		 INSERT INTO revenue_schedules (entity_type, entity_id, invoice_id, amount_cents, currency,
+		                                starts_at, ends_at, recognized_through)
+		 SELECT 'subscription', s.id, $2, $3, $4, p.starts_at, GREATEST(s.end_date, p.starts_at), p.starts_at
+		 FROM subscriptions s, period p
+		 WHERE s.id = $1`,
+		invoice.EntityID, invoice.ID, invoice.TotalCents, invoice.Currency,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create revenue schedule: %w", err)
+	}
+	return nil
+}
+
+// scheduleGiftRevenueTx creates the schedule for a redeemed gift, spread
+// over the months of the subscription it paid for, within a transaction
+func (db *DB) scheduleGiftRevenueTx(tx *sql.Tx, gift *models.Gift, subscriptionID int, startsAt, endsAt time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO revenue_schedules (entity_type, entity_id, gift_id, amount_cents, currency,
+		                                starts_at, ends_at, recognized_through)
+		 VALUES ('subscription', $1, $2, $3, $4, $5, $6, $5)`,
+		subscriptionID, gift.ID, gift.AmountCents, gift.Currency, startsAt, endsAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create revenue schedule: %w", err)
+	}
+	return nil
+}
+
+// lockRevenueSchedulesTx locks and returns an entity's active schedules in
+// currency, newest period first
+func (db *DB) lockRevenueSchedulesTx(tx *sql.Tx, entityType string, entityID int, currency string) ([]models.RevenueSchedule, error) {
+	rows, err := tx.Query(
+		`SELECT `+revenueScheduleColumns+`
+		 FROM revenue_schedules
+		 WHERE entity_type = $1 AND entity_id = $2 AND currency = $3 AND status = 'active'
+		 ORDER BY starts_at DESC, id DESC
+		 FOR UPDATE`,
+		entityType, entityID, currency,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revenue schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []models.RevenueSchedule
+	for rows.Next() {
+		s, err := scanRevenueSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan revenue schedule: %w", err)
+		}
+		schedules = append(schedules, *s)
+	}
+	return schedules, rows.Err()
+}
+
+// ReleaseRevenueTx takes amount of deferred revenue off a subscription's
+// schedules within a transaction, newest period first, when it is given
+// back to the user rather than earned
+func (db *DB) ReleaseRevenueTx(tx *sql.Tx, subscriptionID int, amount int64, currency string) error {
+	schedules, err := db.lockRevenueSchedulesTx(tx, "subscription", subscriptionID, currency)
+	if err != nil {
+		return err
+	}
+
+	for i, share := range billing.AllocateRelease(schedules, amount) {
+		if share == 0 {
+			continue
+		}
+		_, err := tx.Exec(
+			`UPDATE revenue_schedules SET released_cents = released_cents + $1 WHERE id = $2`,
+			share, schedules[i].ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to release revenue: %w", err)
+		}
+	}
+	return nil
+}
+
+// PostCancellationTx closes a subscription's revenue schedules on an
+// immediate cancellation, within the cancel's transaction. What summary
+// gives back, to the card and as credit, is released from the newest
+// periods first; whatever is still deferred after that has been earned and
+// is recognized now.
+func (db *DB) PostCancellationTx(tx *sql.Tx, sub *models.Subscription, summary billing.RefundSummary, idempotencyKey string) error {
+	var transactionID int
+	err := tx.QueryRow(
+		`SELECT id FROM transactions WHERE idempotency_key = $1`,
+		idempotencyKey,
+	).Scan(&transactionID)
+	if err != nil {
+		return fmt.Errorf("failed to find transaction: %w", err)
+	}
+
+	currencies := []string{}
+	err = func() error {
+		rows, err := tx.Query(
+			`SELECT DISTINCT currency FROM revenue_schedules
+			 WHERE entity_type = 'subscription' AND entity_id = $1 AND status = 'active'`,
+			sub.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to get revenue schedules: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var currency string
+			if err := rows.Scan(&currency); err != nil {
+				return fmt.Errorf("failed to scan currency: %w", err)
+			}
+			if summary.AmountCents == 0 || currency != summary.Currency {
+				currencies = append(currencies, currency)
+			}
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return err
+	}
+	if summary.AmountCents > 0 {
+		currencies = append(currencies, summary.Currency)
+	}
+
+	for _, currency := range currencies {
+		schedules, err := db.lockRevenueSchedulesTx(tx, "subscription", sub.ID, currency)
+		if err != nil {
+			return err
+		}
+
+		var refunded, credited, deferred int64
+		if summary.Currency == currency {
+			refunded, credited = summary.RefundCents, summary.CreditCents
+		}
+		for i, share := range billing.AllocateRelease(schedules, refunded+credited) {
+			deferred += schedules[i].RemainingCents()
+			_, err := tx.Exec(
+				`UPDATE revenue_schedules
+				 SET released_cents = released_cents + $1,
+				     recognized_cents = amount_cents - released_cents - $1,
+				     recognized_through = NOW(), status = 'closed'
+				 WHERE id = $2`,
+				share, schedules[i].ID,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to close revenue schedule: %w", err)
+			}
+		}
+
+		draft := billing.CancellationJournal(sub.ID, deferred, refunded, credited, currency)
+		if _, err := db.PostJournalTx(tx, draft, &transactionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecognizeRevenueTx recognizes revenue earned up to the start of the
+// current UTC day on up to limit schedules and returns their IDs. Each
+// schedule gets its own deterministic transaction key per day, and rows
+// are claimed with SKIP LOCKED so concurrent workers never recognize the
+// same revenue twice.
+func (db *DB) RecognizeRevenueTx(tx *sql.Tx, limit int) ([]int, error) {
+	through := time.Now().UTC().Truncate(24 * time.Hour)
+
+	rows, err := tx.Query(
+		`SELECT `+revenueScheduleColumns+`
+		 FROM revenue_schedules
+		 WHERE status = 'active' AND recognized_through < $1
+		 ORDER BY recognized_through
+		 LIMIT $2
+		 FOR UPDATE SKIP LOCKED`,
+		through, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim revenue schedules: %w", err)
+	}
+
+	var schedules []models.RevenueSchedule
+	for rows.Next() {
+		s, err := scanRevenueSchedule(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan revenue schedule: %w", err)
+		}
+		schedules = append(schedules, *s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for i := range schedules {
+		s := &schedules[i]
+		amount := billing.RecognizableAmount(s, through)
+		recognizedThrough := through
+		status := models.ScheduleActive
+		if !through.Before(s.EndsAt) {
+			recognizedThrough, status = s.EndsAt, models.ScheduleCompleted
+		}
+
+		var transactionID int
+		err := tx.QueryRow(
+			`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+			 VALUES ($1, 'recognize_revenue', 'revenue_schedule', $2,
+			         jsonb_build_object('through', $3::timestamp, 'amount_cents', $4::bigint, 'currency', $5::text))
+			 ON CONFLICT (idempotency_key) DO NOTHING
+			 RETURNING id`,
+			fmt.Sprintf("recognize:schedule:%d:%d", s.ID, through.Unix()), s.ID, recognizedThrough, amount, s.Currency,
+		).Scan(&transactionID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to record transaction: %w", err)
+		}
+
+		_, err = tx.Exec(
+			`UPDATE revenue_schedules
+			 SET recognized_cents = recognized_cents + $1, recognized_through = $2, status = $3
+			 WHERE id = $4`,
+			amount, recognizedThrough, status, s.ID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to recognize revenue: %w", err)
+		}
+
+		if _, err := db.PostJournalTx(tx, billing.RecognitionJournal(s, amount, recognizedThrough), &transactionID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+// GetRevenueReport returns, for each month from the month of from to the
+// month of to, the revenue recognized during the month and the revenue
+// still deferred at its end, per currency. Entries count towards the month
+// their effective_at falls in, with each month including its closing
+// instant so recognition through midnight on the 1st lands in the month
+// it was earned.
+func (db *DB) GetRevenueReport(from, to time.Time) ([]models.RevenueMonth, error) {
+	rows, err := db.Query(
+		`WITH months AS (
+		     SELECT generate_series(date_trunc('month', $1::timestamp), date_trunc('month', $2::timestamp),
+		                            interval '1 month') AS month
+		 ), lines AS (
+		     SELECT l.account, l.currency, l.credit_cents - l.debit_cents AS amount, e.effective_at
+		     FROM journal_lines l
+		     JOIN journal_entries e ON e.id = l.entry_id
+		     WHERE l.account IN ($3, $4)
+		 )
+		 SELECT to_char(m.month, 'YYYY-MM'), c.currency,
+		        COALESCE(SUM(l.amount) FILTER (WHERE l.account = $3
+		            AND l.effective_at > m.month AND l.effective_at <= m.month + interval '1 month'), 0),
+		        COALESCE(SUM(l.amount) FILTER (WHERE l.account = $4
+		            AND l.effective_at <= m.month + interval '1 month'), 0)
+		 FROM months m
+		 CROSS JOIN (SELECT DISTINCT currency FROM lines) c
+		 LEFT JOIN lines l ON l.currency = c.currency
+		 GROUP BY m.month, c.currency
+		 ORDER BY m.month, c.currency`,
+		from, to, billing.AccountRecognizedRevenue, billing.AccountDeferredRevenue,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revenue report: %w", err)
+	}
+	defer rows.Close()
+
+	report := []models.RevenueMonth{}
+	for rows.Next() {
+		var m models.RevenueMonth
+		if err := rows.Scan(&m.Month, &m.Currency, &m.RecognizedCents, &m.DeferredCents); err != nil {
+			return nil, fmt.Errorf("failed to scan revenue report: %w", err)
+		}
+		report = append(report, m)
+	}
+	return report, rows.Err()
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+// CreateUserTx creates a user with a normalized email within a transaction
+func (db *DB) CreateUserTx(tx *sql.Tx, email string, idempotencyKey string) (*models.User, error) {
+	var user models.User
+	err := tx.QueryRow(
+		`INSERT INTO users (email) VALUES ($1)
+		 RETURNING id, email, created_at, updated_at`,
+		models.NormalizeEmail(email),
+	).Scan(&user.ID, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'create', 'user', $2, jsonb_build_object('email', $3::text))`,
+		idempotencyKey, user.ID, user.Email,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return &user, nil
+}
+
+// ChangeUserEmailTx changes a user's email to a normalized one within a
+// transaction, recording the old and new address
+func (db *DB) ChangeUserEmailTx(tx *sql.Tx, userID int, email string, idempotencyKey string) (*models.User, error) {
+	var previousEmail string
+	err := tx.QueryRow(
+		`SELECT email FROM users WHERE id = $1 FOR UPDATE`,
+		userID,
+	).Scan(&previousEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock user: %w", err)
+	}
+
+	var user models.User
+	err = tx.QueryRow(
+		`UPDATE users SET email = $1, updated_at = NOW()
+		 WHERE id = $2
+		 RETURNING id, email, created_at, updated_at`,
+		models.NormalizeEmail(email), userID,
+	).Scan(&user.ID, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to change user email: %w", err)
+	}
+
+	// Record transaction
+	_, err = tx.Exec(
+		`INSERT INTO transactions (idempotency_key, operation_type, entity_type, entity_id, metadata)
+		 VALUES ($1, 'change_email', 'user', $2, jsonb_build_object('from', $3::text, 'to', $4::text))`,
+		idempotencyKey, user.ID, previousEmail, user.Email,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,89 @@
+// Package giftcode generates and checks gift redemption codes.
+//
+// A code is 16 symbols of Crockford's base32 alphabet, shown in groups of
+// four (7K3Q-M9TX-2HVD-R4NC). The first 15 symbols are random, 75 bits from
+// crypto/rand, and the last is a Luhn mod 32 check symbol, so typos are
+// caught before a lookup and count as failed attempts without touching the
+// database.
+package giftcode
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+// alphabet is Crockford's base32: no I, L, O or U
+const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const (
+	randomLength = 15
+	codeLength   = randomLength + 1
+	groupSize    = 4
+)
+
+// Generate returns a new random code in its canonical form
+func Generate() (string, error) {
+	random := make([]byte, randomLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	values := make([]int, codeLength)
+	for i, b := range random {
+		values[i] = int(b) % len(alphabet)
+	}
+	values[randomLength] = checkValue(values[:randomLength])
+	return format(values), nil
+}
+
+// Normalize parses a code as a person might type it, in any case, with or
+// without separators and with O, I and L for 0, 1 and 1. It returns the
+// canonical form, and false if the code is malformed or its check symbol
+// does not match.
+func Normalize(code string) (string, bool) {
+	values := make([]int, 0, codeLength)
+	for _, r := range strings.ToUpper(code) {
+		switch r {
+		case '-', ' ':
+			continue
+		case 'O':
+			r = '0'
+		case 'I', 'L':
+			r = '1'
+		}
+		v := strings.IndexRune(alphabet, r)
+		if v < 0 || len(values) == codeLength {
+			return "", false
+		}
+		values = append(values, v)
+	}
+
+	if len(values) != codeLength || checkValue(values[:randomLength]) != values[randomLength] {
+		return "", false
+	}
+	return format(values), true
+}
+
+// checkValue computes the Luhn mod 32 check value of values, which catches
+// every single-symbol error and most adjacent transpositions
+func checkValue(values []int) int {
+	n := len(alphabet)
+	factor, sum := 2, 0
+	for i := len(values) - 1; i >= 0; i-- {
+		addend := factor * values[i]
+		sum += addend/n + addend%n
+		factor = 3 - factor
+	}
+	return (n - sum%n) % n
+}
+
+func format(values []int) string {
+	var b strings.Builder
+	for i, v := range values {
+		if i > 0 && i%groupSize == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(alphabet[v])
+	}
+	return b.String()
+}
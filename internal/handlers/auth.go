@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
+)
+
+// requirePrincipal returns the authenticated caller of r. Authorization
+// fails closed: a request that never went through the auth middleware has
+// no principal and is rejected, so a route registered outside it cannot
+// become public. It writes the error response and returns nil when there
+// is no caller.
+func requirePrincipal(w http.ResponseWriter, r *http.Request) *auth.Principal {
+	principal := auth.FromContext(r.Context())
+	if principal == nil {
+		writeError(w, http.StatusUnauthorized, "Authentication required")
+	}
+	return principal
+}
+
+// authorizeUser checks that the caller may act for userID: a user only for
+// themselves, a service for anyone. It writes the error response and
+// returns false when the caller may not.
+func authorizeUser(w http.ResponseWriter, r *http.Request, userID int) bool {
+	principal := requirePrincipal(w, r)
+	if principal == nil {
+		return false
+	}
+	if !principal.CanActFor(userID) {
+		writeError(w, http.StatusForbidden, "Not allowed to act for this user")
+		return false
+	}
+	return true
+}
+
+// requireService checks that the caller is a server-to-server caller, for
+// administrative endpoints that end users may not reach. It writes the
+// error response and returns false when the caller is not.
+func requireService(w http.ResponseWriter, r *http.Request) bool {
+	principal := requirePrincipal(w, r)
+	if principal == nil {
+		return false
+	}
+	if principal.Kind != auth.PrincipalService {
+		writeError(w, http.StatusForbidden, "This endpoint requires an API key")
+		return false
+	}
+	return true
+}
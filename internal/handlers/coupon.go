@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+type CouponHandler struct {
+	db *database.DB
+}
+
+func NewCouponHandler(db *database.DB) *CouponHandler {
+	return &CouponHandler{db: db}
+}
+
+// Coupons handles GET /coupons and POST /coupons
+func (h *CouponHandler) Coupons(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.ListCoupons(w, r)
+	case http.MethodPost:
+		h.CreateCoupon(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// Coupon handles GET and DELETE /coupons/{code}
+func (h *CouponHandler) Coupon(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.GetCoupon(w, r)
+	case http.MethodDelete:
+		h.DeactivateCoupon(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// ListCoupons handles GET /coupons
+func (h *CouponHandler) ListCoupons(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	coupons, err := h.db.ListCoupons()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"coupons": coupons})
+}
+
+// GetCoupon handles GET /coupons/{code}
+func (h *CouponHandler) GetCoupon(w http.ResponseWriter, r *http.Request) {
+	code := normalizeCouponCode(strings.TrimPrefix(r.URL.Path, "/coupons/"))
+	if code == "" {
+		writeError(w, http.StatusBadRequest, "Coupon code is required")
+		return
+	}
+
+	coupon, err := h.db.GetCouponByCode(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if coupon == nil {
+		writeError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, coupon)
+}
+
+// CreateCoupon handles POST /coupons
+func (h *CouponHandler) CreateCoupon(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	var req models.CouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Code = normalizeCouponCode(req.Code)
+	if req.Code == "" {
+		writeError(w, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	// Each kind needs exactly its own value
+	switch req.Kind {
+	case models.CouponPercent:
+		if req.PercentOff == nil || *req.PercentOff < 1 || *req.PercentOff > 100 {
+			writeError(w, http.StatusBadRequest, "percent_off must be between 1 and 100")
+			return
+		}
+		req.AmountOffCents, req.Currency, req.FreeMonths = nil, nil, nil
+	case models.CouponAmount:
+		if req.AmountOffCents == nil || *req.AmountOffCents <= 0 {
+			writeError(w, http.StatusBadRequest, "amount_off_cents must be positive")
+			return
+		}
+		if req.Currency == nil || len(*req.Currency) != 3 {
+			writeError(w, http.StatusBadRequest, "currency must be a 3-letter ISO code")
+			return
+		}
+		currency := strings.ToUpper(*req.Currency)
+		req.Currency = &currency
+		req.PercentOff, req.FreeMonths = nil, nil
+	case models.CouponFreeMonths:
+		if req.FreeMonths == nil || *req.FreeMonths <= 0 {
+			writeError(w, http.StatusBadRequest, "free_months must be positive")
+			return
+		}
+		req.PercentOff, req.AmountOffCents, req.Currency = nil, nil, nil
+	default:
+		writeError(w, http.StatusBadRequest, "kind must be 'percent', 'amount' or 'free_months'")
+		return
+	}
+
+	if req.MaxRedemptions != nil && *req.MaxRedemptions <= 0 {
+		writeError(w, http.StatusBadRequest, "max_redemptions must be positive")
+		return
+	}
+
+	if req.PerUserLimit != nil && *req.PerUserLimit <= 0 {
+		writeError(w, http.StatusBadRequest, "per_user_limit must be positive")
+		return
+	}
+
+	if req.ValidFrom != nil && req.ValidUntil != nil && !req.ValidUntil.After(*req.ValidFrom) {
+		writeError(w, http.StatusBadRequest, "valid_until must be after valid_from")
+		return
+	}
+
+	// Plan restrictions must name real plans
+	for _, code := range req.PlanCodes {
+		plan, err := h.db.GetPlanByCode(code)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if plan == nil {
+			writeError(w, http.StatusBadRequest, "Unknown plan in plan_codes: "+code)
+			return
+		}
+	}
+
+	existing, err := h.db.GetCouponByCode(req.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing != nil {
+		writeError(w, http.StatusConflict, "Coupon code already exists")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	coupon, err := h.db.CreateCouponTx(tx, req, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create coupon")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, coupon)
+}
+
+// DeactivateCoupon handles DELETE /coupons/{code}
+func (h *CouponHandler) DeactivateCoupon(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	code := normalizeCouponCode(strings.TrimPrefix(r.URL.Path, "/coupons/"))
+	if code == "" {
+		writeError(w, http.StatusBadRequest, "Coupon code is required")
+		return
+	}
+
+	existing, err := h.db.GetCouponByCode(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	coupon, err := h.db.DeactivateCouponTx(tx, code, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to deactivate coupon")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, coupon)
+}
+
+// Helper functions
+
+// normalizeCouponCode makes coupon codes case-insensitive
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// resolveCoupon looks up a coupon and checks it applies to plan. An empty
+// code yields a nil coupon. It writes the error response and returns false
+// when the coupon cannot be used.
+func resolveCoupon(w http.ResponseWriter, db *database.DB, code string, plan *models.Plan) (*models.Coupon, bool) {
+	code = normalizeCouponCode(code)
+	if code == "" {
+		return nil, true
+	}
+
+	coupon, err := db.GetCouponByCode(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	if coupon == nil {
+		writeError(w, http.StatusBadRequest, "Unknown coupon")
+		return nil, false
+	}
+
+	if err := billing.CheckCoupon(coupon, plan, time.Now()); err != nil {
+		writeError(w, http.StatusConflict, "Coupon cannot be applied: "+err.Error())
+		return nil, false
+	}
+
+	return coupon, true
+}
+
+// redeemCoupon records a coupon use inside tx. It is a no-op for a nil
+// coupon. Redeeming locks the coupon's row until commit, so like invoice
+// numbering it must come after any provider call. It writes the error
+// response and returns false on failure.
+func redeemCoupon(w http.ResponseWriter, db *database.DB, tx *sql.Tx, coupon *models.Coupon, userID int, entityType string, entityID int, discount billing.Discount, idempotencyKey string) bool {
+	if coupon == nil {
+		return true
+	}
+
+	err := db.RedeemCouponTx(tx, coupon, userID, entityType, entityID, discount, idempotencyKey)
+	if errors.Is(err, billing.ErrCouponExhausted) || errors.Is(err, billing.ErrCouponUserLimit) {
+		writeError(w, http.StatusConflict, "Coupon cannot be applied: "+err.Error())
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to redeem coupon")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+type CreditHandler struct {
+	db *database.DB
+}
+
+func NewCreditHandler(db *database.DB) *CreditHandler {
+	return &CreditHandler{db: db}
+}
+
+// Balance handles GET /users/{id}/balance
+func (h *CreditHandler) Balance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	userID, _ := userResource(r.URL.Path)
+	if userID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+		return
+	}
+
+	entries, err := h.db.GetCreditLedger(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// Each entry carries the balance after it, so the last one per
+	// currency is the current balance
+	balances := map[string]int64{}
+	for _, entry := range entries {
+		balances[entry.Currency] = entry.BalanceCents
+	}
+
+	response := map[string]interface{}{
+		"user_id":  userID,
+		"balances": balances,
+		"entries":  entries,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Grant handles POST /users/{id}/credit/grant
+func (h *CreditHandler) Grant(w http.ResponseWriter, r *http.Request) {
+	h.adjust(w, r, 1)
+}
+
+// Debit handles POST /users/{id}/credit/debit
+func (h *CreditHandler) Debit(w http.ResponseWriter, r *http.Request) {
+	h.adjust(w, r, -1)
+}
+
+// adjust appends a manual grant (sign 1) or debit (sign -1) to the ledger.
+// Only services may adjust credit; users can only read their balance.
+func (h *CreditHandler) adjust(w http.ResponseWriter, r *http.Request, sign int64) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !requireService(w, r) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	userID, _ := userResource(r.URL.Path)
+	if userID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+		return
+	}
+
+	var req models.CreditRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.AmountCents <= 0 {
+		writeError(w, http.StatusBadRequest, "amount_cents must be positive")
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = "USD"
+	}
+	if len(req.Currency) != 3 {
+		writeError(w, http.StatusBadRequest, "currency must be a 3-letter ISO code")
+		return
+	}
+	req.Currency = strings.ToUpper(req.Currency)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, "reason is required")
+		return
+	}
+
+	// Check if user exists
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	entry, err := h.db.AdjustCreditTx(tx, userID, sign*req.AmountCents, req.Currency, req.Reason, idempotencyKey)
+	if errors.Is(err, database.ErrInsufficientCredit) {
+		writeError(w, http.StatusConflict, "Insufficient credit")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update credit")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, entry)
+}
@@ -2,18 +2,36 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
 
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/giftcode"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/middleware"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
+)
+
+const (
+	maxGiftMessageLength    = 500
+	maxGiftSenderNameLength = 100
+	maxGiftDeliveryDelay    = 365 * 24 * time.Hour
 )
 
 type GiftHandler struct {
-	db *database.DB
+	db             *database.DB
+	provider       payments.Provider
+	redeemFailures *middleware.FailureLimiter
 }
 
-func NewGiftHandler(db *database.DB) *GiftHandler {
-	return &GiftHandler{db: db}
+func NewGiftHandler(db *database.DB, provider payments.Provider, redeemFailures *middleware.FailureLimiter) *GiftHandler {
+	return &GiftHandler{db: db, provider: provider, redeemFailures: redeemFailures}
 }
 
 // CreateGift handles POST /gift
@@ -40,6 +58,10 @@ func (h *GiftHandler) CreateGift(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authorizeUser(w, r, req.GifterID) {
+		return
+	}
+
 	if req.RecipientEmail == "" {
 		writeError(w, http.StatusBadRequest, "recipient_email is required")
 		return
@@ -49,6 +71,25 @@ func (h *GiftHandler) CreateGift(w http.ResponseWriter, r *http.Request) {
 		req.DurationMonths = 1
 	}
 
+	if req.Plan == "" {
+		req.Plan = models.DefaultPlanCode
+	}
+
+	if req.DeliverAt != nil && req.DeliverAt.After(time.Now().Add(maxGiftDeliveryDelay)) {
+		writeError(w, http.StatusBadRequest, "deliver_at must be within a year")
+		return
+	}
+
+	if utf8.RuneCountInString(req.Message) > maxGiftMessageLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("message must be at most %d characters", maxGiftMessageLength))
+		return
+	}
+
+	if utf8.RuneCountInString(req.SenderName) > maxGiftSenderNameLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("sender_name must be at most %d characters", maxGiftSenderNameLength))
+		return
+	}
+
 	// Check if gifter exists
 	gifter, err := h.db.GetUserByID(req.GifterID)
 	if err != nil {
@@ -60,6 +101,18 @@ func (h *GiftHandler) CreateGift(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reject unknown or retired plans
+	plan := requireActivePlan(w, h.db, req.Plan)
+	if plan == nil {
+		return
+	}
+
+	coupon, ok := resolveCoupon(w, h.db, req.Coupon, plan)
+	if !ok {
+		return
+	}
+	discount := billing.ApplyCoupon(coupon, billing.PlanAmount(plan, req.DurationMonths))
+
 	// Begin transaction
 	tx, err := h.db.BeginTx()
 	if err != nil {
@@ -69,14 +122,27 @@ func (h *GiftHandler) CreateGift(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// Create gift
-	gift, err := h.db.CreateGiftTx(tx, req.GifterID, req.RecipientEmail, req.DurationMonths, idempotencyKey)
+	gift, err := h.db.CreateGiftTx(tx, &req, plan, req.DurationMonths+discount.FreeMonths, discount.TotalCents, idempotencyKey)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to create gift")
 		return
 	}
 
+	draft := billing.PurchaseInvoice(req.GifterID, plan, req.DurationMonths, discount, "Gift for "+gift.RecipientEmail)
+	_, payment, ok := chargeInvoice(w, r, h.db, h.provider, tx, draft, "gift", gift.ID, idempotencyKey)
+	if !ok {
+		return
+	}
+
+	// The coupon's row lock is taken only once the charge is done
+	if !redeemCoupon(w, h.db, tx, coupon, req.GifterID, "gift", gift.ID, discount, idempotencyKey) {
+		refundCharge(h.provider, payment)
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
+		refundCharge(h.provider, payment)
 		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
 		return
 	}
@@ -103,13 +169,12 @@ func (h *GiftHandler) RedeemGift(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.GiftID <= 0 {
-		writeError(w, http.StatusBadRequest, "Valid gift_id is required")
+	if req.UserID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
 		return
 	}
 
-	if req.UserID <= 0 {
-		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+	if !authorizeUser(w, r, req.UserID) {
 		return
 	}
 
@@ -124,29 +189,73 @@ func (h *GiftHandler) RedeemGift(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Codes are guessable only by brute force, so failures are limited per
+	// user and per IP
+	clientIP := middleware.ClientIP(r)
+	failureKeys := []string{"user:" + strconv.Itoa(req.UserID), "ip:" + clientIP}
+	if h.redeemFailures.Blocked(failureKeys...) {
+		h.rejectRedemption(user, nil, clientIP, models.RejectRateLimited)
+		writeError(w, http.StatusTooManyRequests, "Too many failed redemption attempts. Try again later.")
+		return
+	}
+
+	code, ok := giftcode.Normalize(req.Code)
+	if !ok {
+		h.redeemFailures.Fail(failureKeys...)
+		h.rejectRedemption(user, nil, clientIP, models.RejectInvalidCode)
+		writeError(w, http.StatusBadRequest, "Invalid gift code")
+		return
+	}
+
 	// Check if gift exists and is pending
-	gift, err := h.db.GetGiftByID(req.GiftID)
+	gift, err := h.db.GetGiftByCode(code)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
 	if gift == nil {
+		h.redeemFailures.Fail(failureKeys...)
+		h.rejectRedemption(user, nil, clientIP, models.RejectUnknownCode)
 		writeError(w, http.StatusNotFound, "Gift not found")
 		return
 	}
+
+	// A scheduled gift stays hidden until it is delivered, so a probe for
+	// its code counts as a failure exactly like an unknown code
+	if gift.Status == models.GiftScheduled {
+		h.redeemFailures.Fail(failureKeys...)
+		h.rejectRedemption(user, gift, clientIP, models.RejectUndelivered)
+		writeError(w, http.StatusNotFound, "Gift not found")
+		return
+	}
+
+	// Only the addressed recipient may redeem a gift that is not open: the
+	// account it was attached to, or else the user with its email
+	recipient := models.NormalizeEmail(user.Email) == models.NormalizeEmail(gift.RecipientEmail)
+	if gift.RecipientID != nil {
+		recipient = *gift.RecipientID == user.ID
+	}
+	if !gift.Open && !recipient {
+		h.rejectRedemption(user, gift, clientIP, models.RejectRecipientMismatch)
+		writeError(w, http.StatusForbidden, "Gift is addressed to a different recipient")
+		return
+	}
+
 	if gift.Status != models.GiftPending {
+		h.rejectRedemption(user, gift, clientIP, models.RejectUnavailable)
 		writeError(w, http.StatusConflict, "Gift is not available for redemption")
 		return
 	}
 
-	// Check if user already has active subscription
-	existing, err := h.db.GetActiveSubscription(req.UserID)
+	// An active or paused subscription is extended by the gift; trials and
+	// subscriptions in dunning are not
+	existing, err := h.db.GetCurrentSubscription(req.UserID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
-	if existing != nil {
-		writeError(w, http.StatusConflict, "User already has an active subscription")
+	if existing != nil && existing.Status != models.StatusActive && existing.Status != models.StatusPaused {
+		writeError(w, http.StatusConflict, "Subscription cannot be extended by a gift while "+string(existing.Status))
 		return
 	}
 
@@ -159,7 +268,7 @@ func (h *GiftHandler) RedeemGift(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// Redeem gift
-	sub, redeemedGift, err := h.db.RedeemGiftTx(tx, req.GiftID, req.UserID, idempotencyKey)
+	sub, redeemedGift, err := h.db.RedeemGiftTx(tx, gift.ID, req.UserID, existing, idempotencyKey)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to redeem gift")
 		return
@@ -175,9 +284,333 @@ func (h *GiftHandler) RedeemGift(w http.ResponseWriter, r *http.Request) {
 		"subscription_id": sub.ID,
 		"gift_id":         redeemedGift.ID,
 		"status":          redeemedGift.Status,
+		"plan":            sub.PlanCode,
 		"start_date":      sub.StartDate,
 		"end_date":        sub.EndDate,
+		"extended":        existing != nil,
+		"gift":            redeemedGift,
+		"subscription":    sub,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// rejectRedemption adds a refused redemption to the audit trail. gift is
+// nil when the code matched no gift. A failure to record is logged rather
+// than returned, so the caller still gets the real reason for the refusal.
+func (h *GiftHandler) rejectRedemption(user *models.User, gift *models.Gift, clientIP string, reason models.RedemptionRejection) {
+	rejection := models.RejectedRedemption{
+		UserID:    user.ID,
+		UserEmail: &user.Email,
+		ClientIP:  clientIP,
+		Reason:    reason,
+	}
+	if gift != nil {
+		rejection.GiftID = &gift.ID
+	}
+	if err := h.db.RecordRejectedRedemption(rejection); err != nil {
+		log.Printf("Failed to record rejected redemption for user %d: %v", user.ID, err)
+	}
+}
+
+// SentGifts handles GET /users/{id}/gifts/sent
+func (h *GiftHandler) SentGifts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	userID, _ := userResource(r.URL.Path)
+	if userID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+		return
+	}
+
+	gifts, err := h.db.GetSentGifts(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id": userID,
+		"gifts":   gifts,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ReceivedGifts handles GET /gifts/received?email=
+func (h *GiftHandler) ReceivedGifts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	email := models.NormalizeEmail(r.URL.Query().Get("email"))
+	if email == "" {
+		writeError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+
+	principal := requirePrincipal(w, r)
+	if principal == nil {
+		return
+	}
+
+	// Users may only look up gifts sent to their own address
+	if principal.Kind == auth.PrincipalUser {
+		user, err := h.db.GetUserByID(principal.UserID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if user == nil || user.Email != email {
+			writeError(w, http.StatusForbidden, "Not allowed to view gifts for this email")
+			return
+		}
+	}
+
+	gifts, err := h.db.GetReceivedGifts(email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// Knowing an address is not proof of owning it, so the codes only
+	// travel in the delivery to the recipient
+	for i := range gifts {
+		gifts[i].RedemptionCode = ""
+	}
+
+	response := map[string]interface{}{
+		"email": email,
+		"gifts": gifts,
 	}
 
 	writeJSON(w, http.StatusOK, response)
 }
+
+// Gifts dispatches POST /gift/{id}/{action}
+func (h *GiftHandler) Gifts(w http.ResponseWriter, r *http.Request) {
+	_, action := idAndAction(r.URL.Path, "/gift/")
+	switch action {
+	case "revoke":
+		h.Revoke(w, r)
+	case "recipient":
+		h.ChangeRecipient(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// Revoke handles POST /gift/{id}/revoke
+func (h *GiftHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	giftID, _ := idAndAction(r.URL.Path, "/gift/")
+	if giftID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid gift id is required")
+		return
+	}
+
+	var req models.RevokeGiftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.GifterID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid gifter_id is required")
+		return
+	}
+
+	if !authorizeUser(w, r, req.GifterID) {
+		return
+	}
+
+	method, ok := revocationMethod(req.Method)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "method must be refund or credit")
+		return
+	}
+
+	gift := h.manageableGift(w, giftID, req.GifterID)
+	if gift == nil {
+		return
+	}
+
+	// Bulk gifts were paid for by their batch's invoice
+	entityType, entityID := "gift", gift.ID
+	if gift.BatchID != nil {
+		entityType, entityID = "gift_batch", *gift.BatchID
+	}
+	invoice, err := h.db.GetLastPaidInvoice(entityType, entityID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	var payment *models.Payment
+	if invoice != nil {
+		if payment, err = h.db.GetPaymentByInvoice(invoice.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+
+	refundCents, creditCents := billing.GiftRevocation(gift, invoice, method)
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Revoke gift
+	revoked, refund, credit, err := h.db.RevokeGiftTx(tx, gift.ID, refundCents, creditCents, invoice, payment, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to revoke gift")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	// The refund is committed before the provider is asked for the money,
+	// so a provider failure leaves a failed refund rather than a lost one
+	if refund != nil {
+		refund = settleRefund(h.db, h.provider, refund, payment)
+	}
+
+	response := map[string]interface{}{
+		"gift":   revoked,
+		"refund": refund,
+		"credit": credit,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ChangeRecipient handles POST /gift/{id}/recipient
+func (h *GiftHandler) ChangeRecipient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	giftID, _ := idAndAction(r.URL.Path, "/gift/")
+	if giftID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid gift id is required")
+		return
+	}
+
+	var req models.GiftRecipientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.GifterID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid gifter_id is required")
+		return
+	}
+
+	if !authorizeUser(w, r, req.GifterID) {
+		return
+	}
+
+	if models.NormalizeEmail(req.RecipientEmail) == "" {
+		writeError(w, http.StatusBadRequest, "recipient_email is required")
+		return
+	}
+
+	gift := h.manageableGift(w, giftID, req.GifterID)
+	if gift == nil {
+		return
+	}
+
+	if models.NormalizeEmail(req.RecipientEmail) == gift.RecipientEmail {
+		writeError(w, http.StatusConflict, "Gift is already addressed to recipient_email")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Change recipient
+	updated, err := h.db.ChangeGiftRecipientTx(tx, gift.ID, req.RecipientEmail, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to change gift recipient")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// revocationMethod parses a revocation method, defaulting to a refund
+func revocationMethod(method string) (billing.RevocationMethod, bool) {
+	switch m := billing.RevocationMethod(method); m {
+	case "":
+		return billing.RevokeToCard, true
+	case billing.RevokeToCard, billing.RevokeToCredit:
+		return m, true
+	default:
+		return "", false
+	}
+}
+
+// manageableGift loads a gift its gifter may still revoke or readdress:
+// one they sent that has not been redeemed, expired or revoked. It writes
+// the error response and returns nil otherwise.
+func (h *GiftHandler) manageableGift(w http.ResponseWriter, giftID, gifterID int) *models.Gift {
+	gift, err := h.db.GetGiftByID(giftID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return nil
+	}
+	if gift == nil {
+		writeError(w, http.StatusNotFound, "Gift not found")
+		return nil
+	}
+	if gift.GifterID != gifterID {
+		writeError(w, http.StatusForbidden, "Gift was sent by a different user")
+		return nil
+	}
+	if gift.Status != models.GiftScheduled && gift.Status != models.GiftPending {
+		writeError(w, http.StatusConflict, "Gift is already "+string(gift.Status))
+		return nil
+	}
+	return gift
+}
@@ -0,0 +1,488 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const (
+	maxGiftBatchSize        = 1000
+	maxGiftBatchUploadBytes = 1 << 20
+)
+
+// CreateBatch handles POST /gift/batch. Recipients come either as JSON or
+// as a CSV file uploaded in a multipart form.
+func (h *GiftHandler) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	var req *models.GiftBatchRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		var err error
+		if req, err = parseGiftBatchUpload(w, r); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		req = &models.GiftBatchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	if req.GifterID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid gifter_id is required")
+		return
+	}
+
+	if !authorizeUser(w, r, req.GifterID) {
+		return
+	}
+
+	if len(req.Recipients) == 0 {
+		writeError(w, http.StatusBadRequest, "At least one recipient is required")
+		return
+	}
+
+	if len(req.Recipients) > maxGiftBatchSize {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("A batch can have at most %d recipients", maxGiftBatchSize))
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = models.GiftBatchAtomic
+	}
+	if req.Mode != models.GiftBatchAtomic && req.Mode != models.GiftBatchPartial {
+		writeError(w, http.StatusBadRequest, "mode must be atomic or partial")
+		return
+	}
+
+	if req.DurationMonths <= 0 {
+		req.DurationMonths = 1
+	}
+
+	if req.Plan == "" {
+		req.Plan = models.DefaultPlanCode
+	}
+
+	if req.DeliverAt != nil && req.DeliverAt.After(time.Now().Add(maxGiftDeliveryDelay)) {
+		writeError(w, http.StatusBadRequest, "deliver_at must be within a year")
+		return
+	}
+
+	recipients, failed := checkBatchRecipients(req)
+
+	// An atomic batch is all or nothing; a partial one needs something to buy
+	if len(recipients) == 0 || (req.Mode == models.GiftBatchAtomic && len(failed) > 0) {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":  "Batch has invalid recipients",
+			"failed": failed,
+		})
+		return
+	}
+
+	// Check if gifter exists
+	gifter, err := h.db.GetUserByID(req.GifterID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if gifter == nil {
+		writeError(w, http.StatusNotFound, "Gifter not found")
+		return
+	}
+
+	// Reject unknown or retired plans
+	plan := requireActivePlan(w, h.db, req.Plan)
+	if plan == nil {
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Create batch
+	batch, gifts, err := h.db.CreateGiftBatchTx(tx, req, plan, recipients, billing.PlanAmount(plan, req.DurationMonths), idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create gift batch")
+		return
+	}
+
+	draft := billing.GiftBatchInvoice(req.GifterID, plan, req.DurationMonths, len(gifts))
+	invoice, payment, ok := chargeInvoice(w, r, h.db, h.provider, tx, draft, "gift_batch", batch.ID, idempotencyKey)
+	if !ok {
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		refundCharge(h.provider, payment)
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	response := map[string]interface{}{
+		"batch":   batch,
+		"gifts":   gifts,
+		"failed":  failed,
+		"invoice": invoice,
+	}
+
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// Batches dispatches /gift/batch/{id}[/{action}]
+func (h *GiftHandler) Batches(w http.ResponseWriter, r *http.Request) {
+	_, action := idAndAction(r.URL.Path, "/gift/batch/")
+	switch action {
+	case "":
+		h.GetBatch(w, r)
+	case "report":
+		h.BatchReport(w, r)
+	case "revoke":
+		h.RevokeBatch(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// GetBatch handles GET /gift/batch/{id}
+func (h *GiftHandler) GetBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	batch := h.findBatch(w, r)
+	if batch == nil {
+		return
+	}
+
+	summary, err := h.db.GetGiftBatchSummary(batch.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	gifts, err := h.db.GetGiftBatchGifts(batch.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	response := map[string]interface{}{
+		"batch":   batch,
+		"summary": summary,
+		"gifts":   gifts,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// BatchReport handles GET /gift/batch/{id}/report, a CSV file with one row
+// per gift
+func (h *GiftHandler) BatchReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	batch := h.findBatch(w, r)
+	if batch == nil {
+		return
+	}
+
+	gifts, err := h.db.GetGiftBatchGifts(batch.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gift-batch-%d.csv"`, batch.ID))
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"gift_id", "recipient_email", "redemption_code", "status", "amount_cents", "currency",
+		"deliver_at", "delivered_at", "redeemed_at", "revoked_at", "expires_at"})
+	for _, gift := range gifts {
+		out.Write([]string{
+			strconv.Itoa(gift.ID), gift.RecipientEmail, gift.RedemptionCode, string(gift.Status),
+			strconv.FormatInt(gift.AmountCents, 10), gift.Currency,
+			gift.DeliverAt.Format(time.RFC3339), formatOptionalTime(gift.DeliveredAt),
+			formatOptionalTime(gift.RedeemedAt), formatOptionalTime(gift.RevokedAt), gift.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+	out.Flush()
+}
+
+// RevokeBatch handles POST /gift/batch/{id}/revoke
+func (h *GiftHandler) RevokeBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	var req models.RevokeGiftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.GifterID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid gifter_id is required")
+		return
+	}
+
+	if !authorizeUser(w, r, req.GifterID) {
+		return
+	}
+
+	method, ok := revocationMethod(req.Method)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "method must be refund or credit")
+		return
+	}
+
+	batch := h.findBatch(w, r)
+	if batch == nil {
+		return
+	}
+	if batch.GifterID != req.GifterID {
+		writeError(w, http.StatusForbidden, "Batch was bought by a different user")
+		return
+	}
+
+	invoice, err := h.db.GetLastPaidInvoice("gift_batch", batch.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	var payment *models.Payment
+	if invoice != nil {
+		if payment, err = h.db.GetPaymentByInvoice(invoice.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Revoke every gift still outstanding
+	gifts, refunds, credits, err := h.db.RevokeGiftBatchTx(tx, batch, invoice, payment, method, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to revoke gift batch")
+		return
+	}
+	if len(gifts) == 0 {
+		writeError(w, http.StatusConflict, "Batch has no gifts left to revoke")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	// The refunds are committed before the provider is asked for the
+	// money, so a provider failure leaves failed refunds rather than lost ones
+	for i := range refunds {
+		refunds[i] = *settleRefund(h.db, h.provider, &refunds[i], payment)
+	}
+
+	response := map[string]interface{}{
+		"batch":   batch,
+		"gifts":   gifts,
+		"refunds": refunds,
+		"credits": credits,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// findBatch loads the batch named by /gift/batch/{id}. It writes the error
+// response and returns nil when there is none.
+func (h *GiftHandler) findBatch(w http.ResponseWriter, r *http.Request) *models.GiftBatch {
+	batchID, _ := idAndAction(r.URL.Path, "/gift/batch/")
+	if batchID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid batch id is required")
+		return nil
+	}
+
+	batch, err := h.db.GetGiftBatch(batchID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return nil
+	}
+	if batch == nil {
+		writeError(w, http.StatusNotFound, "Gift batch not found")
+		return nil
+	}
+	if !authorizeUser(w, r, batch.GifterID) {
+		return nil
+	}
+	return batch
+}
+
+// checkBatchRecipients normalizes a batch's recipients, filling in the
+// batch's message and sender name, and splits them into the rows that can
+// be bought and the rows that cannot
+func checkBatchRecipients(req *models.GiftBatchRequest) ([]models.GiftBatchRecipient, []models.GiftBatchRowError) {
+	valid := []models.GiftBatchRecipient{}
+	failed := []models.GiftBatchRowError{}
+	seen := make(map[string]bool)
+
+	for i, recipient := range req.Recipients {
+		recipient.Email = models.NormalizeEmail(recipient.Email)
+		if recipient.Message == "" {
+			recipient.Message = req.Message
+		}
+		if recipient.SenderName == "" {
+			recipient.SenderName = req.SenderName
+		}
+
+		var problem string
+		switch {
+		case recipient.Email == "":
+			problem = "email is required"
+		case !models.ValidEmail(recipient.Email):
+			problem = "email is not a valid address"
+		case seen[recipient.Email]:
+			problem = "email appears more than once in the batch"
+		case utf8.RuneCountInString(recipient.Message) > maxGiftMessageLength:
+			problem = fmt.Sprintf("message must be at most %d characters", maxGiftMessageLength)
+		case utf8.RuneCountInString(recipient.SenderName) > maxGiftSenderNameLength:
+			problem = fmt.Sprintf("sender_name must be at most %d characters", maxGiftSenderNameLength)
+		}
+
+		if problem != "" {
+			failed = append(failed, models.GiftBatchRowError{Row: i + 1, Email: recipient.Email, Error: problem})
+			continue
+		}
+		seen[recipient.Email] = true
+		valid = append(valid, recipient)
+	}
+	return valid, failed
+}
+
+// parseGiftBatchUpload reads a batch from a multipart form: the batch's
+// settings as form fields and its recipients as a CSV file in the "file"
+// field. The file needs a header row with an email column and may add
+// message and sender_name columns.
+func parseGiftBatchUpload(w http.ResponseWriter, r *http.Request) (*models.GiftBatchRequest, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxGiftBatchUploadBytes)
+	if err := r.ParseMultipartForm(maxGiftBatchUploadBytes); err != nil {
+		return nil, errors.New("Invalid multipart form")
+	}
+
+	req := &models.GiftBatchRequest{
+		Plan:       r.FormValue("plan"),
+		Mode:       models.GiftBatchMode(r.FormValue("mode")),
+		Open:       r.FormValue("open") == "true",
+		Message:    r.FormValue("message"),
+		SenderName: r.FormValue("sender_name"),
+	}
+	req.GifterID, _ = strconv.Atoi(r.FormValue("gifter_id"))
+	req.DurationMonths, _ = strconv.Atoi(r.FormValue("duration_months"))
+	if v := r.FormValue("deliver_at"); v != "" {
+		deliverAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("deliver_at must be an RFC 3339 time")
+		}
+		req.DeliverAt = &deliverAt
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, errors.New("file is required")
+	}
+	defer file.Close()
+
+	records := csv.NewReader(file)
+	records.FieldsPerRecord = -1
+	records.TrimLeadingSpace = true
+
+	header, err := records.Read()
+	if err != nil {
+		return nil, errors.New("file must start with a header row")
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, errors.New("file must have an email column")
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV file: %v", err)
+		}
+		req.Recipients = append(req.Recipients, models.GiftBatchRecipient{
+			Email:      field(record, "email"),
+			Message:    field(record, "message"),
+			SenderName: field(record, "sender_name"),
+		})
+	}
+	return req, nil
+}
+
+// formatOptionalTime formats t for a CSV cell, leaving it empty when nil
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+type InvoiceHandler struct {
+	db *database.DB
+}
+
+func NewInvoiceHandler(db *database.DB) *InvoiceHandler {
+	return &InvoiceHandler{db: db}
+}
+
+// GetInvoice handles GET /invoices/{id}
+func (h *InvoiceHandler) GetInvoice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	invoiceID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/invoices/"))
+	if err != nil || invoiceID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid invoice id is required")
+		return
+	}
+
+	invoice, err := h.db.GetInvoiceByID(invoiceID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if invoice == nil {
+		writeError(w, http.StatusNotFound, "Invoice not found")
+		return
+	}
+	if !authorizeUser(w, r, invoice.UserID) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, invoice)
+}
+
+// UserInvoices handles GET /users/{id}/invoices
+func (h *InvoiceHandler) UserInvoices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	userID, _ := userResource(r.URL.Path)
+	if userID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+		return
+	}
+
+	invoices, err := h.db.GetUserInvoices(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id":  userID,
+		"invoices": invoices,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// issueInvoice stores an invoice for a billable operation inside tx. It
+// writes the error response and returns nil on failure.
+func issueInvoice(w http.ResponseWriter, db *database.DB, tx *sql.Tx, draft billing.InvoiceDraft, entityType string, entityID int, idempotencyKey string) *models.Invoice {
+	invoice, err := db.CreateInvoiceTx(tx, draft, entityType, entityID, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create invoice")
+		return nil
+	}
+	return invoice
+}
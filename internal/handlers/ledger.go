@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+)
+
+type LedgerHandler struct {
+	db *database.DB
+}
+
+func NewLedgerHandler(db *database.DB) *LedgerHandler {
+	return &LedgerHandler{db: db}
+}
+
+// trialBalanceTotal is the sum of every account in one currency
+type trialBalanceTotal struct {
+	Currency    string `json:"currency"`
+	DebitCents  int64  `json:"debit_cents"`
+	CreditCents int64  `json:"credit_cents"`
+}
+
+// TrialBalance handles GET /ledger/trial-balance. Debits and credits must
+// match in every currency; if they ever differ the ledger is corrupt, and
+// the endpoint answers 500 with the figures rather than a report.
+func (h *LedgerHandler) TrialBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !requireService(w, r) {
+		return
+	}
+
+	accounts, err := h.db.GetTrialBalance()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	totals := []trialBalanceTotal{}
+	for _, row := range accounts {
+		if len(totals) == 0 || totals[len(totals)-1].Currency != row.Currency {
+			totals = append(totals, trialBalanceTotal{Currency: row.Currency})
+		}
+		total := &totals[len(totals)-1]
+		total.DebitCents += row.DebitCents
+		total.CreditCents += row.CreditCents
+	}
+
+	balanced := true
+	for _, total := range totals {
+		if total.DebitCents != total.CreditCents {
+			log.Printf("Trial balance out of balance in %s: debits %d, credits %d",
+				total.Currency, total.DebitCents, total.CreditCents)
+			balanced = false
+		}
+	}
+
+	response := map[string]interface{}{
+		"balanced": balanced,
+		"accounts": accounts,
+		"totals":   totals,
+	}
+
+	if !balanced {
+		response["error"] = "Trial balance does not balance"
+		writeJSON(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// reportMonthLayout is the YYYY-MM form of the revenue report's bounds
+const reportMonthLayout = "2006-01"
+
+// RevenueReport handles GET /revenue/report?from=YYYY-MM&to=YYYY-MM. It
+// lists revenue recognized during each month and revenue still deferred at
+// its end, defaulting to the twelve months up to and including this one.
+func (h *LedgerHandler) RevenueReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !requireService(w, r) {
+		return
+	}
+
+	now := time.Now().UTC()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, -11, 0)
+
+	if value := r.URL.Query().Get("from"); value != "" {
+		month, err := time.Parse(reportMonthLayout, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "from must be a month as YYYY-MM")
+			return
+		}
+		from = month
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		month, err := time.Parse(reportMonthLayout, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "to must be a month as YYYY-MM")
+			return
+		}
+		to = month
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	months, err := h.db.GetRevenueReport(from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from":   from.Format(reportMonthLayout),
+		"to":     to.Format(reportMonthLayout),
+		"months": months,
+	})
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
+)
+
+// chargeInvoice bills an operation for draft inside tx: the amount due is
+// drawn from the user's account credit first and the rest is charged to
+// their default payment method, and only then is the invoice numbered and
+// stored. The ordering matters: numbering locks the global invoice counter
+// until commit, so it must never be held across a provider call or every
+// billable request would queue behind the slowest charge. Invoices that
+// credit covers are marked paid without calling the provider, and yield a
+// nil payment. It writes the error response and returns false on failure;
+// the caller's deferred rollback then undoes the operation being billed,
+// including any credit drawn down, and a charge already captured is given
+// back.
+func chargeInvoice(w http.ResponseWriter, r *http.Request, db *database.DB, provider payments.Provider, tx *sql.Tx, draft billing.InvoiceDraft, entityType string, entityID int, idempotencyKey string) (*models.Invoice, *models.Payment, bool) {
+	// The balance stays locked until the operation commits, so the credit
+	// applied to the invoice below is what was left off the charge
+	var due int64
+	if _, _, total := draft.Totals(); total > 0 {
+		credit, err := db.CreditBalanceTx(tx, draft.UserID, draft.Currency)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to apply credit")
+			return nil, nil, false
+		}
+		due = total - min(credit, total)
+	}
+
+	var pm *models.PaymentMethod
+	var charge *payments.Authorization
+	if due > 0 {
+		var err error
+		if pm, err = db.GetDefaultPaymentMethod(draft.UserID); err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return nil, nil, false
+		}
+		if pm == nil {
+			writeError(w, http.StatusPaymentRequired, "Payment method required")
+			return nil, nil, false
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), payments.DefaultTimeout)
+		defer cancel()
+
+		charge, err = payments.Charge(ctx, provider, payments.ChargeRequest{
+			UserID:         draft.UserID,
+			Token:          pm.Token,
+			AmountCents:    due,
+			Currency:       draft.Currency,
+			Description:    fmt.Sprintf("Payment for %s %d", entityType, entityID),
+			IdempotencyKey: idempotencyKey,
+		})
+		if errors.Is(err, payments.ErrDeclined) {
+			writeError(w, http.StatusPaymentRequired, "Payment declined")
+			return nil, nil, false
+		}
+		if errors.Is(err, payments.ErrTimeout) {
+			writeError(w, http.StatusPaymentRequired, "Payment provider timed out")
+			return nil, nil, false
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, "Payment provider error")
+			return nil, nil, false
+		}
+	}
+
+	invoice, payment, err := recordInvoice(db, tx, draft, entityType, entityID, pm, provider, charge, idempotencyKey)
+	if err != nil {
+		if charge != nil {
+			refundCharge(provider, &models.Payment{ProviderRef: charge.ID, AmountCents: charge.AmountCents})
+		}
+		log.Printf("Failed to record invoice for %s %d: %v", entityType, entityID, err)
+		writeError(w, http.StatusInternalServerError, "Failed to record invoice")
+		return nil, nil, false
+	}
+	return invoice, payment, true
+}
+
+// recordInvoice numbers and stores the invoice for draft once it has been
+// paid for, applying the user's credit and the captured charge, if any
+func recordInvoice(db *database.DB, tx *sql.Tx, draft billing.InvoiceDraft, entityType string, entityID int, pm *models.PaymentMethod, provider payments.Provider, charge *payments.Authorization, idempotencyKey string) (*models.Invoice, *models.Payment, error) {
+	invoice, err := db.CreateInvoiceTx(tx, draft, entityType, entityID, idempotencyKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if invoice.TotalCents > 0 {
+		if _, err := db.ApplyCreditTx(tx, invoice, invoice.TotalCents); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if charge == nil {
+		return invoice, nil, db.MarkInvoicePaidTx(tx, invoice)
+	}
+	payment, err := db.RecordPaymentTx(tx, invoice, pm, provider.Name(), charge.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return invoice, payment, nil
+}
+
+// refundCharge gives back a captured charge whose operation was never
+// committed. It is a no-op for a nil payment.
+func refundCharge(provider payments.Provider, payment *models.Payment) {
+	if payment == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), payments.DefaultTimeout)
+	defer cancel()
+
+	if _, err := provider.Refund(ctx, payment.ProviderRef, payment.AmountCents); err != nil {
+		log.Printf("Failed to refund uncommitted charge %s: %v", payment.ProviderRef, err)
+	}
+}
+
+// settleRefund returns a committed refund to the card behind payment and
+// records the outcome. Refunds without a provider payment stay pending.
+func settleRefund(db *database.DB, provider payments.Provider, refund *models.Refund, payment *models.Payment) *models.Refund {
+	if payment == nil {
+		return refund
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), payments.DefaultTimeout)
+	defer cancel()
+
+	var settled *models.Refund
+	providerRef, err := provider.Refund(ctx, payment.ProviderRef, refund.AmountCents)
+	if err != nil {
+		log.Printf("Failed to refund %d against charge %s: %v", refund.ID, payment.ProviderRef, err)
+		settled, err = db.SettleRefund(refund.ID, models.RefundFailed, nil)
+	} else {
+		settled, err = db.SettleRefund(refund.ID, models.RefundCompleted, &providerRef)
+	}
+	if err != nil {
+		log.Printf("Failed to record outcome of refund %d: %v", refund.ID, err)
+		return refund
+	}
+	if settled == nil {
+		return refund
+	}
+	return settled
+}
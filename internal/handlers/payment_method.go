@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+type PaymentMethodHandler struct {
+	db *database.DB
+}
+
+func NewPaymentMethodHandler(db *database.DB) *PaymentMethodHandler {
+	return &PaymentMethodHandler{db: db}
+}
+
+// AddPaymentMethod handles POST /payment-methods
+func (h *PaymentMethodHandler) AddPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	var req models.PaymentMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.UserID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+		return
+	}
+
+	if !authorizeUser(w, r, req.UserID) {
+		return
+	}
+
+	if req.Token == "" {
+		writeError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+
+	// Check if user exists
+	user, err := h.db.GetUserByID(req.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	pm, err := h.db.AddPaymentMethodTx(tx, req.UserID, req.Token, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to add payment method")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, pm)
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+type PlanHandler struct {
+	db *database.DB
+}
+
+func NewPlanHandler(db *database.DB) *PlanHandler {
+	return &PlanHandler{db: db}
+}
+
+// Plans handles GET /plans and POST /plans
+func (h *PlanHandler) Plans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.ListPlans(w, r)
+	case http.MethodPost:
+		h.CreatePlan(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// Plan handles GET, PUT and DELETE /plans/{code}
+func (h *PlanHandler) Plan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.GetPlan(w, r)
+	case http.MethodPut:
+		h.UpdatePlan(w, r)
+	case http.MethodDelete:
+		h.RetirePlan(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// ListPlans handles GET /plans. Retired plans are included with ?all=true.
+func (h *PlanHandler) ListPlans(w http.ResponseWriter, r *http.Request) {
+	activeOnly := r.URL.Query().Get("all") != "true"
+
+	plans, err := h.db.ListPlans(activeOnly)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"plans": plans})
+}
+
+// GetPlan handles GET /plans/{code}
+func (h *PlanHandler) GetPlan(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, "/plans/")
+	if code == "" {
+		writeError(w, http.StatusBadRequest, "Plan code is required")
+		return
+	}
+
+	plan, err := h.db.GetPlanByCode(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if plan == nil {
+		writeError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// CreatePlan handles POST /plans
+func (h *PlanHandler) CreatePlan(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	var req models.PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Code == "" || req.Name == "" {
+		writeError(w, http.StatusBadRequest, "code and name are required")
+		return
+	}
+
+	if req.PriceCents != nil && *req.PriceCents < 0 {
+		writeError(w, http.StatusBadRequest, "price_cents must not be negative")
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = "USD"
+	}
+	if len(req.Currency) != 3 {
+		writeError(w, http.StatusBadRequest, "currency must be a 3-letter ISO code")
+		return
+	}
+	req.Currency = strings.ToUpper(req.Currency)
+
+	if req.TrialDays != nil && *req.TrialDays < 0 {
+		writeError(w, http.StatusBadRequest, "trial_days must not be negative")
+		return
+	}
+
+	if req.BillingInterval != models.IntervalMonth && req.BillingInterval != models.IntervalYear {
+		writeError(w, http.StatusBadRequest, "billing_interval must be 'month' or 'year'")
+		return
+	}
+
+	// Check for an existing plan with the same code
+	existing, err := h.db.GetPlanByCode(req.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing != nil {
+		writeError(w, http.StatusConflict, "Plan code already exists")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	plan, err := h.db.CreatePlanTx(tx, req, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create plan")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, plan)
+}
+
+// UpdatePlan handles PUT /plans/{code}
+func (h *PlanHandler) UpdatePlan(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	code := strings.TrimPrefix(r.URL.Path, "/plans/")
+	if code == "" {
+		writeError(w, http.StatusBadRequest, "Plan code is required")
+		return
+	}
+
+	var req models.PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.PriceCents != nil && *req.PriceCents < 0 {
+		writeError(w, http.StatusBadRequest, "price_cents must not be negative")
+		return
+	}
+
+	if req.TrialDays != nil && *req.TrialDays < 0 {
+		writeError(w, http.StatusBadRequest, "trial_days must not be negative")
+		return
+	}
+
+	if req.Currency != "" {
+		if len(req.Currency) != 3 {
+			writeError(w, http.StatusBadRequest, "currency must be a 3-letter ISO code")
+			return
+		}
+		req.Currency = strings.ToUpper(req.Currency)
+	}
+
+	existing, err := h.db.GetPlanByCode(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+	if req.BillingInterval != "" && req.BillingInterval != existing.BillingInterval {
+		writeError(w, http.StatusBadRequest, "billing_interval cannot be changed")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	plan, err := h.db.UpdatePlanTx(tx, code, req, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update plan")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// RetirePlan handles DELETE /plans/{code}
+func (h *PlanHandler) RetirePlan(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	code := strings.TrimPrefix(r.URL.Path, "/plans/")
+	if code == "" {
+		writeError(w, http.StatusBadRequest, "Plan code is required")
+		return
+	}
+
+	existing, err := h.db.GetPlanByCode(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	plan, err := h.db.RetirePlanTx(tx, code, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to retire plan")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// requireActivePlan looks up a purchasable plan by code. It writes the error
+// response and returns nil when the plan is unknown or retired.
+func requireActivePlan(w http.ResponseWriter, db *database.DB, code string) *models.Plan {
+	plan, err := db.GetPlanByCode(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return nil
+	}
+	if plan == nil {
+		writeError(w, http.StatusBadRequest, "Unknown plan")
+		return nil
+	}
+	if !plan.Active {
+		writeError(w, http.StatusConflict, "Plan is no longer available")
+		return nil
+	}
+	return plan
+}
@@ -2,20 +2,33 @@ package handlers
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
 )
 
 type SubscriptionHandler struct {
-	db *database.DB
+	db       *database.DB
+	provider payments.Provider
+	refunds  billing.RefundPolicy
 }
 
-func NewSubscriptionHandler(db *database.DB) *SubscriptionHandler {
-	return &SubscriptionHandler{db: db}
+func NewSubscriptionHandler(db *database.DB, provider payments.Provider, refunds billing.RefundPolicy) *SubscriptionHandler {
+	return &SubscriptionHandler{db: db, provider: provider, refunds: refunds}
+}
+
+// cancelResponse is a cancelled subscription together with the refund the
+// cancellation earned. Period-end cancellations carry no refund summary.
+type cancelResponse struct {
+	*models.Subscription
+	Refund *billing.RefundSummary `json:"refund,omitempty"`
 }
 
 // Subscribe handles POST /subscribe
@@ -42,10 +55,25 @@ func (h *SubscriptionHandler) Subscribe(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if !authorizeUser(w, r, req.UserID) {
+		return
+	}
+
 	if req.DurationMonths <= 0 {
 		req.DurationMonths = 1 // Default to 1 month
 	}
 
+	if req.Plan == "" {
+		req.Plan = models.DefaultPlanCode
+	}
+
+	// Paid subscriptions only renew themselves when the caller opts in. A
+	// trial exists to convert when it ends, so it does unless told not to.
+	autoRenew := req.AutoRenew != nil && *req.AutoRenew
+	if req.Trial && req.AutoRenew == nil {
+		autoRenew = true
+	}
+
 	// Check if user exists
 	user, err := h.db.GetUserByID(req.UserID)
 	if err != nil {
@@ -57,8 +85,14 @@ func (h *SubscriptionHandler) Subscribe(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Check for existing active subscription
-	existing, err := h.db.GetActiveSubscription(req.UserID)
+	// Reject unknown or retired plans
+	plan := requireActivePlan(w, h.db, req.Plan)
+	if plan == nil {
+		return
+	}
+
+	// Check for an existing active, paused or trial subscription
+	existing, err := h.db.GetCurrentSubscription(req.UserID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Database error")
 		return
@@ -68,6 +102,34 @@ func (h *SubscriptionHandler) Subscribe(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if req.Trial && req.Coupon != "" {
+		writeError(w, http.StatusBadRequest, "Coupons cannot be applied to trials")
+		return
+	}
+
+	coupon, ok := resolveCoupon(w, h.db, req.Coupon, plan)
+	if !ok {
+		return
+	}
+	discount := billing.ApplyCoupon(coupon, billing.PlanAmount(plan, req.DurationMonths))
+
+	if req.Trial {
+		if plan.TrialDays <= 0 {
+			writeError(w, http.StatusBadRequest, "Plan does not offer a trial")
+			return
+		}
+
+		used, err := h.db.HasUsedTrial(user.ID, user.Email)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if used {
+			writeError(w, http.StatusConflict, "Trial already used")
+			return
+		}
+	}
+
 	// Begin transaction
 	tx, err := h.db.BeginTx()
 	if err != nil {
@@ -76,15 +138,41 @@ func (h *SubscriptionHandler) Subscribe(w http.ResponseWriter, r *http.Request)
 	}
 	defer tx.Rollback()
 
-	// Create subscription
-	sub, err := h.db.CreateSubscriptionTx(tx, req.UserID, req.DurationMonths, idempotencyKey)
+	// Create subscription, or a pending trial that the worker converts later
+	var sub *models.Subscription
+	if req.Trial {
+		sub, err = h.db.CreateTrialSubscriptionTx(tx, user, plan, autoRenew, idempotencyKey)
+	} else {
+		sub, err = h.db.CreateSubscriptionTx(tx, req.UserID, plan.Code, req.DurationMonths+discount.FreeMonths, autoRenew, idempotencyKey)
+	}
+	// A concurrent trial for the same user or email loses the race here
+	if database.IsConstraintViolation(err, database.TrialUserConstraint, database.TrialEmailConstraint) {
+		writeError(w, http.StatusConflict, "Trial already used")
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to create subscription")
 		return
 	}
 
+	// Trials are not billable until they convert
+	var payment *models.Payment
+	if !req.Trial {
+		draft := billing.PurchaseInvoice(req.UserID, plan, req.DurationMonths, discount, "Subscription")
+		if _, payment, ok = chargeInvoice(w, r, h.db, h.provider, tx, draft, "subscription", sub.ID, idempotencyKey); !ok {
+			return
+		}
+	}
+
+	// The coupon's row lock is taken only once the charge is done
+	if !redeemCoupon(w, h.db, tx, coupon, req.UserID, "subscription", sub.ID, discount, idempotencyKey) {
+		refundCharge(h.provider, payment)
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
+		refundCharge(h.provider, payment)
 		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
 		return
 	}
@@ -130,11 +218,30 @@ func (h *SubscriptionHandler) Renew(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, "Subscription not found")
 		return
 	}
-	if existing.Status != models.StatusActive {
+	if !authorizeUser(w, r, existing.UserID) {
+		return
+	}
+	if existing.Status != models.StatusActive && existing.Status != models.StatusPastDue {
 		writeError(w, http.StatusConflict, "Subscription is not active")
 		return
 	}
 
+	// Retired plans cannot be renewed; a scheduled change renews onto the new plan
+	nextPlan := existing.PlanCode
+	if existing.PendingPlan != nil {
+		nextPlan = *existing.PendingPlan
+	}
+	plan := requireActivePlan(w, h.db, nextPlan)
+	if plan == nil {
+		return
+	}
+
+	coupon, ok := resolveCoupon(w, h.db, req.Coupon, plan)
+	if !ok {
+		return
+	}
+	discount := billing.ApplyCoupon(coupon, billing.PlanAmount(plan, req.DurationMonths))
+
 	// Begin transaction
 	tx, err := h.db.BeginTx()
 	if err != nil {
@@ -144,14 +251,27 @@ func (h *SubscriptionHandler) Renew(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// Renew subscription
-	sub, err := h.db.RenewSubscriptionTx(tx, req.SubscriptionID, req.DurationMonths, idempotencyKey)
+	sub, err := h.db.RenewSubscriptionTx(tx, req.SubscriptionID, req.DurationMonths+discount.FreeMonths, idempotencyKey)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to renew subscription")
 		return
 	}
 
+	draft := billing.PurchaseInvoice(sub.UserID, plan, req.DurationMonths, discount, "Renewal")
+	_, payment, ok := chargeInvoice(w, r, h.db, h.provider, tx, draft, "subscription", sub.ID, idempotencyKey)
+	if !ok {
+		return
+	}
+
+	// The coupon's row lock is taken only once the charge is done
+	if !redeemCoupon(w, h.db, tx, coupon, sub.UserID, "subscription", sub.ID, discount, idempotencyKey) {
+		refundCharge(h.provider, payment)
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
+		refundCharge(h.provider, payment)
 		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
 		return
 	}
@@ -193,10 +313,36 @@ func (h *SubscriptionHandler) Cancel(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, "Subscription not found")
 		return
 	}
-	if existing.Status != models.StatusActive {
+	if !authorizeUser(w, r, existing.UserID) {
+		return
+	}
+	if existing.Status == models.StatusPaused && req.CancelAtPeriodEnd {
+		writeError(w, http.StatusConflict, "Paused subscriptions can only be cancelled immediately")
+		return
+	}
+	if existing.Status == models.StatusPastDue && req.CancelAtPeriodEnd {
+		writeError(w, http.StatusConflict, "Past due subscriptions can only be cancelled immediately")
+		return
+	}
+	if existing.Status != models.StatusActive && existing.Status != models.StatusPaused && existing.Status != models.StatusPastDue {
 		writeError(w, http.StatusConflict, "Subscription is not active")
 		return
 	}
+	if req.CancelAtPeriodEnd && existing.CancelAtPeriodEnd {
+		writeError(w, http.StatusConflict, "Subscription is already scheduled to cancel")
+		return
+	}
+
+	// Immediate cancellations may give back part of the last payment
+	var summary *billing.RefundSummary
+	var invoice *models.Invoice
+	var payment *models.Payment
+	if !req.CancelAtPeriodEnd {
+		var ok bool
+		if summary, invoice, payment, ok = h.cancellationRefund(w, existing); !ok {
+			return
+		}
+	}
 
 	// Begin transaction
 	tx, err := h.db.BeginTx()
@@ -207,12 +353,293 @@ func (h *SubscriptionHandler) Cancel(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// Cancel subscription
-	sub, err := h.db.CancelSubscriptionTx(tx, req.SubscriptionID, idempotencyKey)
+	sub, err := h.db.CancelSubscriptionTx(tx, req.SubscriptionID, req.CancelAtPeriodEnd, idempotencyKey)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to cancel subscription")
 		return
 	}
 
+	// Only what the card paid goes back to it; the rest returns as credit
+	var refund *models.Refund
+	if summary != nil && summary.RefundCents > 0 {
+		refund, err = h.db.CreateCancellationRefundTx(tx, sub, *summary, invoice, payment, idempotencyKey)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to create refund")
+			return
+		}
+	}
+	if summary != nil && summary.CreditCents > 0 {
+		if _, err := h.db.CreditCancellationTx(tx, sub, *summary, idempotencyKey); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to credit refund")
+			return
+		}
+	}
+
+	// Immediate cancellations settle the subscription's deferred revenue
+	if !req.CancelAtPeriodEnd {
+		if err := h.db.PostCancellationTx(tx, sub, *summary, idempotencyKey); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to post journal entry")
+			return
+		}
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	// The refund is committed before the provider is asked for the money,
+	// so a provider failure leaves a failed refund rather than a lost one
+	if refund != nil {
+		refund = settleRefund(h.db, h.provider, refund, payment)
+		summary.RefundID, summary.Status = &refund.ID, refund.Status
+	}
+
+	writeJSON(w, http.StatusOK, cancelResponse{Subscription: sub, Refund: summary})
+}
+
+// cancellationRefund applies the refund policy to an immediate cancellation
+// of sub. It returns the summary along with the invoice being refunded and
+// its payment, either of which may be nil. It writes the error response and
+// returns false on failure.
+func (h *SubscriptionHandler) cancellationRefund(w http.ResponseWriter, sub *models.Subscription) (*billing.RefundSummary, *models.Invoice, *models.Payment, bool) {
+	plan, err := h.db.GetPlanByCode(sub.PlanCode)
+	if err != nil || plan == nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return nil, nil, nil, false
+	}
+
+	invoice, err := h.db.GetLastPaidInvoice("subscription", sub.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return nil, nil, nil, false
+	}
+
+	var payment *models.Payment
+	if invoice != nil {
+		if payment, err = h.db.GetPaymentByInvoice(invoice.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return nil, nil, nil, false
+		}
+	}
+
+	// A paused subscription's end_date is pushed back on resume, so the
+	// unused time is what was left when it was paused. A past_due
+	// subscription has not paid for the time since end_date.
+	now := time.Now()
+	paidThrough := sub.EndDate
+	if sub.Status == models.StatusPaused && sub.PausedAt != nil {
+		paidThrough = now.Add(sub.EndDate.Sub(*sub.PausedAt))
+	}
+
+	summary := billing.CancellationRefund(h.refunds, plan, invoice, now, paidThrough)
+	return &summary, invoice, payment, true
+}
+
+// UndoCancel handles POST /subscriptions/{id}/undo-cancel
+func (h *SubscriptionHandler) UndoCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	subscriptionID, _ := subscriptionAction(r.URL.Path)
+	if subscriptionID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid subscription id is required")
+		return
+	}
+
+	// Only a scheduled cancellation inside the paid period can be undone
+	existing, err := h.db.GetSubscriptionByID(subscriptionID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	if !authorizeUser(w, r, existing.UserID) {
+		return
+	}
+	if existing.Status != models.StatusActive || !existing.CancelAtPeriodEnd {
+		writeError(w, http.StatusConflict, "Subscription has no pending cancellation")
+		return
+	}
+	if !existing.EndDate.After(time.Now()) {
+		writeError(w, http.StatusConflict, "Subscription period has already ended")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Undo cancellation
+	sub, err := h.db.UndoCancelTx(tx, subscriptionID, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to undo cancellation")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// SetAutoRenew handles POST /subscriptions/{id}/auto-renew
+func (h *SubscriptionHandler) SetAutoRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	subscriptionID, _ := subscriptionAction(r.URL.Path)
+	if subscriptionID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid subscription id is required")
+		return
+	}
+
+	var req models.AutoRenewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.AutoRenew == nil {
+		writeError(w, http.StatusBadRequest, "auto_renew is required")
+		return
+	}
+
+	// Check if subscription exists and can still renew
+	existing, err := h.db.GetSubscriptionByID(subscriptionID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	if !authorizeUser(w, r, existing.UserID) {
+		return
+	}
+	switch existing.Status {
+	case models.StatusActive, models.StatusPaused, models.StatusPending, models.StatusPastDue:
+	default:
+		writeError(w, http.StatusConflict, "Subscription has ended")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Update auto-renew
+	sub, err := h.db.SetAutoRenewTx(tx, subscriptionID, *req.AutoRenew, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update auto-renew")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// Pause handles POST /subscriptions/{id}/pause
+func (h *SubscriptionHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	subscriptionID, _ := subscriptionAction(r.URL.Path)
+	if subscriptionID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid subscription id is required")
+		return
+	}
+
+	// The body is optional; an empty body pauses indefinitely
+	var req models.PauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.ResumeAt != nil && !req.ResumeAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "resume_at must be in the future")
+		return
+	}
+
+	// Check if subscription exists and is active
+	existing, err := h.db.GetSubscriptionByID(subscriptionID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	if !authorizeUser(w, r, existing.UserID) {
+		return
+	}
+	if existing.Status != models.StatusActive {
+		writeError(w, http.StatusConflict, "Subscription is not active")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Pause subscription
+	sub, err := h.db.PauseSubscriptionTx(tx, subscriptionID, req.ResumeAt, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to pause subscription")
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
@@ -222,6 +649,233 @@ func (h *SubscriptionHandler) Cancel(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, sub)
 }
 
+// Resume handles POST /subscriptions/{id}/resume
+func (h *SubscriptionHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	subscriptionID, _ := subscriptionAction(r.URL.Path)
+	if subscriptionID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid subscription id is required")
+		return
+	}
+
+	// Check if subscription exists and is paused
+	existing, err := h.db.GetSubscriptionByID(subscriptionID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	if !authorizeUser(w, r, existing.UserID) {
+		return
+	}
+	if existing.Status != models.StatusPaused {
+		writeError(w, http.StatusConflict, "Subscription is not paused")
+		return
+	}
+
+	// The user may have subscribed again while paused
+	active, err := h.db.GetActiveSubscription(existing.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if active != nil {
+		writeError(w, http.StatusConflict, "User already has an active subscription")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Resume subscription
+	sub, err := h.db.ResumeSubscriptionTx(tx, subscriptionID, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to resume subscription")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// ChangePlan handles POST /subscriptions/{id}/change-plan
+func (h *SubscriptionHandler) ChangePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	subscriptionID, _ := subscriptionAction(r.URL.Path)
+	if subscriptionID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid subscription id is required")
+		return
+	}
+
+	var req models.ChangePlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Plan == "" {
+		writeError(w, http.StatusBadRequest, "plan is required")
+		return
+	}
+
+	applyAt := billing.ApplyAt(req.ApplyAt)
+	if applyAt == "" {
+		applyAt = billing.ApplyNow
+	}
+	if applyAt != billing.ApplyNow && applyAt != billing.ApplyPeriodEnd {
+		writeError(w, http.StatusBadRequest, "apply_at must be 'now' or 'period_end'")
+		return
+	}
+
+	// Check if subscription exists and is active
+	existing, err := h.db.GetSubscriptionByID(subscriptionID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	if !authorizeUser(w, r, existing.UserID) {
+		return
+	}
+	if existing.Status != models.StatusActive {
+		writeError(w, http.StatusConflict, "Subscription is not active")
+		return
+	}
+	if existing.PlanCode == req.Plan {
+		writeError(w, http.StatusConflict, "Subscription is already on this plan")
+		return
+	}
+
+	newPlan := requireActivePlan(w, h.db, req.Plan)
+	if newPlan == nil {
+		return
+	}
+
+	oldPlan, err := h.db.GetPlanByCode(existing.PlanCode)
+	if err != nil || oldPlan == nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if oldPlan.Currency != newPlan.Currency {
+		writeError(w, http.StatusBadRequest, "Cannot change between plans in different currencies")
+		return
+	}
+
+	proration := billing.Prorate(oldPlan, newPlan, time.Now(), existing.EndDate, applyAt)
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Change plan
+	sub, err := h.db.ChangePlanTx(tx, subscriptionID, proration, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to change plan")
+		return
+	}
+
+	// Period-end changes are billed by the renewal that applies them
+	var invoice *models.Invoice
+	var payment *models.Payment
+	if applyAt == billing.ApplyNow {
+		draft := billing.PlanChangeInvoice(sub.UserID, oldPlan, newPlan, proration)
+		if _, _, total := draft.Totals(); total >= 0 {
+			// An upgrade is paid for like any purchase; a declined charge
+			// rolls the change back
+			var ok bool
+			if invoice, payment, ok = chargeInvoice(w, r, h.db, h.provider, tx, draft, "subscription", sub.ID, idempotencyKey); !ok {
+				return
+			}
+		} else {
+			// A downgrade leaves the user owed money, which goes to their balance
+			if invoice = issueInvoice(w, h.db, tx, draft, "subscription", sub.ID, idempotencyKey); invoice == nil {
+				return
+			}
+			if _, err := h.db.CreditInvoiceTx(tx, invoice); err != nil {
+				writeError(w, http.StatusInternalServerError, "Failed to credit balance")
+				return
+			}
+		}
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		refundCharge(h.provider, payment)
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	response := map[string]interface{}{
+		"subscription": sub,
+		"proration":    proration,
+		"invoice":      invoice,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Subscriptions dispatches everything under /subscriptions/. Action routes
+// take a subscription id; the bare path takes a user id.
+func (h *SubscriptionHandler) Subscriptions(w http.ResponseWriter, r *http.Request) {
+	_, action := subscriptionAction(r.URL.Path)
+	switch action {
+	case "":
+		h.GetUserSubscriptions(w, r)
+	case "change-plan":
+		h.ChangePlan(w, r)
+	case "undo-cancel":
+		h.UndoCancel(w, r)
+	case "auto-renew":
+		h.SetAutoRenew(w, r)
+	case "pause":
+		h.Pause(w, r)
+	case "resume":
+		h.Resume(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
 // GetUserSubscriptions handles GET /subscriptions/{user_id}
 func (h *SubscriptionHandler) GetUserSubscriptions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -237,6 +891,10 @@ func (h *SubscriptionHandler) GetUserSubscriptions(w http.ResponseWriter, r *htt
 		return
 	}
 
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
 	// Get subscriptions
 	subs, err := h.db.GetUserSubscriptions(userID)
 	if err != nil {
@@ -253,6 +911,26 @@ func (h *SubscriptionHandler) GetUserSubscriptions(w http.ResponseWriter, r *htt
 }
 
 // Helper functions
+
+// idAndAction splits {prefix}{id}/{action} into its parts. The id is zero
+// when it is missing or not a number.
+func idAndAction(path, prefix string) (int, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		id = 0
+	}
+	if len(parts) < 2 {
+		return id, ""
+	}
+	return id, parts[1]
+}
+
+// subscriptionAction splits /subscriptions/{id}/{action} into its parts
+func subscriptionAction(path string) (int, string) {
+	return idAndAction(path, "/subscriptions/")
+}
+
 func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
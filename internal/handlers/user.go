@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const maxEmailLength = 255
+
+type UserHandler struct {
+	db     *database.DB
+	claims billing.GiftClaimPolicy
+}
+
+func NewUserHandler(db *database.DB, claims billing.GiftClaimPolicy) *UserHandler {
+	return &UserHandler{db: db, claims: claims}
+}
+
+// userResponse is a user together with the gifts claimed for their new
+// email. Requests that did not change the email carry no claims.
+type userResponse struct {
+	*models.User
+	Gifts *models.GiftClaims `json:"gifts,omitempty"`
+}
+
+// Users dispatches /users
+func (h *UserHandler) Users(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.CreateUser(w, r)
+	case http.MethodGet:
+		h.FindUser(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// User dispatches /users/{id}
+func (h *UserHandler) User(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.GetUser(w, r)
+	case http.MethodPatch:
+		h.UpdateUser(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// CreateUser handles POST /users. Users are signed up by services, which
+// then issue the user's tokens.
+func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	var req models.UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	email, ok := checkEmail(w, req.Email)
+	if !ok {
+		return
+	}
+
+	// Check if the email is taken
+	existing, err := h.db.GetUserByEmail(email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing != nil {
+		writeError(w, http.StatusConflict, "Email is already in use")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Create user
+	user, err := h.db.CreateUserTx(tx, email, idempotencyKey)
+	if database.IsUniqueViolation(err) {
+		writeError(w, http.StatusConflict, "Email is already in use")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+
+	claims, err := h.db.ClaimGiftsTx(tx, user, nil, h.claims, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to claim gifts")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, userResponse{User: user, Gifts: claims})
+}
+
+// FindUser handles GET /users?email=
+func (h *UserHandler) FindUser(w http.ResponseWriter, r *http.Request) {
+	if !requireService(w, r) {
+		return
+	}
+
+	email := models.NormalizeEmail(r.URL.Query().Get("email"))
+	if email == "" {
+		writeError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+
+	user, err := h.db.GetUserByEmail(email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// GetUser handles GET /users/{id}
+func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	user := h.findUser(w, r)
+	if user == nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// UpdateUser handles PATCH /users/{id}. The email is the only field a user
+// can change.
+func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "Idempotency-Key header is required")
+		return
+	}
+
+	var req models.UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	email, ok := checkEmail(w, req.Email)
+	if !ok {
+		return
+	}
+
+	user := h.findUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// Nothing to change
+	if email == models.NormalizeEmail(user.Email) {
+		writeJSON(w, http.StatusOK, userResponse{User: user})
+		return
+	}
+
+	// Check if the email is taken
+	existing, err := h.db.GetUserByEmail(email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if existing != nil {
+		writeError(w, http.StatusConflict, "Email is already in use")
+		return
+	}
+
+	// Gifts claimed for the new email may be redeemed onto the user's
+	// current subscription
+	sub, err := h.db.GetCurrentSubscription(user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// Begin transaction
+	tx, err := h.db.BeginTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Change email
+	updated, err := h.db.ChangeUserEmailTx(tx, user.ID, email, idempotencyKey)
+	if database.IsUniqueViolation(err) {
+		writeError(w, http.StatusConflict, "Email is already in use")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+
+	claims, err := h.db.ClaimGiftsTx(tx, updated, sub, h.claims, idempotencyKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to claim gifts")
+		return
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, userResponse{User: updated, Gifts: claims})
+}
+
+// findUser loads the user named by /users/{id}. It writes the error
+// response and returns nil when there is none.
+func (h *UserHandler) findUser(w http.ResponseWriter, r *http.Request) *models.User {
+	userID, _ := userResource(r.URL.Path)
+	if userID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+		return nil
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return nil
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "User not found")
+		return nil
+	}
+	return user
+}
+
+// checkEmail normalizes and validates an email from a request body. It
+// writes the error response and returns false when it is unusable.
+func checkEmail(w http.ResponseWriter, email string) (string, bool) {
+	email = models.NormalizeEmail(email)
+	if email == "" {
+		writeError(w, http.StatusBadRequest, "email is required")
+		return "", false
+	}
+	if utf8.RuneCountInString(email) > maxEmailLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("email must be at most %d characters", maxEmailLength))
+		return "", false
+	}
+	if !models.ValidEmail(email) {
+		writeError(w, http.StatusBadRequest, "email is not a valid address")
+		return "", false
+	}
+	return email, true
+}
+
+// PendingGifts handles GET /users/{id}/pending-gifts
+func (h *UserHandler) PendingGifts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	userID, _ := userResource(r.URL.Path)
+	if userID <= 0 {
+		writeError(w, http.StatusBadRequest, "Valid user_id is required")
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	gifts, err := h.db.GetPendingGifts(user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id":      user.ID,
+		"email":        user.Email,
+		"claim_policy": h.claims,
+		"gifts":        gifts,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// UserRouter dispatches /users/{id}/{resource} to the handler that owns
+// each resource, once the caller is known to be allowed to act for the user
+type UserRouter struct {
+	routes map[string]http.HandlerFunc
+}
+
+func NewUserRouter() *UserRouter {
+	return &UserRouter{routes: make(map[string]http.HandlerFunc)}
+}
+
+// Handle registers the handler for /users/{id}/{resource}
+func (u *UserRouter) Handle(resource string, handler http.HandlerFunc) {
+	u.routes[resource] = handler
+}
+
+func (u *UserRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, resource := userResource(r.URL.Path)
+	handler, ok := u.routes[resource]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+	handler(w, r)
+}
+
+// userResource splits /users/{id}/{resource} into its parts
+func userResource(path string) (int, string) {
+	return idAndAction(path, "/users/")
+}
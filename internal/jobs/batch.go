@@ -0,0 +1,53 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+)
+
+// batchStep claims and processes up to limit rows inside tx and returns the
+// IDs it handled.
+type batchStep func(tx *sql.Tx, limit int) ([]int, error)
+
+// batchJob runs a step in its own transaction, batch after batch, until a
+// batch comes back short. Each step must claim rows with SKIP LOCKED so
+// replicas can share the work.
+type batchJob struct {
+	name      string
+	db        *database.DB
+	batchSize int
+	step      batchStep
+}
+
+func (j *batchJob) Name() string {
+	return j.name
+}
+
+func (j *batchJob) Run(ctx context.Context) (int, error) {
+	total := 0
+	for ctx.Err() == nil {
+		tx, err := j.db.BeginTx()
+		if err != nil {
+			return total, fmt.Errorf("failed to start transaction: %w", err)
+		}
+
+		ids, err := j.step(tx, j.batchSize)
+		if err != nil {
+			tx.Rollback()
+			return total, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return total, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+
+		total += len(ids)
+		if len(ids) < j.batchSize {
+			break
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+)
+
+// NewSubscriptionExpiry returns a job that moves active subscriptions past
+// their end_date to expired.
+func NewSubscriptionExpiry(db *database.DB, batchSize int) Job {
+	return &batchJob{
+		name:      "subscription-expiry",
+		db:        db,
+		batchSize: batchSize,
+		step:      db.ExpireSubscriptionsTx,
+	}
+}
+
+// NewGiftExpiry returns a job that expires unredeemed gifts past expires_at
+// and queues a refund to each gifter.
+func NewGiftExpiry(db *database.DB, batchSize int) Job {
+	return &batchJob{
+		name:      "gift-expiry",
+		db:        db,
+		batchSize: batchSize,
+		step:      db.ExpireGiftsTx,
+	}
+}
+
+// NewGiftDelivery returns a job that delivers scheduled gifts whose
+// deliver_at has passed and emits a gift.delivered event for each.
+func NewGiftDelivery(db *database.DB, batchSize int) Job {
+	return &batchJob{
+		name:      "gift-delivery",
+		db:        db,
+		batchSize: batchSize,
+		step:      db.DeliverGiftsTx,
+	}
+}
+
+// NewAutoResume returns a job that resumes paused subscriptions whose
+// resume_at has passed.
+func NewAutoResume(db *database.DB, batchSize int) Job {
+	return &batchJob{
+		name:      "subscription-auto-resume",
+		db:        db,
+		batchSize: batchSize,
+		step:      db.ResumeDueSubscriptionsTx,
+	}
+}
+
+// NewTrialEnd returns a job that expires finished trials without a payment
+// method on file. The renewal charge job converts the rest.
+func NewTrialEnd(db *database.DB, batchSize int) Job {
+	return &batchJob{
+		name:      "trial-end",
+		db:        db,
+		batchSize: batchSize,
+		step:      db.EndTrialsTx,
+	}
+}
+
+// NewRevenueRecognition returns a job that recognizes the revenue earned
+// on active revenue schedules through the start of the current day.
+func NewRevenueRecognition(db *database.DB, batchSize int) Job {
+	return &batchJob{
+		name:      "revenue-recognition",
+		db:        db,
+		batchSize: batchSize,
+		step:      db.RecognizeRevenueTx,
+	}
+}
@@ -0,0 +1,245 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
+)
+
+// renewalJob charges subscriptions whose automatic renewal is due. Each
+// subscription is handled in its own transaction, so a provider call holds
+// only one row lock and a failed commit refunds only its own charge.
+type renewalJob struct {
+	db       *database.DB
+	provider payments.Provider
+	schedule billing.RetrySchedule
+	lead     time.Duration
+}
+
+// NewRenewalCharge returns a job that charges one billing interval for
+// auto-renewing subscriptions whose end_date is within lead, for finished
+// trials, and for past_due subscriptions due a retry. A successful charge
+// renews the subscription; a failed one moves it to past_due with the next
+// retry taken from schedule, or to unpaid once the schedule is exhausted.
+// A charge that fails ahead of end_date leaves the paid period alone: the
+// subscription stays active and is charged again at end_date.
+func NewRenewalCharge(db *database.DB, provider payments.Provider, schedule billing.RetrySchedule, lead time.Duration) Job {
+	return &renewalJob{db: db, provider: provider, schedule: schedule, lead: lead}
+}
+
+func (j *renewalJob) Name() string {
+	return "renewal-charge"
+}
+
+func (j *renewalJob) Run(ctx context.Context) (int, error) {
+	total := 0
+	for ctx.Err() == nil {
+		claimed, err := j.runOne(ctx)
+		if err != nil {
+			return total, err
+		}
+		if !claimed {
+			break
+		}
+		total++
+	}
+	return total, nil
+}
+
+// runOne claims and charges a single due subscription. It reports false
+// when nothing is due.
+func (j *renewalJob) runOne(ctx context.Context) (bool, error) {
+	tx, err := j.db.BeginTx()
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	sub, err := j.db.ClaimDueRenewalTx(tx, j.lead)
+	if err != nil || sub == nil {
+		return false, err
+	}
+
+	payment, err := j.charge(ctx, tx, sub)
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		if payment != nil {
+			j.refund(payment.ProviderRef, payment.AmountCents)
+		}
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// charge bills one interval of the subscription's next plan and renews it,
+// or records the failure and advances dunning. The period being paid for
+// starts at end_date, so retries keep the same due date and the renewal
+// key, derived from the subscription and that date, can only ever be
+// applied once.
+func (j *renewalJob) charge(ctx context.Context, tx *sql.Tx, sub *models.Subscription) (*models.Payment, error) {
+	dueAt := sub.EndDate
+	attempt := billing.PaymentAttempt{Attempt: sub.PaymentAttempts + 1, DueAt: dueAt}
+	attemptKey := fmt.Sprintf("payment_attempt:subscription:%d:%d:%d", sub.ID, dueAt.Unix(), attempt.Attempt)
+
+	// The first attempt in the lead window comes before anything is owed,
+	// so it does not count towards dunning
+	early := sub.Status == models.StatusActive && sub.NextPaymentAt == nil && time.Now().Before(dueAt)
+	if early {
+		attemptKey = fmt.Sprintf("payment_attempt:subscription:%d:%d:early", sub.ID, dueAt.Unix())
+	}
+
+	planCode := sub.PlanCode
+	if sub.PendingPlan != nil {
+		planCode = *sub.PendingPlan
+	}
+	plan, err := j.db.GetPlanByCode(planCode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retired plans cannot be renewed, so there is nothing to retry. An
+	// active subscription keeps its paid period and expires at end_date.
+	if plan == nil || !plan.Active {
+		attempt.Result = billing.AttemptPlanRetired
+		if sub.Status != models.StatusActive {
+			return nil, j.fail(tx, sub, attempt, attemptKey, models.StatusExpired, nil)
+		}
+		if _, err := j.db.SetAutoRenewTx(tx, sub.ID, false, "auto_renew_off:"+attemptKey); err != nil {
+			return nil, err
+		}
+		attempt.Status = string(models.StatusActive)
+		return nil, j.db.RecordPaymentAttemptTx(tx, sub.ID, attempt, attemptKey)
+	}
+
+	months := plan.IntervalMonths()
+	draft := billing.PurchaseInvoice(sub.UserID, plan, months, billing.ApplyCoupon(nil, billing.PlanAmount(plan, months)), "Renewal")
+	_, _, total := draft.Totals()
+	attempt.AmountCents, attempt.Currency = total, plan.Currency
+
+	// Account credit is drawn down first; only the rest goes to the card.
+	// The balance stays locked until the renewal commits.
+	credit, err := j.db.CreditBalanceTx(tx, sub.UserID, plan.Currency)
+	if err != nil {
+		return nil, err
+	}
+	due := total - min(credit, total)
+
+	pm, err := j.db.GetDefaultPaymentMethod(sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth *payments.Authorization
+	switch {
+	case due <= 0:
+	case pm == nil:
+		attempt.Result = billing.AttemptNoPaymentMethod
+	default:
+		auth, err = payments.Charge(ctx, j.provider, payments.ChargeRequest{
+			UserID:         sub.UserID,
+			Token:          pm.Token,
+			AmountCents:    due,
+			Currency:       plan.Currency,
+			Description:    fmt.Sprintf("Renewal of subscription %d", sub.ID),
+			IdempotencyKey: attemptKey,
+		})
+		switch {
+		case err == nil:
+		case errors.Is(err, payments.ErrDeclined):
+			attempt.Result = billing.AttemptDeclined
+		case errors.Is(err, payments.ErrTimeout):
+			attempt.Result = billing.AttemptTimeout
+		default:
+			attempt.Result = billing.AttemptError
+		}
+	}
+
+	if attempt.Result != "" {
+		if early {
+			attempt.Attempt = sub.PaymentAttempts
+			return nil, j.fail(tx, sub, attempt, attemptKey, models.StatusActive, &dueAt)
+		}
+		next, ok := j.schedule.NextAttempt(dueAt, attempt.Attempt)
+		if !ok {
+			return nil, j.fail(tx, sub, attempt, attemptKey, models.StatusUnpaid, nil)
+		}
+		return nil, j.fail(tx, sub, attempt, attemptKey, models.StatusPastDue, &next)
+	}
+
+	payment, err := j.renew(tx, sub, months, draft, pm, auth, dueAt)
+	if err != nil {
+		if auth != nil {
+			j.refund(auth.ID, auth.AmountCents)
+		}
+		return nil, err
+	}
+
+	attempt.Result, attempt.Status = billing.AttemptSucceeded, string(models.StatusActive)
+	if err := j.db.RecordPaymentAttemptTx(tx, sub.ID, attempt, attemptKey); err != nil {
+		if auth != nil {
+			j.refund(auth.ID, auth.AmountCents)
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+// renew extends the subscription through the same path as a manual renewal
+// and stores the invoice and payment for it
+func (j *renewalJob) renew(tx *sql.Tx, sub *models.Subscription, months int, draft billing.InvoiceDraft, pm *models.PaymentMethod, auth *payments.Authorization, dueAt time.Time) (*models.Payment, error) {
+	renewKey := RenewalKey(sub.ID, dueAt)
+	if _, err := j.db.RenewSubscriptionTx(tx, sub.ID, months, renewKey); err != nil {
+		return nil, err
+	}
+
+	invoice, err := j.db.CreateInvoiceTx(tx, draft, "subscription", sub.ID, renewKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := j.db.ApplyCreditTx(tx, invoice, invoice.TotalCents); err != nil {
+		return nil, err
+	}
+
+	if auth == nil {
+		return nil, j.db.MarkInvoicePaidTx(tx, invoice)
+	}
+	return j.db.RecordPaymentTx(tx, invoice, pm, j.provider.Name(), auth.ID)
+}
+
+// fail moves the subscription to status, with its next attempt at next,
+// and records the failed attempt
+func (j *renewalJob) fail(tx *sql.Tx, sub *models.Subscription, attempt billing.PaymentAttempt, attemptKey string, status models.SubscriptionStatus, next *time.Time) error {
+	if _, err := j.db.UpdateDunningTx(tx, sub.ID, status, attempt.Attempt, next); err != nil {
+		return err
+	}
+
+	attempt.Status, attempt.NextAttemptAt = string(status), next
+	return j.db.RecordPaymentAttemptTx(tx, sub.ID, attempt, attemptKey)
+}
+
+// refund gives back a charge whose renewal was never committed
+func (j *renewalJob) refund(authorizationID string, amount int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), payments.DefaultTimeout)
+	defer cancel()
+
+	if _, err := j.provider.Refund(ctx, authorizationID, amount); err != nil {
+		log.Printf("Failed to refund uncommitted charge %s: %v", authorizationID, err)
+	}
+}
+
+// RenewalKey is the idempotency key for the automatic renewal of a
+// subscription's period ending at periodEnd
+func RenewalKey(subscriptionID int, periodEnd time.Time) string {
+	return fmt.Sprintf("renew:subscription:%d:%d", subscriptionID, periodEnd.Unix())
+}
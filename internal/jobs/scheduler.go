@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Job is a unit of periodic background work. Run returns how many entities
+// it processed so the scheduler can log progress.
+type Job interface {
+	Name() string
+	Run(ctx context.Context) (int, error)
+}
+
+// Scheduler runs a set of jobs on a fixed interval. Jobs must be safe to run
+// concurrently on several replicas; the scheduler does no leader election.
+type Scheduler struct {
+	interval time.Duration
+	jobs     []Job
+}
+
+func NewScheduler(interval time.Duration, jobs ...Job) *Scheduler {
+	return &Scheduler{interval: interval, jobs: jobs}
+}
+
+// Start runs every job once immediately and then on each tick until ctx is
+// cancelled. It blocks until shutdown.
+func (s *Scheduler) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.runAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) runAll(ctx context.Context) {
+	for _, job := range s.jobs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		start := time.Now()
+		count, err := job.Run(ctx)
+		if err != nil {
+			log.Printf("Job %s failed after %d items: %v", job.Name(), count, err)
+			continue
+		}
+		if count > 0 {
+			log.Printf("Job %s processed %d items in %v", job.Name(), count, time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyStore looks up API keys by hash
+type APIKeyStore interface {
+	GetAPIKeyByHash(hash string) (*models.APIKey, error)
+}
+
+// Authenticate rejects requests without valid credentials and puts the
+// caller's auth.Principal on the request context. Server-to-server callers
+// send an API key in the X-API-Key header; end users send a JWT signed by
+// one of keys as a bearer token, with their user ID as its subject. With
+// no key set configured, only API keys are accepted.
+func Authenticate(keys *auth.KeySet, apiKeys APIKeyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var principal *auth.Principal
+
+			if key := r.Header.Get(APIKeyHeader); key != "" {
+				apiKey, err := apiKeys.GetAPIKeyByHash(auth.HashAPIKey(key))
+				if err != nil {
+					log.Printf("Failed to look up API key: %v", err)
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(`{"error":"Database error"}`))
+					return
+				}
+				if apiKey == nil || apiKey.RevokedAt != nil {
+					unauthorized(w, "Invalid API key")
+					return
+				}
+				principal = &auth.Principal{Kind: auth.PrincipalService, APIKeyID: apiKey.ID, Name: apiKey.Name}
+			} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && keys != nil {
+				claims, err := keys.Verify(strings.TrimSpace(token), time.Now())
+				if err != nil {
+					unauthorized(w, "Invalid token: "+err.Error())
+					return
+				}
+				userID, err := strconv.Atoi(claims.Subject)
+				if err != nil || userID <= 0 {
+					unauthorized(w, "Invalid token: subject is not a user ID")
+					return
+				}
+				principal = &auth.Principal{Kind: auth.PrincipalUser, UserID: userID}
+			} else {
+				unauthorized(w, "Authentication required")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	body, _ := json.Marshal(map[string]string{"error": message})
+	w.Write(body)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/cache"
 )
 
@@ -47,8 +48,9 @@ func (r *responseRecorder) Write(b []byte) (int, error) {
 func Idempotency(redisClient *cache.Redis) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Only apply to POST, PUT, DELETE
-			if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			// Only apply to POST, PUT, PATCH, DELETE
+			if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch &&
+				r.Method != http.MethodDelete {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -59,7 +61,12 @@ func Idempotency(redisClient *cache.Redis) func(http.Handler) http.Handler {
 				return
 			}
 
+			// Keys are scoped to the caller, so one caller cannot replay
+			// another's response by reusing its key
 			cacheKey := "idempotency:" + idempotencyKey
+			if principal := auth.FromContext(r.Context()); principal != nil {
+				cacheKey = "idempotency:" + principal.ID() + ":" + idempotencyKey
+			}
 
 			// Check if we have a cached response
 			cached, err := redisClient.Get(cacheKey)
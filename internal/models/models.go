@@ -1,6 +1,23 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// NormalizeEmail lowercases and trims an email address for comparison
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ValidEmail reports whether a normalized email is a bare address, with no
+// display name or angle brackets
+func ValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
 
 // User represents a user in the system
 type User struct {
@@ -10,6 +27,50 @@ type User struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// APIKey identifies a server-to-server caller. Only the key's hash is
+// stored; Prefix is kept to tell keys apart.
+type APIKey struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	KeyHash   string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// BillingInterval represents how often a plan is billed
+type BillingInterval string
+
+const (
+	IntervalMonth BillingInterval = "month"
+	IntervalYear  BillingInterval = "year"
+)
+
+// DefaultPlanCode is used when a request does not name a plan
+const DefaultPlanCode = "monthly"
+
+// Plan represents a purchasable plan in the catalog
+type Plan struct {
+	ID              int             `json:"id"`
+	Code            string          `json:"code"`
+	Name            string          `json:"name"`
+	PriceCents      int64           `json:"price_cents"`
+	Currency        string          `json:"currency"`
+	BillingInterval BillingInterval `json:"billing_interval"`
+	TrialDays       int             `json:"trial_days"`
+	Active          bool            `json:"active"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// IntervalMonths returns the length of one billing interval in months
+func (p *Plan) IntervalMonths() int {
+	if p.BillingInterval == IntervalYear {
+		return 12
+	}
+	return 1
+}
+
 // SubscriptionStatus represents valid subscription states
 type SubscriptionStatus string
 
@@ -18,27 +79,41 @@ const (
 	StatusCancelled SubscriptionStatus = "cancelled"
 	StatusExpired   SubscriptionStatus = "expired"
 	StatusPending   SubscriptionStatus = "pending"
+	StatusPaused    SubscriptionStatus = "paused"
+	StatusPastDue   SubscriptionStatus = "past_due"
+	StatusUnpaid    SubscriptionStatus = "unpaid"
 )
 
 // Subscription represents a user subscription
 type Subscription struct {
-	ID          int                `json:"id"`
-	UserID      int                `json:"user_id"`
-	Status      SubscriptionStatus `json:"status"`
-	StartDate   time.Time          `json:"start_date"`
-	EndDate     time.Time          `json:"end_date"`
-	CancelledAt *time.Time         `json:"cancelled_at,omitempty"`
-	CreatedAt   time.Time          `json:"created_at"`
-	UpdatedAt   time.Time          `json:"updated_at"`
+	ID                int                `json:"id"`
+	UserID            int                `json:"user_id"`
+	PlanCode          string             `json:"plan"`
+	PendingPlan       *string            `json:"pending_plan,omitempty"`
+	Status            SubscriptionStatus `json:"status"`
+	StartDate         time.Time          `json:"start_date"`
+	EndDate           time.Time          `json:"end_date"`
+	CancelledAt       *time.Time         `json:"cancelled_at,omitempty"`
+	CancelAtPeriodEnd bool               `json:"cancel_at_period_end"`
+	AutoRenew         bool               `json:"auto_renew"`
+	PausedAt          *time.Time         `json:"paused_at,omitempty"`
+	ResumeAt          *time.Time         `json:"resume_at,omitempty"`
+	TrialEnd          *time.Time         `json:"trial_end,omitempty"`
+	PaymentAttempts   int                `json:"payment_attempts"`
+	NextPaymentAt     *time.Time         `json:"next_payment_attempt_at,omitempty"`
+	CreatedAt         time.Time          `json:"created_at"`
+	UpdatedAt         time.Time          `json:"updated_at"`
 }
 
 // GiftStatus represents valid gift states
 type GiftStatus string
 
 const (
-	GiftPending  GiftStatus = "pending"
-	GiftRedeemed GiftStatus = "redeemed"
-	GiftExpired  GiftStatus = "expired"
+	GiftScheduled GiftStatus = "scheduled"
+	GiftPending   GiftStatus = "pending"
+	GiftRedeemed  GiftStatus = "redeemed"
+	GiftExpired   GiftStatus = "expired"
+	GiftRevoked   GiftStatus = "revoked"
 )
 
 // Gift represents a subscription gift
@@ -47,13 +122,335 @@ type Gift struct {
 	GifterID       int        `json:"gifter_id"`
 	RecipientEmail string     `json:"recipient_email"`
 	RecipientID    *int       `json:"recipient_id,omitempty"`
+	RedemptionCode string     `json:"redemption_code,omitempty"`
+	Open           bool       `json:"open"`
+	PlanCode       string     `json:"plan"`
 	Status         GiftStatus `json:"status"`
 	DurationMonths int        `json:"duration_months"`
+	AmountCents    int64      `json:"amount_cents"`
+	Currency       string     `json:"currency"`
+	Message        *string    `json:"message,omitempty"`
+	SenderName     *string    `json:"sender_name,omitempty"`
+	DeliverAt      time.Time  `json:"deliver_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
 	RedeemedAt     *time.Time `json:"redeemed_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
 	ExpiresAt      time.Time  `json:"expires_at"`
+	BatchID        *int       `json:"batch_id,omitempty"`
 	CreatedAt      time.Time  `json:"created_at"`
 }
 
+// GiftClaims are the gifts claimed for a user when they sign up or change
+// their email. Subscription is the one the redeemed gifts were applied to.
+type GiftClaims struct {
+	Attached     []Gift        `json:"attached"`
+	Redeemed     []Gift        `json:"redeemed"`
+	Subscription *Subscription `json:"subscription,omitempty"`
+}
+
+// GiftBatchMode decides what a bulk gift purchase does with invalid rows
+type GiftBatchMode string
+
+const (
+	// GiftBatchAtomic creates nothing unless every row is valid
+	GiftBatchAtomic GiftBatchMode = "atomic"
+	// GiftBatchPartial creates the valid rows and reports the rest
+	GiftBatchPartial GiftBatchMode = "partial"
+)
+
+// GiftBatch is a bulk gift purchase: one order, invoice and charge for the
+// gifts it created
+type GiftBatch struct {
+	ID             int           `json:"id"`
+	GifterID       int           `json:"gifter_id"`
+	PlanCode       string        `json:"plan"`
+	DurationMonths int           `json:"duration_months"`
+	Mode           GiftBatchMode `json:"mode"`
+	RequestedCount int           `json:"requested_count"`
+	CreatedCount   int           `json:"created_count"`
+	AmountCents    int64         `json:"amount_cents"`
+	Currency       string        `json:"currency"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+// GiftBatchStatusCount is how many of a batch's gifts are in a status, and
+// what they were bought for
+type GiftBatchStatusCount struct {
+	Status      GiftStatus `json:"status"`
+	Count       int        `json:"count"`
+	AmountCents int64      `json:"amount_cents"`
+}
+
+// GiftBatchRowError is a recipient row a bulk gift purchase refused. Row
+// is its 1-based position in the request or CSV file.
+type GiftBatchRowError struct {
+	Row   int    `json:"row"`
+	Email string `json:"email"`
+	Error string `json:"error"`
+}
+
+// RedemptionRejection is why a gift redemption attempt was refused
+type RedemptionRejection string
+
+const (
+	RejectRateLimited       RedemptionRejection = "rate_limited"
+	RejectInvalidCode       RedemptionRejection = "invalid_code"
+	RejectUnknownCode       RedemptionRejection = "unknown_code"
+	RejectRecipientMismatch RedemptionRejection = "recipient_mismatch"
+	RejectUnavailable       RedemptionRejection = "unavailable"
+	RejectUndelivered       RedemptionRejection = "undelivered"
+)
+
+// RejectedRedemption is an entry in the audit trail of refused gift
+// redemptions. GiftID is set when the code matched a gift.
+type RejectedRedemption struct {
+	ID        int                 `json:"id"`
+	GiftID    *int                `json:"gift_id,omitempty"`
+	UserID    int                 `json:"user_id"`
+	UserEmail *string             `json:"user_email,omitempty"`
+	ClientIP  string              `json:"client_ip"`
+	Reason    RedemptionRejection `json:"reason"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// Event types written to the events outbox
+const (
+	EventGiftDelivered = "gift.delivered"
+)
+
+// Event is a domain event in the outbox, written in the same transaction
+// as the change it describes
+type Event struct {
+	ID            int             `json:"id"`
+	Type          string          `json:"type"`
+	EntityType    string          `json:"entity_type"`
+	EntityID      int             `json:"entity_id"`
+	Payload       json.RawMessage `json:"payload"`
+	TransactionID *int            `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// RefundStatus represents valid refund states
+type RefundStatus string
+
+const (
+	RefundPending   RefundStatus = "pending"
+	RefundCompleted RefundStatus = "completed"
+	RefundFailed    RefundStatus = "failed"
+)
+
+// Refund represents money owed back to a customer
+type Refund struct {
+	ID            int          `json:"id"`
+	UserID        int          `json:"user_id"`
+	EntityType    string       `json:"entity_type"`
+	EntityID      int          `json:"entity_id"`
+	AmountCents   int64        `json:"amount_cents"`
+	Currency      string       `json:"currency"`
+	Reason        string       `json:"reason"`
+	Status        RefundStatus `json:"status"`
+	InvoiceID     *int         `json:"invoice_id,omitempty"`
+	TransactionID *int         `json:"transaction_id,omitempty"`
+	PaymentID     *int         `json:"payment_id,omitempty"`
+	ProviderRef   *string      `json:"provider_ref,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// PaymentMethod represents a stored payment instrument for a user
+type PaymentMethod struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PaymentStatus represents valid payment states
+type PaymentStatus string
+
+const (
+	PaymentCaptured PaymentStatus = "captured"
+	PaymentRefunded PaymentStatus = "refunded"
+)
+
+// Payment represents money captured from a customer for an invoice
+type Payment struct {
+	ID              int           `json:"id"`
+	UserID          int           `json:"user_id"`
+	InvoiceID       int           `json:"invoice_id"`
+	PaymentMethodID *int          `json:"payment_method_id,omitempty"`
+	Provider        string        `json:"provider"`
+	ProviderRef     string        `json:"provider_ref"`
+	AmountCents     int64         `json:"amount_cents"`
+	Currency        string        `json:"currency"`
+	Status          PaymentStatus `json:"status"`
+	CreatedAt       time.Time     `json:"created_at"`
+}
+
+// CreditEntry is one movement on a user's account credit. Entries are
+// never changed; BalanceCents is the running balance after the entry.
+type CreditEntry struct {
+	ID            int       `json:"id"`
+	UserID        int       `json:"user_id"`
+	AmountCents   int64     `json:"amount_cents"`
+	Currency      string    `json:"currency"`
+	BalanceCents  int64     `json:"balance_cents"`
+	Reason        string    `json:"reason"`
+	EntityType    *string   `json:"entity_type,omitempty"`
+	EntityID      *int      `json:"entity_id,omitempty"`
+	TransactionID *int      `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// AccountType represents the kind of a ledger account
+type AccountType string
+
+const (
+	AccountAsset     AccountType = "asset"
+	AccountLiability AccountType = "liability"
+	AccountRevenue   AccountType = "revenue"
+	AccountExpense   AccountType = "expense"
+)
+
+// JournalEntry is one balanced double-entry posting. Entries are never
+// changed; corrections are posted as new entries.
+type JournalEntry struct {
+	ID            int           `json:"id"`
+	TransactionID *int          `json:"transaction_id,omitempty"`
+	Description   string        `json:"description"`
+	EntityType    string        `json:"entity_type"`
+	EntityID      int           `json:"entity_id"`
+	Lines         []JournalLine `json:"lines"`
+	EffectiveAt   time.Time     `json:"effective_at"`
+	CreatedAt     time.Time     `json:"created_at"`
+}
+
+// JournalLine is a debit or a credit to one account within an entry
+type JournalLine struct {
+	ID          int    `json:"id"`
+	EntryID     int    `json:"entry_id"`
+	Account     string `json:"account"`
+	DebitCents  int64  `json:"debit_cents"`
+	CreditCents int64  `json:"credit_cents"`
+	Currency    string `json:"currency"`
+}
+
+// ScheduleStatus represents valid revenue schedule states
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	ScheduleCompleted ScheduleStatus = "completed"
+	ScheduleClosed    ScheduleStatus = "closed"
+)
+
+// RevenueSchedule spreads the revenue for one paid period over that
+// period. Released amounts were given back (refunds, credits) and are
+// never recognized.
+type RevenueSchedule struct {
+	ID                int            `json:"id"`
+	EntityType        string         `json:"entity_type"`
+	EntityID          int            `json:"entity_id"`
+	InvoiceID         *int           `json:"invoice_id,omitempty"`
+	GiftID            *int           `json:"gift_id,omitempty"`
+	AmountCents       int64          `json:"amount_cents"`
+	ReleasedCents     int64          `json:"released_cents"`
+	RecognizedCents   int64          `json:"recognized_cents"`
+	Currency          string         `json:"currency"`
+	StartsAt          time.Time      `json:"starts_at"`
+	EndsAt            time.Time      `json:"ends_at"`
+	RecognizedThrough time.Time      `json:"recognized_through"`
+	Status            ScheduleStatus `json:"status"`
+	CreatedAt         time.Time      `json:"created_at"`
+}
+
+// RemainingCents returns the revenue still deferred on the schedule
+func (s *RevenueSchedule) RemainingCents() int64 {
+	return s.AmountCents - s.ReleasedCents - s.RecognizedCents
+}
+
+// RevenueMonth is recognized revenue during a month and deferred revenue
+// at its end, in one currency
+type RevenueMonth struct {
+	Month           string `json:"month"`
+	Currency        string `json:"currency"`
+	RecognizedCents int64  `json:"recognized_cents"`
+	DeferredCents   int64  `json:"deferred_cents"`
+}
+
+// TrialBalanceRow is the total posted to one account in one currency
+type TrialBalanceRow struct {
+	Account     string      `json:"account"`
+	Type        AccountType `json:"type"`
+	Currency    string      `json:"currency"`
+	DebitCents  int64       `json:"debit_cents"`
+	CreditCents int64       `json:"credit_cents"`
+}
+
+// CouponKind represents how a coupon discounts a purchase
+type CouponKind string
+
+const (
+	CouponPercent    CouponKind = "percent"
+	CouponAmount     CouponKind = "amount"
+	CouponFreeMonths CouponKind = "free_months"
+)
+
+// Coupon represents a discount or promotion code
+type Coupon struct {
+	ID              int        `json:"id"`
+	Code            string     `json:"code"`
+	Kind            CouponKind `json:"kind"`
+	PercentOff      *int       `json:"percent_off,omitempty"`
+	AmountOffCents  *int64     `json:"amount_off_cents,omitempty"`
+	Currency        *string    `json:"currency,omitempty"`
+	FreeMonths      *int       `json:"free_months,omitempty"`
+	MaxRedemptions  *int       `json:"max_redemptions,omitempty"`
+	PerUserLimit    *int       `json:"per_user_limit,omitempty"`
+	RedemptionCount int        `json:"redemption_count"`
+	ValidFrom       *time.Time `json:"valid_from,omitempty"`
+	ValidUntil      *time.Time `json:"valid_until,omitempty"`
+	PlanCodes       []string   `json:"plan_codes"`
+	Active          bool       `json:"active"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// InvoiceStatus represents valid invoice states
+type InvoiceStatus string
+
+const (
+	InvoiceIssued InvoiceStatus = "issued"
+	InvoicePaid   InvoiceStatus = "paid"
+	InvoiceVoid   InvoiceStatus = "void"
+)
+
+// Invoice represents the billing document for one billable operation
+type Invoice struct {
+	ID            int           `json:"id"`
+	Number        string        `json:"number"`
+	UserID        int           `json:"user_id"`
+	EntityType    string        `json:"entity_type"`
+	EntityID      int           `json:"entity_id"`
+	TransactionID int           `json:"transaction_id"`
+	SubtotalCents int64         `json:"subtotal_cents"`
+	DiscountCents int64         `json:"discount_cents"`
+	TotalCents    int64         `json:"total_cents"`
+	CreditCents   int64         `json:"credit_applied_cents"`
+	Currency      string        `json:"currency"`
+	Status        InvoiceStatus `json:"status"`
+	IssuedAt      time.Time     `json:"issued_at"`
+	Lines         []InvoiceLine `json:"lines,omitempty"`
+}
+
+// InvoiceLine represents a single charge, discount or credit on an invoice
+type InvoiceLine struct {
+	ID              int    `json:"id"`
+	InvoiceID       int    `json:"invoice_id"`
+	Description     string `json:"description"`
+	Quantity        int    `json:"quantity"`
+	UnitAmountCents int64  `json:"unit_amount_cents"`
+	AmountCents     int64  `json:"amount_cents"`
+}
+
 // Transaction represents an idempotent operation record
 type Transaction struct {
 	ID             int       `json:"id"`
@@ -67,28 +464,121 @@ type Transaction struct {
 
 // API Request/Response types
 
+type UserRequest struct {
+	Email string `json:"email"`
+}
+
 type SubscribeRequest struct {
 	UserID         int    `json:"user_id"`
 	Plan           string `json:"plan"`
 	DurationMonths int    `json:"duration_months"`
+	Trial          bool   `json:"trial"`
+	Coupon         string `json:"coupon,omitempty"`
+	AutoRenew      *bool  `json:"auto_renew,omitempty"`
 }
 
 type RenewRequest struct {
-	SubscriptionID int `json:"subscription_id"`
-	DurationMonths int `json:"duration_months"`
+	SubscriptionID int    `json:"subscription_id"`
+	DurationMonths int    `json:"duration_months"`
+	Coupon         string `json:"coupon,omitempty"`
+}
+
+type ChangePlanRequest struct {
+	Plan    string `json:"plan"`
+	ApplyAt string `json:"apply_at"`
+}
+
+type AutoRenewRequest struct {
+	AutoRenew *bool `json:"auto_renew"`
+}
+
+type PauseRequest struct {
+	ResumeAt *time.Time `json:"resume_at,omitempty"`
 }
 
 type CancelRequest struct {
-	SubscriptionID int `json:"subscription_id"`
+	SubscriptionID    int  `json:"subscription_id"`
+	CancelAtPeriodEnd bool `json:"cancel_at_period_end"`
 }
 
 type GiftRequest struct {
+	GifterID       int        `json:"gifter_id"`
+	RecipientEmail string     `json:"recipient_email"`
+	Plan           string     `json:"plan"`
+	DurationMonths int        `json:"duration_months"`
+	Coupon         string     `json:"coupon,omitempty"`
+	Open           bool       `json:"open,omitempty"`
+	DeliverAt      *time.Time `json:"deliver_at,omitempty"`
+	Message        string     `json:"message,omitempty"`
+	SenderName     string     `json:"sender_name,omitempty"`
+}
+
+// GiftBatchRequest buys gifts for many recipients at once. Message and
+// SenderName apply to recipients that do not set their own.
+type GiftBatchRequest struct {
+	GifterID       int                  `json:"gifter_id"`
+	Plan           string               `json:"plan"`
+	DurationMonths int                  `json:"duration_months"`
+	Mode           GiftBatchMode        `json:"mode"`
+	Open           bool                 `json:"open,omitempty"`
+	DeliverAt      *time.Time           `json:"deliver_at,omitempty"`
+	Message        string               `json:"message,omitempty"`
+	SenderName     string               `json:"sender_name,omitempty"`
+	Recipients     []GiftBatchRecipient `json:"recipients"`
+}
+
+type GiftBatchRecipient struct {
+	Email      string `json:"email"`
+	Message    string `json:"message,omitempty"`
+	SenderName string `json:"sender_name,omitempty"`
+}
+
+type RevokeGiftRequest struct {
+	GifterID int    `json:"gifter_id"`
+	Method   string `json:"method"`
+}
+
+type GiftRecipientRequest struct {
 	GifterID       int    `json:"gifter_id"`
 	RecipientEmail string `json:"recipient_email"`
-	DurationMonths int    `json:"duration_months"`
 }
 
 type RedeemGiftRequest struct {
-	GiftID int `json:"gift_id"`
-	UserID int `json:"user_id"`
+	Code   string `json:"code"`
+	UserID int    `json:"user_id"`
+}
+
+type PlanRequest struct {
+	Code            string          `json:"code"`
+	Name            string          `json:"name"`
+	PriceCents      *int64          `json:"price_cents,omitempty"`
+	Currency        string          `json:"currency"`
+	BillingInterval BillingInterval `json:"billing_interval"`
+	TrialDays       *int            `json:"trial_days,omitempty"`
+	Active          *bool           `json:"active,omitempty"`
+}
+
+type PaymentMethodRequest struct {
+	UserID int    `json:"user_id"`
+	Token  string `json:"token"`
+}
+
+type CreditRequest struct {
+	AmountCents int64  `json:"amount_cents"`
+	Currency    string `json:"currency"`
+	Reason      string `json:"reason"`
+}
+
+type CouponRequest struct {
+	Code           string     `json:"code"`
+	Kind           CouponKind `json:"kind"`
+	PercentOff     *int       `json:"percent_off,omitempty"`
+	AmountOffCents *int64     `json:"amount_off_cents,omitempty"`
+	Currency       *string    `json:"currency,omitempty"`
+	FreeMonths     *int       `json:"free_months,omitempty"`
+	MaxRedemptions *int       `json:"max_redemptions,omitempty"`
+	PerUserLimit   *int       `json:"per_user_limit,omitempty"`
+	ValidFrom      *time.Time `json:"valid_from,omitempty"`
+	ValidUntil     *time.Time `json:"valid_until,omitempty"`
+	PlanCodes      []string   `json:"plan_codes,omitempty"`
 }
@@ -0,0 +1,192 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Outcome is the scripted result of the next call to a Fake
+type Outcome int
+
+const (
+	Succeed Outcome = iota
+	Decline
+	Timeout
+)
+
+// Tokens that make the Fake fail every authorization, so declines can be
+// exercised end to end without scripting
+const (
+	DeclineToken = "tok_decline"
+	TimeoutToken = "tok_timeout"
+)
+
+type fakeAuthState string
+
+const (
+	fakeAuthorized fakeAuthState = "authorized"
+	fakeCaptured   fakeAuthState = "captured"
+	fakeVoided     fakeAuthState = "voided"
+)
+
+type fakeAuth struct {
+	amount   int64
+	captured int64
+	refunded int64
+	state    fakeAuthState
+}
+
+// Fake is a deterministic in-process Provider. Each call consumes the next
+// scripted outcome, defaulting to Succeed when the script is empty. IDs are
+// sequential and authorizations are deduplicated by idempotency key, so a
+// retried request returns the original hold. It is safe for concurrent use.
+type Fake struct {
+	mu     sync.Mutex
+	script []Outcome
+	seq    int
+	auths  map[string]*fakeAuth
+	byKey  map[string]*Authorization
+}
+
+func NewFake(script ...Outcome) *Fake {
+	return &Fake{
+		script: script,
+		auths:  make(map[string]*fakeAuth),
+		byKey:  make(map[string]*Authorization),
+	}
+}
+
+// Script appends outcomes for the next calls, in order
+func (f *Fake) Script(outcomes ...Outcome) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, outcomes...)
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) Authorize(ctx context.Context, req ChargeRequest) (*Authorization, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.next(ctx); err != nil {
+		return nil, err
+	}
+	switch req.Token {
+	case DeclineToken:
+		return nil, ErrDeclined
+	case TimeoutToken:
+		return nil, ErrTimeout
+	}
+
+	if req.IdempotencyKey != "" {
+		if auth, ok := f.byKey[req.IdempotencyKey]; ok && f.auths[auth.ID].state != fakeVoided {
+			return auth, nil
+		}
+	}
+
+	auth := &Authorization{ID: f.newID("auth"), AmountCents: req.AmountCents, Currency: req.Currency}
+	f.auths[auth.ID] = &fakeAuth{amount: req.AmountCents, state: fakeAuthorized}
+	if req.IdempotencyKey != "" {
+		f.byKey[req.IdempotencyKey] = auth
+	}
+	return auth, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, authorizationID string, amount int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.next(ctx); err != nil {
+		return err
+	}
+
+	auth, ok := f.auths[authorizationID]
+	if !ok {
+		return ErrNotFound
+	}
+	if auth.state == fakeCaptured && auth.captured == amount {
+		return nil
+	}
+	if auth.state != fakeAuthorized {
+		return ErrInvalidState
+	}
+	if amount > auth.amount {
+		return ErrAmountExceedsAuth
+	}
+
+	auth.captured = amount
+	auth.state = fakeCaptured
+	return nil
+}
+
+func (f *Fake) Refund(ctx context.Context, authorizationID string, amount int64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.next(ctx); err != nil {
+		return "", err
+	}
+
+	auth, ok := f.auths[authorizationID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	if auth.state != fakeCaptured {
+		return "", ErrInvalidState
+	}
+	if auth.refunded+amount > auth.captured {
+		return "", ErrAmountExceedsAuth
+	}
+
+	auth.refunded += amount
+	return f.newID("refund"), nil
+}
+
+func (f *Fake) Void(ctx context.Context, authorizationID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.next(ctx); err != nil {
+		return err
+	}
+
+	auth, ok := f.auths[authorizationID]
+	if !ok {
+		return ErrNotFound
+	}
+	if auth.state != fakeAuthorized {
+		return ErrInvalidState
+	}
+
+	auth.state = fakeVoided
+	return nil
+}
+
+// next pops the next scripted outcome and turns it into an error
+func (f *Fake) next(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return ErrTimeout
+	}
+	if len(f.script) == 0 {
+		return nil
+	}
+
+	outcome := f.script[0]
+	f.script = f.script[1:]
+	switch outcome {
+	case Decline:
+		return ErrDeclined
+	case Timeout:
+		return ErrTimeout
+	}
+	return nil
+}
+
+func (f *Fake) newID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("fake_%s_%06d", prefix, f.seq)
+}
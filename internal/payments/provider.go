@@ -0,0 +1,63 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultTimeout bounds a single call to a payment provider
+const DefaultTimeout = 10 * time.Second
+
+var (
+	ErrDeclined          = errors.New("payment was declined")
+	ErrTimeout           = errors.New("payment provider timed out")
+	ErrNotFound          = errors.New("authorization not found")
+	ErrInvalidState      = errors.New("authorization is not in a valid state for this operation")
+	ErrAmountExceedsAuth = errors.New("amount exceeds authorized amount")
+)
+
+// ChargeRequest describes an amount to authorize against a stored payment
+// method. IdempotencyKey lets the provider deduplicate retried calls.
+type ChargeRequest struct {
+	UserID         int
+	Token          string
+	AmountCents    int64
+	Currency       string
+	Description    string
+	IdempotencyKey string
+}
+
+// Authorization is a hold placed on a payment method by Authorize
+type Authorization struct {
+	ID          string
+	AmountCents int64
+	Currency    string
+}
+
+// Provider is a payment processor. Authorize places a hold, Capture takes
+// the money, Void releases an uncaptured hold and Refund returns captured
+// money. Implementations return ErrDeclined or ErrTimeout for the failures
+// callers are expected to handle.
+type Provider interface {
+	Name() string
+	Authorize(ctx context.Context, req ChargeRequest) (*Authorization, error)
+	Capture(ctx context.Context, authorizationID string, amount int64) error
+	Refund(ctx context.Context, authorizationID string, amount int64) (string, error)
+	Void(ctx context.Context, authorizationID string) error
+}
+
+// Charge authorizes and captures req in one step. A hold whose capture
+// fails is voided so the customer is not left with a pending charge.
+func Charge(ctx context.Context, p Provider, req ChargeRequest) (*Authorization, error) {
+	auth, err := p.Authorize(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Capture(ctx, auth.ID, auth.AmountCents); err != nil {
+		p.Void(ctx, auth.ID)
+		return nil, err
+	}
+	return auth, nil
+}
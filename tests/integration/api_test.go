@@ -3,18 +3,36 @@ package integration
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/cache"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/database"
 	"github.com/jeet-patel/subscription-commerce-backend/internal/handlers"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/middleware"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
 )
 
 var testDB *database.DB
 var testRedis *cache.Redis
+var testPayments *payments.Fake
+var testRedeemFailures *middleware.FailureLimiter
+
+// newRequest builds a request from a trusted service, as the auth
+// middleware would hand it to a handler
+func newRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	service := &auth.Principal{Kind: auth.PrincipalService, APIKeyID: 1, Name: "integration-tests"}
+	return req.WithContext(auth.WithPrincipal(req.Context(), service))
+}
 
 func setupTest(t *testing.T) func() {
 	var err error
@@ -31,9 +49,29 @@ func setupTest(t *testing.T) func() {
 		t.Fatalf("Failed to connect to Redis: %v", err)
 	}
 
-	// Clean up tables
+	testPayments = payments.NewFake()
+
+	// Each test counts failed redemptions under its own name
+	testRedeemFailures = middleware.NewFailureLimiter(testRedis, fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		middleware.GiftRedeemFailureLimit, middleware.GiftRedeemFailureWindow)
+
+	// Clean up tables; the ledgers are append-only, so they are truncated
+	testDB.Exec("TRUNCATE journal_lines, journal_entries")
+	testDB.Exec("TRUNCATE credit_ledger")
+	testDB.Exec("TRUNCATE gift_redemption_rejections")
+	testDB.Exec("DELETE FROM revenue_schedules")
+	testDB.Exec("DELETE FROM payments")
+	testDB.Exec("DELETE FROM invoice_lines")
+	testDB.Exec("DELETE FROM invoices")
+	testDB.Exec("DELETE FROM coupon_redemptions")
+	testDB.Exec("DELETE FROM coupons")
+	testDB.Exec("DELETE FROM refunds")
+	testDB.Exec("DELETE FROM trials")
+	testDB.Exec("DELETE FROM payment_methods")
+	testDB.Exec("DELETE FROM events")
 	testDB.Exec("DELETE FROM transactions")
 	testDB.Exec("DELETE FROM gifts")
+	testDB.Exec("DELETE FROM gift_batches")
 	testDB.Exec("DELETE FROM subscriptions")
 	testDB.Exec("DELETE FROM users")
 
@@ -41,9 +79,26 @@ func setupTest(t *testing.T) func() {
 	testDB.Exec("INSERT INTO users (id, email) VALUES (100, 'testuser@test.com')")
 	testDB.Exec("INSERT INTO users (id, email) VALUES (101, 'recipient@test.com')")
 
+	// Paid operations charge the user's card on file
+	testDB.Exec("INSERT INTO payment_methods (user_id, token) VALUES (100, 'tok_test')")
+
 	return func() {
+		testDB.Exec("TRUNCATE journal_lines, journal_entries")
+		testDB.Exec("TRUNCATE credit_ledger")
+		testDB.Exec("TRUNCATE gift_redemption_rejections")
+		testDB.Exec("DELETE FROM revenue_schedules")
+		testDB.Exec("DELETE FROM payments")
+		testDB.Exec("DELETE FROM invoice_lines")
+		testDB.Exec("DELETE FROM invoices")
+		testDB.Exec("DELETE FROM coupon_redemptions")
+		testDB.Exec("DELETE FROM coupons")
+		testDB.Exec("DELETE FROM refunds")
+		testDB.Exec("DELETE FROM trials")
+		testDB.Exec("DELETE FROM payment_methods")
+		testDB.Exec("DELETE FROM events")
 		testDB.Exec("DELETE FROM transactions")
 		testDB.Exec("DELETE FROM gifts")
+		testDB.Exec("DELETE FROM gift_batches")
 		testDB.Exec("DELETE FROM subscriptions")
 		testDB.Exec("DELETE FROM users WHERE id IN (100, 101)")
 		testDB.Close()
@@ -55,10 +110,10 @@ func TestSubscribeHappyPath(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewSubscriptionHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
 
 	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
-	req := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotency-Key", "test-sub-001")
 
@@ -85,11 +140,11 @@ func TestSubscribeDuplicateUser(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewSubscriptionHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
 
 	// First subscription
 	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
-	req := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotency-Key", "test-sub-002")
 
@@ -101,7 +156,7 @@ func TestSubscribeDuplicateUser(t *testing.T) {
 	}
 
 	// Try duplicate subscription
-	req2 := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req2 := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req2.Header.Set("Content-Type", "application/json")
 	req2.Header.Set("Idempotency-Key", "test-sub-003")
 
@@ -117,11 +172,11 @@ func TestRenewHappyPath(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewSubscriptionHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
 
 	// Create subscription first
 	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
-	req := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotency-Key", "test-sub-004")
 
@@ -134,7 +189,7 @@ func TestRenewHappyPath(t *testing.T) {
 
 	// Renew subscription
 	renewBody := `{"subscription_id": ` + string(rune(subID+'0')) + `, "duration_months": 1}`
-	renewReq := httptest.NewRequest(http.MethodPost, "/renew", bytes.NewBufferString(renewBody))
+	renewReq := newRequest(http.MethodPost, "/renew", bytes.NewBufferString(renewBody))
 	renewReq.Header.Set("Content-Type", "application/json")
 	renewReq.Header.Set("Idempotency-Key", "test-renew-001")
 
@@ -150,11 +205,11 @@ func TestCancelHappyPath(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewSubscriptionHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
 
 	// Create subscription first
 	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
-	req := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotency-Key", "test-sub-005")
 
@@ -167,7 +222,7 @@ func TestCancelHappyPath(t *testing.T) {
 
 	// Cancel subscription
 	cancelBody := `{"subscription_id": ` + string(rune(subID+'0')) + `}`
-	cancelReq := httptest.NewRequest(http.MethodPost, "/cancel", bytes.NewBufferString(cancelBody))
+	cancelReq := newRequest(http.MethodPost, "/cancel", bytes.NewBufferString(cancelBody))
 	cancelReq.Header.Set("Content-Type", "application/json")
 	cancelReq.Header.Set("Idempotency-Key", "test-cancel-001")
 
@@ -186,14 +241,194 @@ func TestCancelHappyPath(t *testing.T) {
 	}
 }
 
+func TestCancelWithProratedRefund(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.RefundPolicy{Mode: billing.RefundProrated})
+
+	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "test-sub-refund-001")
+
+	rr := httptest.NewRecorder()
+	handler.Subscribe(rr, req)
+
+	var subResponse map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &subResponse)
+	subID := int(subResponse["id"].(float64))
+
+	cancelBody := fmt.Sprintf(`{"subscription_id": %d}`, subID)
+	cancelReq := newRequest(http.MethodPost, "/cancel", bytes.NewBufferString(cancelBody))
+	cancelReq.Header.Set("Content-Type", "application/json")
+	cancelReq.Header.Set("Idempotency-Key", "test-cancel-refund-001")
+
+	cancelRR := httptest.NewRecorder()
+	handler.Cancel(cancelRR, cancelReq)
+
+	if cancelRR.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", cancelRR.Code, cancelRR.Body.String())
+	}
+
+	var response struct {
+		Status string                `json:"status"`
+		Refund billing.RefundSummary `json:"refund"`
+	}
+	json.Unmarshal(cancelRR.Body.Bytes(), &response)
+
+	if response.Status != "cancelled" {
+		t.Errorf("Expected status 'cancelled', got %s", response.Status)
+	}
+	if response.Refund.AmountCents <= 0 || response.Refund.RefundID == nil {
+		t.Fatalf("Expected a refund, got %+v", response.Refund)
+	}
+	if response.Refund.Status != models.RefundCompleted {
+		t.Errorf("Expected refund status 'completed', got %s", response.Refund.Status)
+	}
+
+	var invoiceID int
+	testDB.QueryRow(`SELECT invoice_id FROM refunds WHERE id = $1`, *response.Refund.RefundID).Scan(&invoiceID)
+	if response.Refund.InvoiceID == nil || invoiceID != *response.Refund.InvoiceID {
+		t.Errorf("Expected refund linked to invoice %v, got %d", response.Refund.InvoiceID, invoiceID)
+	}
+}
+
+func TestSubscribeDrawsDownCredit(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	credits := handlers.NewCreditHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	grantReq := newRequest(http.MethodPost, "/users/100/credit/grant",
+		bytes.NewBufferString(`{"amount_cents": 600, "currency": "usd", "reason": "Goodwill"}`))
+	grantReq.Header.Set("Idempotency-Key", "test-credit-grant-001")
+	grantRR := httptest.NewRecorder()
+	credits.Grant(grantRR, grantReq)
+
+	if grantRR.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", grantRR.Code, grantRR.Body.String())
+	}
+
+	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req.Header.Set("Idempotency-Key", "test-sub-credit-001")
+	rr := httptest.NewRecorder()
+	handler.Subscribe(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The card only covers what the credit did not
+	var charged int64
+	testDB.QueryRow(`SELECT amount_cents FROM payments WHERE user_id = 100`).Scan(&charged)
+	if charged != 399 {
+		t.Errorf("Expected 399 charged to the card, got %d", charged)
+	}
+
+	balanceReq := newRequest(http.MethodGet, "/users/100/balance", nil)
+	balanceRR := httptest.NewRecorder()
+	credits.Balance(balanceRR, balanceReq)
+
+	var balance struct {
+		Balances map[string]int64     `json:"balances"`
+		Entries  []models.CreditEntry `json:"entries"`
+	}
+	json.Unmarshal(balanceRR.Body.Bytes(), &balance)
+
+	if balance.Balances["USD"] != 0 {
+		t.Errorf("Expected USD balance 0, got %d", balance.Balances["USD"])
+	}
+	if len(balance.Entries) != 2 || balance.Entries[1].AmountCents != -600 {
+		t.Errorf("Expected a grant and a 600 draw-down, got %+v", balance.Entries)
+	}
+
+	// Debits cannot take the balance below zero
+	debitReq := newRequest(http.MethodPost, "/users/100/credit/debit",
+		bytes.NewBufferString(`{"amount_cents": 1, "reason": "Correction"}`))
+	debitReq.Header.Set("Idempotency-Key", "test-credit-debit-001")
+	debitRR := httptest.NewRecorder()
+	credits.Debit(debitRR, debitReq)
+
+	if debitRR.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d: %s", debitRR.Code, debitRR.Body.String())
+	}
+}
+
+func TestTrialBalanceAfterOperations(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	subs := handlers.NewSubscriptionHandler(testDB, testPayments, billing.RefundPolicy{Mode: billing.RefundProrated})
+	gifts := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+	ledger := handlers.NewLedgerHandler(testDB)
+
+	post := func(handler http.HandlerFunc, path, key, body string) map[string]interface{} {
+		req := newRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code >= 300 {
+			t.Fatalf("%s: expected success, got %d: %s", path, rr.Code, rr.Body.String())
+		}
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return response
+	}
+
+	sub := post(subs.Subscribe, "/subscribe", "test-ledger-sub", `{"user_id": 100, "plan": "monthly"}`)
+	post(subs.Renew, "/renew", "test-ledger-renew", fmt.Sprintf(`{"subscription_id": %d}`, int(sub["id"].(float64))))
+	gift := post(gifts.CreateGift, "/gift", "test-ledger-gift", `{"gifter_id": 100, "recipient_email": "recipient@test.com"}`)
+	post(gifts.RedeemGift, "/gift/redeem", "test-ledger-redeem", fmt.Sprintf(`{"code": %q, "user_id": 101}`, gift["redemption_code"]))
+	post(subs.Cancel, "/cancel", "test-ledger-cancel", fmt.Sprintf(`{"subscription_id": %d}`, int(sub["id"].(float64))))
+
+	rr := httptest.NewRecorder()
+	ledger.TrialBalance(rr, newRequest(http.MethodGet, "/ledger/trial-balance", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Balanced bool                     `json:"balanced"`
+		Accounts []models.TrialBalanceRow `json:"accounts"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+
+	if !response.Balanced {
+		t.Error("Expected the trial balance to balance")
+	}
+
+	posted := map[string]int64{}
+	for _, row := range response.Accounts {
+		posted[row.Account] = row.DebitCents - row.CreditCents
+	}
+	// Three paid invoices, less the refund paid back out
+	if posted["cash"] <= 0 || posted["cash"] >= 3*999 {
+		t.Errorf("Expected cash between 0 and %d, got %d", 3*999, posted["cash"])
+	}
+	if posted["gift_liability"] != 0 {
+		t.Errorf("Expected the redeemed gift to clear gift liability, got %d", posted["gift_liability"])
+	}
+	if posted["refunds_payable"] != 0 {
+		t.Errorf("Expected the settled refund to clear refunds payable, got %d", posted["refunds_payable"])
+	}
+	// Only the gifted subscription is still owed service
+	if posted["deferred_revenue"] != -999 {
+		t.Errorf("Expected 999 deferred, got %d", -posted["deferred_revenue"])
+	}
+}
+
 func TestGiftHappyPath(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewGiftHandler(testDB)
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
 
 	body := `{"gifter_id": 100, "recipient_email": "friend@test.com", "duration_months": 3}`
-	req := httptest.NewRequest(http.MethodPost, "/gift", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/gift", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotency-Key", "test-gift-001")
 
@@ -214,16 +449,464 @@ func TestGiftHappyPath(t *testing.T) {
 	if response["duration_months"].(float64) != 3 {
 		t.Errorf("Expected duration_months 3, got %v", response["duration_months"])
 	}
+
+	if code, _ := response["redemption_code"].(string); code == "" {
+		t.Error("Expected a redemption code")
+	}
+}
+
+func TestGiftRedeemRequiresRecipient(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	send := func(handle http.HandlerFunc, path, key, body string) *httptest.ResponseRecorder {
+		req := newRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handle(rr, req)
+		return rr
+	}
+
+	var addressed, open models.Gift
+	rr := send(handler.CreateGift, "/gift", "test-recipient-gift", `{"gifter_id": 100, "recipient_email": "  Recipient@Test.COM "}`)
+	json.Unmarshal(rr.Body.Bytes(), &addressed)
+	rr = send(handler.CreateGift, "/gift", "test-open-gift", `{"gifter_id": 100, "recipient_email": "someone@test.com", "open": true}`)
+	json.Unmarshal(rr.Body.Bytes(), &open)
+
+	if addressed.RecipientEmail != "recipient@test.com" {
+		t.Errorf("Expected the recipient email to be normalized, got %q", addressed.RecipientEmail)
+	}
+
+	// User 100 is not the recipient
+	rr = send(handler.RedeemGift, "/gift/redeem", "test-recipient-wrong", fmt.Sprintf(`{"code": %q, "user_id": 100}`, addressed.RedemptionCode))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for another user, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var reason string
+	testDB.QueryRow(`SELECT reason FROM gift_redemption_rejections WHERE gift_id = $1 AND user_id = 100`, addressed.ID).Scan(&reason)
+	if reason != string(models.RejectRecipientMismatch) {
+		t.Errorf("Expected a recipient_mismatch rejection on record, got %q", reason)
+	}
+
+	rr = send(handler.RedeemGift, "/gift/redeem", "test-recipient-right", fmt.Sprintf(`{"code": %q, "user_id": 101}`, addressed.RedemptionCode))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the recipient to redeem, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Anyone holding the code can redeem an open gift
+	rr = send(handler.RedeemGift, "/gift/redeem", "test-open-redeem", fmt.Sprintf(`{"code": %q, "user_id": 100}`, open.RedemptionCode))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the open gift to be redeemed, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestGiftRedeemExtendsActiveSubscription(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	var subID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, plan_code, status, start_date, end_date)
+		 VALUES (101, 'monthly', 'active', NOW() - interval '10 days', NOW() + interval '20 days')
+		 RETURNING id`,
+	).Scan(&subID)
+	before, _ := testDB.GetSubscriptionByID(subID)
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	req := newRequest(http.MethodPost, "/gift", bytes.NewBufferString(`{"gifter_id": 100, "recipient_email": "recipient@test.com", "duration_months": 3}`))
+	req.Header.Set("Idempotency-Key", "test-stack-gift")
+	rr := httptest.NewRecorder()
+	handler.CreateGift(rr, req)
+
+	var gift models.Gift
+	json.Unmarshal(rr.Body.Bytes(), &gift)
+
+	req = newRequest(http.MethodPost, "/gift/redeem", bytes.NewBufferString(fmt.Sprintf(`{"code": %q, "user_id": 101}`, gift.RedemptionCode)))
+	req.Header.Set("Idempotency-Key", "test-stack-redeem")
+	rr = httptest.NewRecorder()
+	handler.RedeemGift(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Extended     bool                `json:"extended"`
+		Gift         models.Gift         `json:"gift"`
+		Subscription models.Subscription `json:"subscription"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+
+	if !response.Extended || response.Subscription.ID != subID {
+		t.Errorf("Expected subscription %d to be extended, got %+v", subID, response.Subscription)
+	}
+	if response.Gift.Status != models.GiftRedeemed {
+		t.Errorf("Expected the gift to be redeemed, got %s", response.Gift.Status)
+	}
+
+	var extendedByThreeMonths bool
+	testDB.QueryRow(
+		`SELECT end_date = $2::timestamp + interval '3 months' FROM subscriptions WHERE id = $1`,
+		subID, before.EndDate,
+	).Scan(&extendedByThreeMonths)
+	if !extendedByThreeMonths {
+		t.Errorf("Expected end_date %v to move out by 3 months, got %v", before.EndDate, response.Subscription.EndDate)
+	}
+
+	var appliedAs string
+	testDB.QueryRow(`SELECT metadata->>'applied_as' FROM transactions WHERE idempotency_key = 'test-stack-redeem'`).Scan(&appliedAs)
+	if appliedAs != "extension" {
+		t.Errorf("Expected the redemption to be recorded as an extension, got %q", appliedAs)
+	}
+}
+
+func TestGiftRedeemFailuresAreLimited(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	req := newRequest(http.MethodPost, "/gift", bytes.NewBufferString(`{"gifter_id": 100, "recipient_email": "recipient@test.com"}`))
+	req.Header.Set("Idempotency-Key", "test-gift-limit")
+	rr := httptest.NewRecorder()
+	handler.CreateGift(rr, req)
+
+	var gift models.Gift
+	json.Unmarshal(rr.Body.Bytes(), &gift)
+
+	redeem := func(code, key string) int {
+		body := fmt.Sprintf(`{"code": %q, "user_id": 101}`, code)
+		req := newRequest(http.MethodPost, "/gift/redeem", bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler.RedeemGift(rr, req)
+		return rr.Code
+	}
+
+	// A well-formed code that matches no gift, and a code with a typo
+	if code := redeem("0000-0000-0000-0000", "test-redeem-miss"); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown code, got %d", code)
+	}
+	if code := redeem("0000-0000-0000-0001", "test-redeem-typo"); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a bad check symbol, got %d", code)
+	}
+	for i := 2; i < middleware.GiftRedeemFailureLimit; i++ {
+		redeem("0000-0000-0000-0000", fmt.Sprintf("test-redeem-miss-%d", i))
+	}
+
+	// Once blocked, even the right code is refused
+	if code := redeem(gift.RedemptionCode, "test-redeem-blocked"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 after %d failures, got %d", middleware.GiftRedeemFailureLimit, code)
+	}
+}
+
+func TestGiftRevokeRefundsGifter(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	send := func(handle http.HandlerFunc, path, key, body string) *httptest.ResponseRecorder {
+		req := newRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handle(rr, req)
+		return rr
+	}
+
+	var gift models.Gift
+	rr := send(handler.CreateGift, "/gift", "test-revoke-gift", `{"gifter_id": 100, "recipient_email": "recipient@test.com"}`)
+	json.Unmarshal(rr.Body.Bytes(), &gift)
+	path := fmt.Sprintf("/gift/%d/revoke", gift.ID)
+
+	// Only the gifter can revoke
+	rr = send(handler.Gifts, path, "test-revoke-other", `{"gifter_id": 101}`)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for another user, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = send(handler.Gifts, path, "test-revoke", `{"gifter_id": 100}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Gift   models.Gift    `json:"gift"`
+		Refund *models.Refund `json:"refund"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+
+	if response.Gift.Status != models.GiftRevoked {
+		t.Errorf("Expected status revoked, got %s", response.Gift.Status)
+	}
+	if response.Refund == nil || response.Refund.AmountCents != gift.AmountCents || response.Refund.Status != models.RefundCompleted {
+		t.Errorf("Expected a completed refund of %d, got %+v", gift.AmountCents, response.Refund)
+	}
+
+	// What was owed as a gift has been paid back out
+	balance, _ := testDB.GetTrialBalance()
+	for _, row := range balance {
+		if row.Account == billing.AccountGiftLiability && row.DebitCents != row.CreditCents {
+			t.Errorf("Expected gift_liability to net to zero, got %d debit and %d credit", row.DebitCents, row.CreditCents)
+		}
+	}
+
+	rr = send(handler.Gifts, path, "test-revoke-again", `{"gifter_id": 100}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a revoked gift, got %d", rr.Code)
+	}
+	rr = send(handler.RedeemGift, "/gift/redeem", "test-revoke-redeem", fmt.Sprintf(`{"code": %q, "user_id": 101}`, gift.RedemptionCode))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 when redeeming a revoked gift, got %d", rr.Code)
+	}
+}
+
+func TestGiftChangeRecipientRotatesCode(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	send := func(handle http.HandlerFunc, path, key, body string) *httptest.ResponseRecorder {
+		req := newRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handle(rr, req)
+		return rr
+	}
+
+	var gift, changed models.Gift
+	rr := send(handler.CreateGift, "/gift", "test-readdress-gift", `{"gifter_id": 100, "recipient_email": "wrong@test.com"}`)
+	json.Unmarshal(rr.Body.Bytes(), &gift)
+
+	rr = send(handler.Gifts, fmt.Sprintf("/gift/%d/recipient", gift.ID), "test-readdress",
+		`{"gifter_id": 100, "recipient_email": "Recipient@Test.com"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	json.Unmarshal(rr.Body.Bytes(), &changed)
+
+	if changed.RecipientEmail != "recipient@test.com" {
+		t.Errorf("Expected the new recipient, got %q", changed.RecipientEmail)
+	}
+	if changed.RedemptionCode == gift.RedemptionCode {
+		t.Error("Expected a new redemption code")
+	}
+
+	var deliveries int
+	testDB.QueryRow(`SELECT COUNT(*) FROM events WHERE event_type = $1 AND entity_id = $2`, models.EventGiftDelivered, gift.ID).Scan(&deliveries)
+	if deliveries != 2 {
+		t.Errorf("Expected the gift to be delivered again, got %d deliveries", deliveries)
+	}
+
+	// The old code no longer works; the new one does for the new recipient
+	rr = send(handler.RedeemGift, "/gift/redeem", "test-readdress-old", fmt.Sprintf(`{"code": %q, "user_id": 101}`, gift.RedemptionCode))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for the old code, got %d", rr.Code)
+	}
+	rr = send(handler.RedeemGift, "/gift/redeem", "test-readdress-new", fmt.Sprintf(`{"code": %q, "user_id": 101}`, changed.RedemptionCode))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the new recipient to redeem, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestGiftBatchPartialModeAndRevoke(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	send := func(handle http.HandlerFunc, path, key, body string) *httptest.ResponseRecorder {
+		req := newRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handle(rr, req)
+		return rr
+	}
+
+	recipients := `[{"email": "one@test.com"}, {"email": "two@test.com"}, {"email": "not-an-email"}, {"email": " ONE@test.com"}]`
+
+	// Atomic mode refuses the whole batch over one bad row
+	rr := send(handler.CreateBatch, "/gift/batch", "test-batch-atomic", `{"gifter_id": 100, "recipients": `+recipients+`}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for an atomic batch with bad rows, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = send(handler.CreateBatch, "/gift/batch", "test-batch-partial", `{"gifter_id": 100, "mode": "partial", "recipients": `+recipients+`}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var created struct {
+		Batch   models.GiftBatch           `json:"batch"`
+		Gifts   []models.Gift              `json:"gifts"`
+		Failed  []models.GiftBatchRowError `json:"failed"`
+		Invoice models.Invoice             `json:"invoice"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+
+	if len(created.Gifts) != 2 || created.Batch.CreatedCount != 2 || created.Batch.RequestedCount != 4 {
+		t.Fatalf("Expected 2 of 4 gifts created, got %d (batch %+v)", len(created.Gifts), created.Batch)
+	}
+	if len(created.Failed) != 2 || created.Failed[0].Row != 3 || created.Failed[1].Row != 4 {
+		t.Errorf("Expected rows 3 and 4 to fail, got %+v", created.Failed)
+	}
+	if created.Invoice.TotalCents != created.Batch.AmountCents || created.Invoice.Status != models.InvoicePaid {
+		t.Errorf("Expected one paid invoice for %d, got %+v", created.Batch.AmountCents, created.Invoice)
+	}
+
+	rr = send(handler.Batches, fmt.Sprintf("/gift/batch/%d/revoke", created.Batch.ID), "test-batch-revoke", `{"gifter_id": 100}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var revoked struct {
+		Gifts   []models.Gift   `json:"gifts"`
+		Refunds []models.Refund `json:"refunds"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &revoked)
+
+	var refunded int64
+	for _, refund := range revoked.Refunds {
+		refunded += refund.AmountCents
+	}
+	if len(revoked.Gifts) != 2 || refunded != created.Invoice.TotalCents {
+		t.Errorf("Expected 2 gifts revoked and %d refunded, got %d and %d", created.Invoice.TotalCents, len(revoked.Gifts), refunded)
+	}
+
+	rr = send(handler.Batches, fmt.Sprintf("/gift/batch/%d/revoke", created.Batch.ID), "test-batch-revoke-again", `{"gifter_id": 100}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 once nothing is left to revoke, got %d", rr.Code)
+	}
+}
+
+func TestSignupClaimsPendingGifts(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	create := func(key, body string) models.Gift {
+		req := newRequest(http.MethodPost, "/gift", bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler.CreateGift(rr, req)
+
+		var gift models.Gift
+		json.Unmarshal(rr.Body.Bytes(), &gift)
+		return gift
+	}
+
+	delivered := create("test-claim-delivered", `{"gifter_id": 100, "recipient_email": "newcomer@test.com"}`)
+	deliverAt := time.Now().Add(48 * time.Hour).Format(time.RFC3339)
+	scheduled := create("test-claim-scheduled", fmt.Sprintf(`{"gifter_id": 100, "recipient_email": "newcomer@test.com", "deliver_at": %q}`, deliverAt))
+
+	tx, _ := testDB.BeginTx()
+	user, err := testDB.CreateUserTx(tx, "Newcomer@Test.com", "test-claim-signup")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	claims, err := testDB.ClaimGiftsTx(tx, user, nil, billing.ClaimRedeem, "test-claim-signup")
+	if err != nil {
+		t.Fatalf("Failed to claim gifts: %v", err)
+	}
+	tx.Commit()
+
+	// The delivered gift is redeemed onto a new subscription; the scheduled
+	// one is attached to wait for its delivery
+	if len(claims.Redeemed) != 1 || claims.Redeemed[0].ID != delivered.ID || claims.Subscription == nil {
+		t.Errorf("Expected gift %d to be redeemed onto a subscription, got %+v", delivered.ID, claims)
+	}
+	if len(claims.Attached) != 1 || claims.Attached[0].ID != scheduled.ID || *claims.Attached[0].RecipientID != user.ID {
+		t.Errorf("Expected gift %d to be attached to user %d, got %+v", scheduled.ID, user.ID, claims.Attached)
+	}
+
+	// Once delivered, the attached gift waits on the account
+	testDB.Exec(`UPDATE gifts SET status = 'pending', deliver_at = NOW(), delivered_at = NOW() WHERE id = $1`, scheduled.ID)
+
+	userHandler := handlers.NewUserHandler(testDB, billing.ClaimRedeem)
+	req := newRequest(http.MethodGet, fmt.Sprintf("/users/%d/pending-gifts", user.ID), nil)
+	rr := httptest.NewRecorder()
+	userHandler.PendingGifts(rr, req)
+
+	var pending struct {
+		Gifts []models.Gift `json:"gifts"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &pending)
+	if len(pending.Gifts) != 1 || pending.Gifts[0].ID != scheduled.ID {
+		t.Errorf("Expected gift %d to be pending for the user, got %+v", scheduled.ID, pending.Gifts)
+	}
+}
+
+func TestUserCreateAndChangeEmail(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewUserHandler(testDB, billing.ClaimAttach)
+
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := newRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		if path == "/users" {
+			handler.Users(rr, req)
+		} else {
+			handler.User(rr, req)
+		}
+		return rr
+	}
+
+	rr := send(http.MethodPost, "/users", "test-user-create", `{"email": "  New.User@Test.COM "}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var user models.User
+	json.Unmarshal(rr.Body.Bytes(), &user)
+	if user.Email != "new.user@test.com" {
+		t.Errorf("Expected the email to be normalized, got %q", user.Email)
+	}
+
+	if rr := send(http.MethodPost, "/users", "test-user-duplicate", `{"email": "NEW.USER@test.com"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a duplicate email, got %d", rr.Code)
+	}
+	if rr := send(http.MethodPost, "/users", "test-user-invalid", `{"email": "Name <name@test.com>"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid email, got %d", rr.Code)
+	}
+
+	path := fmt.Sprintf("/users/%d", user.ID)
+	if rr := send(http.MethodPatch, path, "test-user-taken", `{"email": "recipient@test.com"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for another user's email, got %d", rr.Code)
+	}
+
+	rr = send(http.MethodPatch, path, "test-user-change", `{"email": "changed@test.com"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req := newRequest(http.MethodGet, "/users?email=Changed@Test.com", nil)
+	rr = httptest.NewRecorder()
+	handler.Users(rr, req)
+
+	var found models.User
+	json.Unmarshal(rr.Body.Bytes(), &found)
+	if rr.Code != http.StatusOK || found.ID != user.ID {
+		t.Errorf("Expected to find user %d by the new email, got %d: %s", user.ID, rr.Code, rr.Body.String())
+	}
 }
 
 func TestMissingIdempotencyKey(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewSubscriptionHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
 
 	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
-	req := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	// No Idempotency-Key header
 
@@ -239,10 +922,10 @@ func TestSubscribeUserNotFound(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewSubscriptionHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
 
 	body := `{"user_id": 9999, "plan": "monthly", "duration_months": 1}`
-	req := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotency-Key", "test-sub-notfound")
 
@@ -258,10 +941,10 @@ func TestResponseTime(t *testing.T) {
 	cleanup := setupTest(t)
 	defer cleanup()
 
-	handler := handlers.NewSubscriptionHandler(testDB)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
 
 	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
-	req := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotency-Key", "test-perf-001")
 
@@ -276,3 +959,304 @@ func TestResponseTime(t *testing.T) {
 
 	t.Logf("Subscribe response time: %v", elapsed)
 }
+
+func TestSubscribeUnknownPlan(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	body := `{"user_id": 100, "plan": "does-not-exist", "duration_months": 1}`
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "test-sub-unknown-plan")
+
+	rr := httptest.NewRecorder()
+	handler.Subscribe(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSubscribeRetiredPlan(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	testDB.Exec("INSERT INTO plans (code, name, price_cents, billing_interval, active) VALUES ('test-retired', 'Retired', 500, 'month', FALSE)")
+	defer testDB.Exec("DELETE FROM plans WHERE code = 'test-retired'")
+
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	body := `{"user_id": 100, "plan": "test-retired", "duration_months": 1}`
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "test-sub-retired-plan")
+
+	rr := httptest.NewRecorder()
+	handler.Subscribe(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPauseAndResumeExtendsEndDate(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	// Subscription paused one day ago
+	var subID int
+	var endDate time.Time
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, paused_at)
+		 VALUES (100, 'paused', NOW() - interval '10 days', NOW() + interval '20 days', NOW() - interval '1 day')
+		 RETURNING id, end_date`,
+	).Scan(&subID, &endDate)
+
+	req := newRequest(http.MethodPost, fmt.Sprintf("/subscriptions/%d/resume", subID), nil)
+	req.Header.Set("Idempotency-Key", "test-resume-001")
+
+	rr := httptest.NewRecorder()
+	handler.Subscriptions(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	sub, _ := testDB.GetSubscriptionByID(subID)
+	if sub.Status != models.StatusActive {
+		t.Errorf("Expected status 'active', got %s", sub.Status)
+	}
+	if shift := sub.EndDate.Sub(endDate); shift < 23*time.Hour || shift > 25*time.Hour {
+		t.Errorf("Expected end_date to shift by about a day, shifted by %v", shift)
+	}
+}
+
+func TestImmediateUpgradeChargesCard(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	testDB.Exec("INSERT INTO plans (code, name, price_cents, billing_interval) VALUES ('test-premium', 'Premium', 2999, 'month')")
+	defer testDB.Exec("DELETE FROM plans WHERE code = 'test-premium'")
+
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	var subID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, plan_code, status, start_date, end_date)
+		 VALUES (100, 'monthly', 'active', NOW() - interval '10 days', NOW() + interval '20 days')
+		 RETURNING id`,
+	).Scan(&subID)
+
+	changePlan := func(key string) *httptest.ResponseRecorder {
+		body := `{"plan": "test-premium", "apply_at": "now"}`
+		req := newRequest(http.MethodPost, fmt.Sprintf("/subscriptions/%d/change-plan", subID), bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler.Subscriptions(rr, req)
+		return rr
+	}
+
+	// A declined upgrade leaves the subscription on its old plan
+	testPayments.Script(payments.Decline)
+	if rr := changePlan("test-upgrade-declined"); rr.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected status 402, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if sub, _ := testDB.GetSubscriptionByID(subID); sub.PlanCode != "monthly" {
+		t.Errorf("Expected declined upgrade to keep plan monthly, got %s", sub.PlanCode)
+	}
+
+	rr := changePlan("test-upgrade-paid")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Proration billing.Proration `json:"proration"`
+		Invoice   models.Invoice    `json:"invoice"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if response.Invoice.Status != models.InvoicePaid || response.Invoice.TotalCents != response.Proration.NetCents {
+		t.Errorf("Expected a paid invoice for %d, got %s for %d", response.Proration.NetCents, response.Invoice.Status, response.Invoice.TotalCents)
+	}
+
+	var charged int64
+	testDB.QueryRow(`SELECT COALESCE(SUM(amount_cents), 0) FROM payments WHERE invoice_id = $1 AND status = 'captured'`,
+		response.Invoice.ID).Scan(&charged)
+	if charged != response.Proration.NetCents {
+		t.Errorf("Expected the card to be charged %d, got %d", response.Proration.NetCents, charged)
+	}
+}
+
+func TestTrialOnlyOncePerUser(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	body := `{"user_id": 100, "plan": "monthly", "trial": true}`
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "test-trial-001")
+
+	rr := httptest.NewRecorder()
+	handler.Subscribe(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+
+	if response["status"] != "pending" {
+		t.Errorf("Expected status 'pending', got %v", response["status"])
+	}
+
+	// Expire the trial so the user has no current subscription
+	testDB.Exec("UPDATE subscriptions SET status = 'expired' WHERE user_id = 100")
+
+	req2 := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req2.Header.Set("Content-Type", "application/json")
+	req2.Header.Set("Idempotency-Key", "test-trial-002")
+
+	rr2 := httptest.NewRecorder()
+	handler.Subscribe(rr2, req2)
+
+	if rr2.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 Conflict, got %d: %s", rr2.Code, rr2.Body.String())
+	}
+}
+
+func TestCouponRedemptionLimit(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	testDB.Exec(`INSERT INTO coupons (code, kind, percent_off, max_redemptions) VALUES ('ONCE', 'percent', 50, 1)`)
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	body := `{"gifter_id": 100, "recipient_email": "friend@test.com", "duration_months": 2, "coupon": "once"}`
+	req := newRequest(http.MethodPost, "/gift", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "test-coupon-001")
+
+	rr := httptest.NewRecorder()
+	handler.CreateGift(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+
+	// Two months of the seeded monthly plan (999) at 50% off
+	if response["amount_cents"].(float64) != 999 {
+		t.Errorf("Expected amount_cents 999, got %v", response["amount_cents"])
+	}
+
+	req2 := newRequest(http.MethodPost, "/gift", bytes.NewBufferString(body))
+	req2.Header.Set("Content-Type", "application/json")
+	req2.Header.Set("Idempotency-Key", "test-coupon-002")
+
+	rr2 := httptest.NewRecorder()
+	handler.CreateGift(rr2, req2)
+
+	if rr2.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 Conflict, got %d: %s", rr2.Code, rr2.Body.String())
+	}
+}
+
+func TestSubscribeIssuesInvoice(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	body := `{"user_id": 100, "plan": "monthly", "duration_months": 3}`
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "test-invoice-001")
+
+	rr := httptest.NewRecorder()
+	handler.Subscribe(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	invoiceHandler := handlers.NewInvoiceHandler(testDB)
+
+	req2 := newRequest(http.MethodGet, "/users/100/invoices", nil)
+	rr2 := httptest.NewRecorder()
+	invoiceHandler.UserInvoices(rr2, req2)
+
+	if rr2.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr2.Code, rr2.Body.String())
+	}
+
+	var response struct {
+		Invoices []models.Invoice `json:"invoices"`
+	}
+	json.Unmarshal(rr2.Body.Bytes(), &response)
+
+	if len(response.Invoices) != 1 {
+		t.Fatalf("Expected 1 invoice, got %d", len(response.Invoices))
+	}
+
+	invoice := response.Invoices[0]
+	if !strings.HasPrefix(invoice.Number, "INV-") {
+		t.Errorf("Expected invoice number to start with INV-, got %s", invoice.Number)
+	}
+	// Three months of the seeded monthly plan (999)
+	if invoice.TotalCents != 2997 {
+		t.Errorf("Expected total_cents 2997, got %d", invoice.TotalCents)
+	}
+}
+
+func TestSubscribeDeclinedChargeRollsBack(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	testPayments.Script(payments.Decline)
+	handler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	body := `{"user_id": 100, "plan": "monthly", "duration_months": 1}`
+	req := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "test-payment-001")
+
+	rr := httptest.NewRecorder()
+	handler.Subscribe(rr, req)
+
+	if rr.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected status 402, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	subs, _ := testDB.GetUserSubscriptions(100)
+	if len(subs) != 0 {
+		t.Errorf("Expected declined subscribe to leave no subscription, got %d", len(subs))
+	}
+
+	// The same request succeeds once the card goes through
+	req2 := newRequest(http.MethodPost, "/subscribe", bytes.NewBufferString(body))
+	req2.Header.Set("Content-Type", "application/json")
+	req2.Header.Set("Idempotency-Key", "test-payment-001")
+
+	rr2 := httptest.NewRecorder()
+	handler.Subscribe(rr2, req2)
+
+	if rr2.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr2.Code, rr2.Body.String())
+	}
+
+	var paymentCount int
+	testDB.QueryRow(`SELECT COUNT(*) FROM payments WHERE user_id = 100 AND status = 'captured'`).Scan(&paymentCount)
+	if paymentCount != 1 {
+		t.Errorf("Expected 1 captured payment, got %d", paymentCount)
+	}
+}
@@ -0,0 +1,225 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/auth"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/handlers"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/middleware"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+var testJWTSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func testKeySet(t *testing.T, extra ...string) *auth.KeySet {
+	keys := fmt.Sprintf(`{"kty": "oct", "kid": "hs", "k": %q}`, base64.RawURLEncoding.EncodeToString(testJWTSecret))
+	for _, key := range extra {
+		keys += ", " + key
+	}
+	ks, err := auth.ParseKeySet([]byte(`{"keys": [` + keys + `]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse key set: %v", err)
+	}
+	ks.Issuer, ks.Audience = "https://id.test", "subscriptions"
+	return ks
+}
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signHS256 signs claims with secret under the "hs" key
+func signHS256(secret []byte, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "HS256", "kid": "hs"}) + "." + encodeSegment(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func userClaims(sub string, expiresIn time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"sub": sub,
+		"iss": "https://id.test",
+		"aud": []string{"subscriptions", "other"},
+		"exp": time.Now().Add(expiresIn).Unix(),
+	}
+}
+
+func TestJWTVerification(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	var x, y [32]byte
+	ecKey.X.FillBytes(x[:])
+	ecKey.Y.FillBytes(y[:])
+	ks := testKeySet(t, fmt.Sprintf(`{"kty": "EC", "kid": "es", "crv": "P-256", "x": %q, "y": %q}`,
+		base64.RawURLEncoding.EncodeToString(x[:]), base64.RawURLEncoding.EncodeToString(y[:])))
+
+	now := time.Now()
+	claims, err := ks.Verify(signHS256(testJWTSecret, userClaims("100", time.Hour)), now)
+	if err != nil || claims.Subject != "100" {
+		t.Fatalf("Expected a valid HS256 token for subject 100, got %+v (%v)", claims, err)
+	}
+
+	// ES256 signatures are r || s, each padded to 32 bytes
+	signed := encodeSegment(map[string]string{"alg": "ES256", "kid": "es"}) + "." + encodeSegment(userClaims("101", time.Hour))
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	var signature [64]byte
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	if claims, err := ks.Verify(signed+"."+base64.RawURLEncoding.EncodeToString(signature[:]), now); err != nil || claims.Subject != "101" {
+		t.Errorf("Expected a valid ES256 token for subject 101, got %+v (%v)", claims, err)
+	}
+
+	wrongAudience := userClaims("100", time.Hour)
+	wrongAudience["aud"] = "other"
+	unsigned := encodeSegment(map[string]string{"alg": "none", "kid": "hs"}) + "." + encodeSegment(userClaims("100", time.Hour)) + "."
+	// An HS256 token naming the EC key must not be checked with the EC
+	// key's public coordinates as a shared secret
+	confused := encodeSegment(map[string]string{"alg": "HS256", "kid": "es"}) + "." + encodeSegment(userClaims("100", time.Hour)) + ".c2ln"
+	noExpiry := userClaims("100", time.Hour)
+	delete(noExpiry, "exp")
+
+	rejected := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"expired", signHS256(testJWTSecret, userClaims("100", -2*auth.ClockSkew)), auth.ErrTokenExpired},
+		{"no expiry", signHS256(testJWTSecret, noExpiry), auth.ErrTokenExpired},
+		{"wrong key", signHS256([]byte("another secret of thirty-two bytes"), userClaims("100", time.Hour)), auth.ErrBadSignature},
+		{"wrong audience", signHS256(testJWTSecret, wrongAudience), auth.ErrWrongAudience},
+		{"alg none", unsigned, auth.ErrBadSignature},
+		{"alg confusion", confused, auth.ErrBadSignature},
+		{"garbage", "not-a-token", auth.ErrMalformedToken},
+	}
+	for _, tc := range rejected {
+		if _, err := ks.Verify(tc.token, now); err != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+// testAPIKeys is an in-memory APIKeyStore
+type testAPIKeys map[string]*models.APIKey
+
+func (k testAPIKeys) GetAPIKeyByHash(hash string) (*models.APIKey, error) {
+	return k[hash], nil
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+	key, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("Failed to generate API key: %v", err)
+	}
+	revokedKey, _, revokedHash, _ := auth.GenerateAPIKey()
+	revokedAt := time.Now()
+	store := testAPIKeys{
+		hash:        {ID: 7, Name: "billing-sync", Prefix: prefix, KeyHash: hash},
+		revokedHash: {ID: 8, Name: "old", KeyHash: revokedHash, RevokedAt: &revokedAt},
+	}
+
+	var seen *auth.Principal
+	handler := middleware.Authenticate(testKeySet(t), store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = auth.FromContext(r.Context())
+	}))
+
+	send := func(header, value string) int {
+		seen = nil
+		req := httptest.NewRequest(http.MethodGet, "/users/100", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send("Authorization", "Bearer "+signHS256(testJWTSecret, userClaims("100", time.Hour))); code != http.StatusOK ||
+		seen == nil || seen.Kind != auth.PrincipalUser || seen.UserID != 100 {
+		t.Errorf("Expected user 100 from a bearer token, got %d with %+v", code, seen)
+	}
+	if code := send(middleware.APIKeyHeader, key); code != http.StatusOK ||
+		seen == nil || seen.Kind != auth.PrincipalService || seen.APIKeyID != 7 {
+		t.Errorf("Expected API key 7, got %d with %+v", code, seen)
+	}
+
+	for name, code := range map[string]int{
+		"no credentials":  send("", ""),
+		"revoked key":     send(middleware.APIKeyHeader, revokedKey),
+		"unknown key":     send(middleware.APIKeyHeader, key+"x"),
+		"non-user sub":    send("Authorization", "Bearer "+signHS256(testJWTSecret, userClaims("admin", time.Hour))),
+		"expired token":   send("Authorization", "Bearer "+signHS256(testJWTSecret, userClaims("100", -time.Hour))),
+		"basic auth only": send("Authorization", "Basic dXNlcjpwYXNz"),
+	} {
+		if code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status 401, got %d", name, code)
+		}
+	}
+}
+
+func TestUserCannotActForAnotherUser(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	user := &auth.Principal{Kind: auth.PrincipalUser, UserID: 101}
+	subHandler := handlers.NewSubscriptionHandler(testDB, testPayments, billing.DefaultRefundPolicy)
+
+	body := bytes.NewBufferString(`{"user_id": 100, "duration_months": 1}`)
+	req := httptest.NewRequest(http.MethodPost, "/subscribe", body)
+	req.Header.Set("Idempotency-Key", "test-auth-subscribe-other")
+	req = req.WithContext(auth.WithPrincipal(req.Context(), user))
+	rr := httptest.NewRecorder()
+	subHandler.Subscribe(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 subscribing another user, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Administrative endpoints need an API key
+	userHandler := handlers.NewUserHandler(testDB, billing.ClaimAttach)
+	req = httptest.NewRequest(http.MethodGet, "/users?email=testuser@test.com", nil)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), user))
+	rr = httptest.NewRecorder()
+	userHandler.Users(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 looking up users as a user, got %d", rr.Code)
+	}
+
+	// Requests that skipped the auth middleware are turned away
+	req = httptest.NewRequest(http.MethodGet, "/users?email=testuser@test.com", nil)
+	rr = httptest.NewRecorder()
+	userHandler.Users(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a principal, got %d", rr.Code)
+	}
+
+	// The same request as user 100 goes through
+	body = bytes.NewBufferString(`{"user_id": 100, "duration_months": 1}`)
+	req = httptest.NewRequest(http.MethodPost, "/subscribe", body)
+	req.Header.Set("Idempotency-Key", "test-auth-subscribe-self")
+	req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{Kind: auth.PrincipalUser, UserID: 100}))
+	rr = httptest.NewRecorder()
+	subHandler.Subscribe(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected status 201 subscribing yourself, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
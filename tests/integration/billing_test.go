@@ -0,0 +1,223 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+)
+
+var (
+	monthlyPlan = &models.Plan{Code: "monthly", PriceCents: 1000, Currency: "USD", BillingInterval: models.IntervalMonth}
+	annualPlan  = &models.Plan{Code: "annual", PriceCents: 12000, Currency: "USD", BillingInterval: models.IntervalYear}
+)
+
+func TestProrateImmediateUpgrade(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Half of an average month remains
+	periodEnd := now.Add(365 * 24 * time.Hour / 24)
+
+	p := billing.Prorate(monthlyPlan, annualPlan, now, periodEnd, billing.ApplyNow)
+
+	if p.CreditCents != 500 {
+		t.Errorf("Expected credit 500, got %d", p.CreditCents)
+	}
+	if p.ChargeCents != 500 {
+		t.Errorf("Expected charge 500, got %d", p.ChargeCents)
+	}
+	if p.NetCents != 0 {
+		t.Errorf("Expected net 0, got %d", p.NetCents)
+	}
+	if !p.EffectiveAt.Equal(now) {
+		t.Errorf("Expected effective_at %v, got %v", now, p.EffectiveAt)
+	}
+}
+
+func TestProrateAtPeriodEnd(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := now.AddDate(0, 0, 10)
+
+	p := billing.Prorate(annualPlan, monthlyPlan, now, periodEnd, billing.ApplyPeriodEnd)
+
+	if p.CreditCents != 0 || p.ChargeCents != 0 || p.NetCents != 0 {
+		t.Errorf("Expected no proration at period end, got %+v", p)
+	}
+	if !p.EffectiveAt.Equal(periodEnd) {
+		t.Errorf("Expected effective_at %v, got %v", periodEnd, p.EffectiveAt)
+	}
+}
+
+func TestProrateExpiredPeriod(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	p := billing.Prorate(monthlyPlan, annualPlan, now, now.Add(-time.Hour), billing.ApplyNow)
+
+	if p.RemainingSeconds != 0 || p.NetCents != 0 {
+		t.Errorf("Expected nothing to prorate, got %+v", p)
+	}
+}
+
+func TestApplyCouponCapsAtSubtotal(t *testing.T) {
+	amountOff := int64(5000)
+	coupon := &models.Coupon{Code: "BIG", Kind: models.CouponAmount, AmountOffCents: &amountOff}
+
+	d := billing.ApplyCoupon(coupon, 999)
+
+	if d.DiscountCents != 999 || d.TotalCents != 0 {
+		t.Errorf("Expected discount capped at 999 with total 0, got %+v", d)
+	}
+}
+
+func TestCheckCouponPlanRestriction(t *testing.T) {
+	coupon := &models.Coupon{Code: "ANNUAL", Kind: models.CouponFreeMonths, Active: true, PlanCodes: []string{"annual"}}
+
+	if err := billing.CheckCoupon(coupon, monthlyPlan, time.Now()); err != billing.ErrCouponPlanRestricted {
+		t.Errorf("Expected ErrCouponPlanRestricted, got %v", err)
+	}
+	if err := billing.CheckCoupon(coupon, annualPlan, time.Now()); err != nil {
+		t.Errorf("Expected coupon to apply to annual plan, got %v", err)
+	}
+}
+
+func TestRetryScheduleExhausts(t *testing.T) {
+	schedule, err := billing.ParseRetrySchedule("1, 3,5,7")
+	if err != nil {
+		t.Fatalf("Expected schedule to parse, got %v", err)
+	}
+
+	dueAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	next, ok := schedule.NextAttempt(dueAt, 2)
+	if !ok || !next.Equal(dueAt.AddDate(0, 0, 3)) {
+		t.Errorf("Expected second retry on day 3, got %v (%v)", next, ok)
+	}
+	if _, ok := schedule.NextAttempt(dueAt, 5); ok {
+		t.Error("Expected no retry after the schedule is exhausted")
+	}
+
+	if _, err := billing.ParseRetrySchedule("3,1"); err == nil {
+		t.Error("Expected decreasing retry days to be rejected")
+	}
+}
+
+func TestCancellationRefundPolicies(t *testing.T) {
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	invoice := &models.Invoice{ID: 1, TotalCents: 800, Currency: "USD", IssuedAt: now.AddDate(0, 0, -3)}
+	// Half of an average month remains
+	paidThrough := now.Add(365 * 24 * time.Hour / 24)
+
+	prorated := billing.CancellationRefund(billing.RefundPolicy{Mode: billing.RefundProrated}, monthlyPlan, invoice, now, paidThrough)
+	if prorated.AmountCents != 500 {
+		t.Errorf("Expected prorated refund 500, got %d", prorated.AmountCents)
+	}
+
+	// Refunds are capped at what the invoice collected
+	full := billing.CancellationRefund(billing.RefundPolicy{Mode: billing.RefundFull, WindowDays: 7}, annualPlan, invoice, now, paidThrough)
+	if full.AmountCents != 800 {
+		t.Errorf("Expected full refund 800, got %d", full.AmountCents)
+	}
+
+	late := billing.CancellationRefund(billing.RefundPolicy{Mode: billing.RefundFull, WindowDays: 2}, monthlyPlan, invoice, now, paidThrough)
+	if late.AmountCents != 0 {
+		t.Errorf("Expected no refund outside the window, got %d", late.AmountCents)
+	}
+
+	// Only what the card paid goes back to it
+	invoice.CreditCents = 200
+	split := billing.CancellationRefund(billing.RefundPolicy{Mode: billing.RefundFull, WindowDays: 7}, annualPlan, invoice, now, paidThrough)
+	if split.AmountCents != 800 || split.RefundCents != 600 || split.CreditCents != 200 {
+		t.Errorf("Expected 600 refunded and 200 credited, got %+v", split)
+	}
+	invoice.CreditCents = 800
+	credited := billing.CancellationRefund(billing.RefundPolicy{Mode: billing.RefundProrated}, monthlyPlan, invoice, now, paidThrough)
+	if credited.RefundCents != 0 || credited.CreditCents != 500 {
+		t.Errorf("Expected a credit-paid invoice to be credited, got %+v", credited)
+	}
+	invoice.CreditCents = 0
+
+	none := billing.CancellationRefund(billing.DefaultRefundPolicy, monthlyPlan, invoice, now, paidThrough)
+	if none.AmountCents != 0 {
+		t.Errorf("Expected no refund under the default policy, got %d", none.AmountCents)
+	}
+
+	if _, err := billing.ParseRefundPolicy("full", 0); err == nil {
+		t.Error("Expected full refunds without a window to be rejected")
+	}
+}
+
+func TestGiftRevocationSplit(t *testing.T) {
+	gift := &models.Gift{AmountCents: 1000, Currency: "USD"}
+
+	// A batch of three gifts, a third of it paid from account credit
+	invoice := &models.Invoice{TotalCents: 3000, CreditCents: 1000, Currency: "USD"}
+	refund, credit := billing.GiftRevocation(gift, invoice, billing.RevokeToCard)
+	if refund != 666 || credit != 334 {
+		t.Errorf("Expected 666 refunded and 334 credited, got %d and %d", refund, credit)
+	}
+
+	refund, credit = billing.GiftRevocation(gift, invoice, billing.RevokeToCredit)
+	if refund != 0 || credit != 1000 {
+		t.Errorf("Expected everything credited, got %d refunded and %d credited", refund, credit)
+	}
+
+	// Gifts without an invoice can only go back as credit
+	refund, credit = billing.GiftRevocation(gift, nil, billing.RevokeToCard)
+	if refund != 0 || credit != 1000 {
+		t.Errorf("Expected an uninvoiced gift to be credited, got %d refunded and %d credited", refund, credit)
+	}
+}
+
+func TestJournalEntriesBalance(t *testing.T) {
+	invoice := &models.Invoice{Number: "INV-000001", EntityType: "subscription", EntityID: 1,
+		TotalCents: 999, CreditCents: 300, Currency: "USD"}
+	payment := billing.InvoicePaymentJournal(invoice)
+	if !payment.Balanced() || len(payment.Lines) != 3 {
+		t.Errorf("Expected a balanced three-line entry, got %+v", payment.Lines)
+	}
+
+	// Refunds below, equal to and above what is still deferred
+	for _, refund := range []int64{0, 400, 700} {
+		d := billing.CancellationJournal(1, 500, refund, 0, "USD")
+		if !d.Balanced() {
+			t.Errorf("Expected cancellation with refund %d to balance, got %+v", refund, d.Lines)
+		}
+		if debits, _ := d.Totals(); debits != max(refund, 500) {
+			t.Errorf("Expected debits of %d for refund %d, got %d", max(refund, 500), refund, debits)
+		}
+	}
+
+	if d := billing.CancellationJournal(1, 500, 300, 200, "USD"); !d.Balanced() || len(d.Lines) != 3 {
+		t.Errorf("Expected a balanced three-line entry for a split refund, got %+v", d.Lines)
+	}
+
+	gift := &models.Gift{ID: 1, AmountCents: 999, Currency: "USD"}
+	if d := billing.GiftRedemptionJournal(gift, 2); !d.Balanced() {
+		t.Errorf("Expected gift redemption to balance, got %+v", d.Lines)
+	}
+}
+
+func TestRevenueRecognitionAmounts(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	schedule := &models.RevenueSchedule{AmountCents: 3000, Currency: "USD",
+		StartsAt: start, EndsAt: start.AddDate(0, 0, 30), RecognizedThrough: start}
+
+	if amount := billing.RecognizableAmount(schedule, start.AddDate(0, 0, 10)); amount != 1000 {
+		t.Errorf("Expected 1000 recognized after a third of the period, got %d", amount)
+	}
+	if amount := billing.RecognizableAmount(schedule, start.AddDate(0, 1, 0)); amount != 3000 {
+		t.Errorf("Expected everything recognized past the end, got %d", amount)
+	}
+
+	// Releasing part of the schedule spreads the rest over the time left
+	schedule.RecognizedCents, schedule.ReleasedCents = 1000, 1000
+	schedule.RecognizedThrough = start.AddDate(0, 0, 10)
+	if amount := billing.RecognizableAmount(schedule, start.AddDate(0, 0, 20)); amount != 500 {
+		t.Errorf("Expected 500 recognized after release, got %d", amount)
+	}
+
+	schedules := []models.RevenueSchedule{{AmountCents: 1000, RecognizedCents: 200}, {AmountCents: 1000}}
+	shares := billing.AllocateRelease(schedules, 1500)
+	if shares[0] != 800 || shares[1] != 700 {
+		t.Errorf("Expected release split 800/700, got %v", shares)
+	}
+}
@@ -0,0 +1,46 @@
+package integration
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/giftcode"
+)
+
+func TestGiftCodeChecksum(t *testing.T) {
+	code, err := giftcode.Generate()
+	if err != nil {
+		t.Fatalf("Failed to generate code: %v", err)
+	}
+	if len(code) != 19 || strings.Count(code, "-") != 3 {
+		t.Fatalf("Expected a code like XXXX-XXXX-XXXX-XXXX, got %s", code)
+	}
+
+	// Typed sloppily, the code still normalizes to itself
+	typed := strings.ToLower(strings.ReplaceAll(code, "-", " "))
+	typed = strings.NewReplacer("0", "o", "1", "l").Replace(typed)
+	if normalized, ok := giftcode.Normalize(typed); !ok || normalized != code {
+		t.Errorf("Expected %q to normalize to %s, got %s (%v)", typed, code, normalized, ok)
+	}
+
+	// Every single-symbol substitution is caught by the check symbol
+	const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	for i := range code {
+		if code[i] == '-' {
+			continue
+		}
+		for _, r := range alphabet {
+			if byte(r) == code[i] {
+				continue
+			}
+			mistyped := code[:i] + string(r) + code[i+1:]
+			if _, ok := giftcode.Normalize(mistyped); ok {
+				t.Errorf("Expected %s to fail the checksum", mistyped)
+			}
+		}
+	}
+
+	if _, ok := giftcode.Normalize("ABCD-EFGH"); ok {
+		t.Error("Expected a short code to be rejected")
+	}
+}
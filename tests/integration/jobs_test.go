@@ -0,0 +1,431 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/billing"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/handlers"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/jobs"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/models"
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
+)
+
+func TestSubscriptionExpiryJob(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	var overdueID, currentID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date)
+		 VALUES (100, 'active', NOW() - interval '2 months', NOW() - interval '1 day')
+		 RETURNING id`,
+	).Scan(&overdueID)
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date)
+		 VALUES (101, 'active', NOW(), NOW() + interval '1 month')
+		 RETURNING id`,
+	).Scan(&currentID)
+
+	job := jobs.NewSubscriptionExpiry(testDB, 10)
+	count, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Expiry job failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 expired subscription, got %d", count)
+	}
+
+	overdue, _ := testDB.GetSubscriptionByID(overdueID)
+	if overdue.Status != models.StatusExpired {
+		t.Errorf("Expected overdue subscription to be expired, got %s", overdue.Status)
+	}
+
+	current, _ := testDB.GetSubscriptionByID(currentID)
+	if current.Status != models.StatusActive {
+		t.Errorf("Expected current subscription to stay active, got %s", current.Status)
+	}
+
+	// A second run must not expire anything twice
+	count, err = job.Run(context.Background())
+	if err != nil || count != 0 {
+		t.Errorf("Expected no work on second run, got %d (%v)", count, err)
+	}
+}
+
+func TestGiftExpiryJobQueuesRefund(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	var giftID int
+	testDB.QueryRow(
+		`INSERT INTO gifts (gifter_id, recipient_email, status, duration_months, amount_cents, currency, expires_at)
+		 VALUES (100, 'friend@test.com', 'pending', 3, 2997, 'USD', NOW() - interval '1 hour')
+		 RETURNING id`,
+	).Scan(&giftID)
+
+	job := jobs.NewGiftExpiry(testDB, 10)
+	count, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Gift expiry job failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 expired gift, got %d", count)
+	}
+
+	gift, _ := testDB.GetGiftByID(giftID)
+	if gift.Status != models.GiftExpired {
+		t.Errorf("Expected gift to be expired, got %s", gift.Status)
+	}
+
+	var refundUser int
+	var refundAmount int64
+	testDB.QueryRow(
+		`SELECT user_id, amount_cents FROM refunds WHERE entity_type = 'gift' AND entity_id = $1`,
+		giftID,
+	).Scan(&refundUser, &refundAmount)
+	if refundUser != 100 || refundAmount != 2997 {
+		t.Errorf("Expected refund of 2997 to user 100, got %d to user %d", refundAmount, refundUser)
+	}
+}
+
+func TestRevenueRecognitionJob(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	var subID, scheduleID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date)
+		 VALUES (100, 'active', NOW() - interval '40 days', NOW() - interval '10 days')
+		 RETURNING id`,
+	).Scan(&subID)
+	testDB.QueryRow(
+		`INSERT INTO revenue_schedules (entity_type, entity_id, amount_cents, currency, starts_at, ends_at, recognized_through)
+		 VALUES ('subscription', $1, 3000, 'USD', NOW() - interval '40 days', NOW() - interval '10 days', NOW() - interval '40 days')
+		 RETURNING id`,
+		subID,
+	).Scan(&scheduleID)
+
+	job := jobs.NewRevenueRecognition(testDB, 10)
+	count, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Revenue recognition job failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 recognized schedule, got %d", count)
+	}
+
+	var recognized int64
+	var status string
+	testDB.QueryRow(
+		`SELECT recognized_cents, status FROM revenue_schedules WHERE id = $1`,
+		scheduleID,
+	).Scan(&recognized, &status)
+	if recognized != 3000 || status != string(models.ScheduleCompleted) {
+		t.Errorf("Expected 3000 recognized and completed, got %d (%s)", recognized, status)
+	}
+
+	var credited int64
+	testDB.QueryRow(
+		`SELECT COALESCE(SUM(credit_cents), 0) FROM journal_lines WHERE account = $1`,
+		billing.AccountRecognizedRevenue,
+	).Scan(&credited)
+	if credited != 3000 {
+		t.Errorf("Expected 3000 credited to recognized revenue, got %d", credited)
+	}
+
+	// A second run must not recognize anything twice
+	count, err = job.Run(context.Background())
+	if err != nil || count != 0 {
+		t.Errorf("Expected no work on second run, got %d (%v)", count, err)
+	}
+}
+
+func TestGiftDeliveryJobReleasesScheduledGifts(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	handler := handlers.NewGiftHandler(testDB, testPayments, testRedeemFailures)
+
+	deliverAt := time.Now().Add(time.Hour)
+	body := fmt.Sprintf(`{"gifter_id": 100, "recipient_email": "recipient@test.com", "deliver_at": %q,
+		"message": "Happy birthday!", "sender_name": "Sam"}`, deliverAt.Format(time.RFC3339))
+	req := newRequest(http.MethodPost, "/gift", bytes.NewBufferString(body))
+	req.Header.Set("Idempotency-Key", "test-scheduled-gift")
+	rr := httptest.NewRecorder()
+	handler.CreateGift(rr, req)
+
+	var gift models.Gift
+	json.Unmarshal(rr.Body.Bytes(), &gift)
+	if gift.Status != models.GiftScheduled || gift.Message == nil || *gift.Message != "Happy birthday!" {
+		t.Fatalf("Expected a scheduled gift with its message, got %s", rr.Body.String())
+	}
+
+	// Not redeemable before delivery
+	redeem := newRequest(http.MethodPost, "/gift/redeem",
+		bytes.NewBufferString(fmt.Sprintf(`{"code": %q, "user_id": 101}`, gift.RedemptionCode)))
+	redeem.Header.Set("Idempotency-Key", "test-scheduled-redeem")
+	rr = httptest.NewRecorder()
+	handler.RedeemGift(rr, redeem)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 before delivery, got %d", rr.Code)
+	}
+
+	job := jobs.NewGiftDelivery(testDB, 10)
+	if count, _ := job.Run(context.Background()); count != 0 {
+		t.Errorf("Expected nothing due yet, got %d", count)
+	}
+
+	testDB.Exec(`UPDATE gifts SET deliver_at = NOW() - interval '1 minute' WHERE id = $1`, gift.ID)
+	count, err := job.Run(context.Background())
+	if err != nil || count != 1 {
+		t.Fatalf("Expected 1 delivered gift, got %d (%v)", count, err)
+	}
+
+	delivered, _ := testDB.GetGiftByID(gift.ID)
+	if delivered.Status != models.GiftPending || delivered.DeliveredAt == nil {
+		t.Errorf("Expected the gift to be pending and delivered, got %s", delivered.Status)
+	}
+
+	var events int
+	testDB.QueryRow(
+		`SELECT COUNT(*) FROM events WHERE event_type = $1 AND entity_id = $2`,
+		models.EventGiftDelivered, gift.ID,
+	).Scan(&events)
+	if events != 1 {
+		t.Errorf("Expected one gift.delivered event, got %d", events)
+	}
+}
+
+func TestExpiryCancelsAtPeriodEnd(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	var subID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, cancel_at_period_end)
+		 VALUES (100, 'active', NOW() - interval '1 month', NOW() - interval '1 minute', TRUE)
+		 RETURNING id`,
+	).Scan(&subID)
+
+	if _, err := jobs.NewSubscriptionExpiry(testDB, 10).Run(context.Background()); err != nil {
+		t.Fatalf("Expiry job failed: %v", err)
+	}
+
+	sub, _ := testDB.GetSubscriptionByID(subID)
+	if sub.Status != models.StatusCancelled {
+		t.Errorf("Expected status 'cancelled', got %s", sub.Status)
+	}
+	if sub.CancelledAt == nil {
+		t.Error("Expected cancelled_at to be set")
+	}
+}
+
+func TestTrialEndConvertsWithPaymentMethod(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	testDB.Exec("INSERT INTO payment_methods (user_id, token) VALUES (100, 'tok_test')")
+
+	var paidID, unpaidID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, trial_end, auto_renew)
+		 VALUES (100, 'pending', NOW() - interval '7 days', NOW() - interval '1 minute', NOW() - interval '1 minute', TRUE)
+		 RETURNING id`,
+	).Scan(&paidID)
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, trial_end)
+		 VALUES (101, 'pending', NOW() - interval '7 days', NOW() - interval '1 minute', NOW() - interval '1 minute')
+		 RETURNING id`,
+	).Scan(&unpaidID)
+
+	if _, err := jobs.NewTrialEnd(testDB, 10).Run(context.Background()); err != nil {
+		t.Fatalf("Trial end job failed: %v", err)
+	}
+	if _, err := jobs.NewRenewalCharge(testDB, payments.NewFake(), billing.DefaultRetrySchedule, time.Hour).Run(context.Background()); err != nil {
+		t.Fatalf("Renewal charge job failed: %v", err)
+	}
+
+	paid, _ := testDB.GetSubscriptionByID(paidID)
+	if paid.Status != models.StatusActive {
+		t.Errorf("Expected trial with payment method to convert, got %s", paid.Status)
+	}
+
+	unpaid, _ := testDB.GetSubscriptionByID(unpaidID)
+	if unpaid.Status != models.StatusExpired {
+		t.Errorf("Expected trial without payment method to expire, got %s", unpaid.Status)
+	}
+}
+
+func TestFailedRenewalChargeDunning(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	var subID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, trial_end, auto_renew)
+		 VALUES (100, 'pending', NOW() - interval '7 days', NOW() - interval '1 minute', NOW() - interval '1 minute', TRUE)
+		 RETURNING id`,
+	).Scan(&subID)
+
+	job := jobs.NewRenewalCharge(testDB, payments.NewFake(payments.Decline, payments.Decline), billing.RetrySchedule{1, 3}, time.Hour)
+
+	if _, err := job.Run(context.Background()); err != nil {
+		t.Fatalf("Renewal charge job failed: %v", err)
+	}
+
+	sub, _ := testDB.GetSubscriptionByID(subID)
+	if sub.Status != models.StatusPastDue {
+		t.Fatalf("Expected status 'past_due', got %s", sub.Status)
+	}
+	if sub.NextPaymentAt == nil || !sub.NextPaymentAt.Equal(sub.EndDate.AddDate(0, 0, 1)) {
+		t.Errorf("Expected next attempt one day after %v, got %v", sub.EndDate, sub.NextPaymentAt)
+	}
+
+	// Skip ahead to the last scheduled retry
+	testDB.Exec(`UPDATE subscriptions SET payment_attempts = 2, next_payment_attempt_at = NOW() - interval '1 minute' WHERE id = $1`, subID)
+
+	if _, err := job.Run(context.Background()); err != nil {
+		t.Fatalf("Renewal charge job failed: %v", err)
+	}
+
+	sub, _ = testDB.GetSubscriptionByID(subID)
+	if sub.Status != models.StatusUnpaid {
+		t.Errorf("Expected status 'unpaid', got %s", sub.Status)
+	}
+
+	var attempts int
+	testDB.QueryRow(
+		`SELECT COUNT(*) FROM transactions
+		 WHERE operation_type = 'payment_attempt' AND entity_id = $1 AND metadata->>'result' = 'declined'`,
+		subID,
+	).Scan(&attempts)
+	if attempts != 2 {
+		t.Errorf("Expected 2 declined attempts in the history, got %d", attempts)
+	}
+}
+
+func TestDunningStopsWhenAutoRenewTurnedOff(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	testDB.Exec("INSERT INTO payment_methods (user_id, token) VALUES (100, 'tok_test')")
+
+	var subID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, auto_renew, payment_attempts, next_payment_attempt_at)
+		 VALUES (100, 'past_due', NOW() - interval '1 month', NOW() - interval '1 day', FALSE, 1, NOW() - interval '1 minute')
+		 RETURNING id`,
+	).Scan(&subID)
+
+	count, err := jobs.NewRenewalCharge(testDB, payments.NewFake(), billing.DefaultRetrySchedule, time.Hour).Run(context.Background())
+	if err != nil || count != 0 {
+		t.Fatalf("Expected no retry with auto-renew off, got %d (%v)", count, err)
+	}
+
+	sub, _ := testDB.GetSubscriptionByID(subID)
+	if sub.Status != models.StatusPastDue || sub.PaymentAttempts != 1 {
+		t.Errorf("Expected the subscription left past_due after 1 attempt, got %s after %d", sub.Status, sub.PaymentAttempts)
+	}
+
+	var charged int
+	testDB.QueryRow(`SELECT COUNT(*) FROM payments WHERE user_id = 100`).Scan(&charged)
+	if charged != 0 {
+		t.Errorf("Expected no charge, got %d payments", charged)
+	}
+}
+
+func TestEarlyRenewalFailureKeepsPaidPeriod(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	testDB.Exec("INSERT INTO payment_methods (user_id, token) VALUES (100, 'tok_test')")
+
+	var subID int
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, auto_renew)
+		 VALUES (100, 'active', NOW() - interval '1 month', NOW() + interval '1 hour', TRUE)
+		 RETURNING id`,
+	).Scan(&subID)
+
+	job := jobs.NewRenewalCharge(testDB, payments.NewFake(payments.Decline, payments.Decline), billing.RetrySchedule{1, 3}, 24*time.Hour)
+
+	// The retry waits for end_date, so one run makes one attempt
+	count, err := job.Run(context.Background())
+	if err != nil || count != 1 {
+		t.Fatalf("Expected 1 attempt, got %d (%v)", count, err)
+	}
+
+	sub, _ := testDB.GetSubscriptionByID(subID)
+	if sub.Status != models.StatusActive || sub.PaymentAttempts != 0 {
+		t.Fatalf("Expected the subscription to stay active with no dunning attempts, got %s with %d", sub.Status, sub.PaymentAttempts)
+	}
+	if sub.NextPaymentAt == nil || !sub.NextPaymentAt.Equal(sub.EndDate) {
+		t.Errorf("Expected a retry at %v, got %v", sub.EndDate, sub.NextPaymentAt)
+	}
+
+	// Once end_date has passed a failed charge starts dunning
+	testDB.Exec(`UPDATE subscriptions SET end_date = NOW() - interval '1 minute', next_payment_attempt_at = NOW() - interval '1 minute' WHERE id = $1`, subID)
+
+	if _, err := job.Run(context.Background()); err != nil {
+		t.Fatalf("Renewal charge job failed: %v", err)
+	}
+
+	sub, _ = testDB.GetSubscriptionByID(subID)
+	if sub.Status != models.StatusPastDue || sub.PaymentAttempts != 1 {
+		t.Errorf("Expected status 'past_due' after 1 attempt, got %s after %d", sub.Status, sub.PaymentAttempts)
+	}
+}
+
+func TestAutoRenewalAppliedOncePerPeriod(t *testing.T) {
+	cleanup := setupTest(t)
+	defer cleanup()
+
+	var subID int
+	var endDate time.Time
+	testDB.QueryRow(
+		`INSERT INTO subscriptions (user_id, status, start_date, end_date, auto_renew)
+		 VALUES (100, 'active', NOW() - interval '1 month', NOW() + interval '1 hour', TRUE)
+		 RETURNING id, end_date`,
+	).Scan(&subID, &endDate)
+
+	job := jobs.NewRenewalCharge(testDB, payments.NewFake(), billing.DefaultRetrySchedule, 24*time.Hour)
+
+	count, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Renewal charge job failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 renewal, got %d", count)
+	}
+
+	var extended bool
+	testDB.QueryRow(
+		`SELECT end_date = $2::timestamp + interval '1 month' FROM subscriptions WHERE id = $1`,
+		subID, endDate,
+	).Scan(&extended)
+	if !extended {
+		t.Error("Expected end_date to be extended by one month")
+	}
+
+	var renewKey string
+	testDB.QueryRow(
+		`SELECT idempotency_key FROM transactions WHERE operation_type = 'renew' AND entity_id = $1`,
+		subID,
+	).Scan(&renewKey)
+	if renewKey != jobs.RenewalKey(subID, endDate) {
+		t.Errorf("Expected renewal key %s, got %s", jobs.RenewalKey(subID, endDate), renewKey)
+	}
+
+	// The new period is outside the lead window, so nothing renews twice
+	count, err = job.Run(context.Background())
+	if err != nil || count != 0 {
+		t.Errorf("Expected no work on second run, got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,44 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jeet-patel/subscription-commerce-backend/internal/payments"
+)
+
+func TestFakeProviderScriptedOutcomes(t *testing.T) {
+	fake := payments.NewFake(payments.Decline, payments.Timeout)
+	req := payments.ChargeRequest{Token: "tok_test", AmountCents: 999, Currency: "USD"}
+
+	if _, err := fake.Authorize(context.Background(), req); err != payments.ErrDeclined {
+		t.Errorf("Expected ErrDeclined, got %v", err)
+	}
+	if _, err := fake.Authorize(context.Background(), req); err != payments.ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+
+	auth, err := payments.Charge(context.Background(), fake, req)
+	if err != nil {
+		t.Fatalf("Expected charge to succeed once the script is used up, got %v", err)
+	}
+	if auth.ID != "fake_auth_000001" {
+		t.Errorf("Expected deterministic id fake_auth_000001, got %s", auth.ID)
+	}
+
+	if _, err := fake.Refund(context.Background(), auth.ID, 1000); err != payments.ErrAmountExceedsAuth {
+		t.Errorf("Expected refund above the captured amount to fail, got %v", err)
+	}
+	if err := fake.Void(context.Background(), auth.ID); err != payments.ErrInvalidState {
+		t.Errorf("Expected void of a captured charge to fail, got %v", err)
+	}
+}
+
+func TestFakeProviderDeclineToken(t *testing.T) {
+	fake := payments.NewFake()
+
+	_, err := payments.Charge(context.Background(), fake, payments.ChargeRequest{Token: payments.DeclineToken, AmountCents: 999})
+	if err != payments.ErrDeclined {
+		t.Errorf("Expected ErrDeclined, got %v", err)
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"os"
 	"sort"
 	"sync"
 	"time"
 )
 
+// apiKey authenticates every request but /health
+var apiKey = os.Getenv("API_KEY")
+
 type Stats struct {
 	TotalRequests  int
 	SuccessCount   int
@@ -102,6 +106,7 @@ func runIdempotencyTest(baseURL string, retryCount int) *Stats {
 		req, _ := http.NewRequest("POST", baseURL+"/subscribe", bytes.NewBufferString(body))
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Idempotency-Key", idempotencyKey)
+		req.Header.Set("X-API-Key", apiKey)
 
 		client := &http.Client{Timeout: 10 * time.Second}
 		resp, err := client.Do(req)
@@ -158,7 +163,9 @@ func runMixedLoadTest(baseURL string, totalRequests, concurrency int) *Stats {
 			if reqNum%10 < 7 {
 				resp, err = http.Get(baseURL + "/health")
 			} else {
-				resp, err = http.Get(baseURL + "/subscriptions/1")
+				req, _ := http.NewRequest("GET", baseURL+"/subscriptions/1", nil)
+				req.Header.Set("X-API-Key", apiKey)
+				resp, err = http.DefaultClient.Do(req)
 			}
 
 			duration := time.Since(start)